@@ -3,6 +3,7 @@ package expr
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/grafana/grafana/pkg/expr/mathexp"
@@ -45,18 +46,36 @@ type Node interface {
 type DataPipeline []Node
 
 // execute runs all the command/datasource requests in the pipeline return a
-// map of the refId of the of each command
+// map of the refId of the of each command. If datasource queries fail, the other
+// queries are still run so that the errors of all of them are returned as QueryErrors.
 func (dp *DataPipeline) execute(c context.Context, s *Service) (mathexp.Vars, error) {
 	vars := make(mathexp.Vars)
+	var queryErrors QueryErrors
 	for _, node := range *dp {
+		if len(queryErrors) > 0 && node.NodeType() != TypeDatasourceNode {
+			// The command may depend on a failed query.
+			continue
+		}
 		res, err := node.Execute(c, vars, s)
 		if err != nil {
+			var queryError QueryError
+			if errors.As(err, &queryError) {
+				queryErrors = append(queryErrors, queryError)
+				continue
+			}
 			return nil, err
 		}
 
 		vars[node.RefID()] = res
 	}
-	return vars, nil
+	switch len(queryErrors) {
+	case 0:
+		return vars, nil
+	case 1:
+		return nil, queryErrors[0]
+	default:
+		return nil, queryErrors
+	}
 }
 
 // BuildPipeline builds a graph of the nodes, and returns the nodes in an
@@ -1,9 +1,12 @@
 package expr
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/expr/mathexp"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/stretchr/testify/require"
 )
@@ -241,6 +244,50 @@ func TestServicebuildPipeLine(t *testing.T) {
 	}
 }
 
+func TestDataPipelineExecute_QueryErrors(t *testing.T) {
+	errDown := errors.New("datasource is down")
+	failed := func(refID string) *fakeNode {
+		return &fakeNode{refID: refID, nodeType: TypeDatasourceNode, err: QueryError{RefID: refID, Err: errDown}}
+	}
+
+	t.Run("the errors of all failed queries are returned", func(t *testing.T) {
+		cmd := &fakeNode{refID: "B", nodeType: TypeCMDNode}
+		dp := DataPipeline{failed("A"), cmd, failed("C"), &fakeNode{refID: "D", nodeType: TypeDatasourceNode}}
+		_, err := dp.execute(context.Background(), &Service{})
+		var queryErrors QueryErrors
+		require.ErrorAs(t, err, &queryErrors)
+		require.Equal(t, QueryErrors{{RefID: "A", Err: errDown}, {RefID: "C", Err: errDown}}, queryErrors)
+		require.False(t, cmd.executed)
+	})
+
+	t.Run("the error of a single failed query is returned as is", func(t *testing.T) {
+		dp := DataPipeline{failed("A"), &fakeNode{refID: "B", nodeType: TypeDatasourceNode}}
+		_, err := dp.execute(context.Background(), &Service{})
+		var queryError QueryError
+		require.ErrorAs(t, err, &queryError)
+		require.Equal(t, "A", queryError.RefID)
+		var queryErrors QueryErrors
+		require.False(t, errors.As(err, &queryErrors))
+	})
+}
+
+type fakeNode struct {
+	refID    string
+	nodeType NodeType
+	err      error
+	executed bool
+}
+
+func (n *fakeNode) ID() int64          { return 0 }
+func (n *fakeNode) NodeType() NodeType { return n.nodeType }
+func (n *fakeNode) RefID() string      { return n.refID }
+func (n *fakeNode) String() string     { return n.refID }
+
+func (n *fakeNode) Execute(_ context.Context, _ mathexp.Vars, _ *Service) (mathexp.Results, error) {
+	n.executed = true
+	return mathexp.Results{}, n.err
+}
+
 func getRefIDOrder(nodes []Node) []string {
 	ids := make([]string, 0, len(nodes))
 	for _, n := range nodes {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
@@ -35,6 +36,17 @@ func (e QueryError) Unwrap() error {
 	return e.Err
 }
 
+// QueryErrors are the errors of several queries that failed in the same request.
+type QueryErrors []QueryError
+
+func (e QueryErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
 // baseNode includes common properties used across DPNodes.
 type baseNode struct {
 	id    int64
@@ -21,6 +21,14 @@ func TestQueryError_Error(t *testing.T) {
 	assert.EqualError(t, e, "failed to execute query A: this is an error message")
 }
 
+func TestQueryErrors_Error(t *testing.T) {
+	e := QueryErrors{
+		{RefID: "A", Err: errors.New("timeout")},
+		{RefID: "B", Err: errors.New("bad gateway")},
+	}
+	assert.EqualError(t, e, "failed to execute query A: timeout; failed to execute query B: bad gateway")
+}
+
 func TestQueryError_Unwrap(t *testing.T) {
 	t.Run("errors.Is", func(t *testing.T) {
 		expectedIsErr := errors.New("expected")
@@ -82,6 +82,10 @@ type Result struct {
 	// It does not contain values for classic conditions as the values
 	// in classic conditions do not have a RefID.
 	Values map[string]NumberValueCapture
+
+	// InstanceOrder, if set, are the names of the labels of Instance in the order they
+	// were returned by the datasource, which is lost in Instance.
+	InstanceOrder []string
 }
 
 // State is an enum of the evaluation State for an alert instance.
@@ -441,6 +445,7 @@ func evaluateExecutionResult(execResults ExecutionResults, ts time.Time) Results
 			EvaluationDuration: time.Since(ts),
 			EvaluationString:   extractEvalString(f),
 			Values:             extractValues(f),
+			InstanceOrder:      extractLabelOrder(f.Fields[0]),
 		}
 
 		switch {
@@ -1,6 +1,7 @@
 package eval
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -8,6 +9,8 @@ import (
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/stretchr/testify/require"
 	ptr "github.com/xorcare/pointer"
+
+	"github.com/grafana/grafana/pkg/expr"
 )
 
 func TestEvaluateExecutionResult(t *testing.T) {
@@ -31,6 +34,22 @@ func TestEvaluateExecutionResult(t *testing.T) {
 				},
 			},
 		},
+		{
+			desc: "labels named by the datasource keep their order",
+			execResults: ExecutionResults{
+				Results: []*data.Frame{
+					data.NewFrame("", data.NewField(`up{zone="eu", job="api"}`, data.Labels{"job": "api", "zone": "eu"}, []*float64{ptr.Float64(1)})),
+				},
+			},
+			expectResultLength: 1,
+			expectResults: Results{
+				{
+					State:         Alerting,
+					Instance:      data.Labels{"job": "api", "zone": "eu"},
+					InstanceOrder: []string{"zone", "job"},
+				},
+			},
+		},
 		{
 			desc: "non-zero valued single instance is single Alerting state result",
 			execResults: ExecutionResults{
@@ -287,6 +306,7 @@ func TestEvaluateExecutionResult(t *testing.T) {
 			for i, r := range res {
 				require.Equal(t, tc.expectResults[i].State, r.State)
 				require.Equal(t, tc.expectResults[i].Instance, r.Instance)
+				require.Equal(t, tc.expectResults[i].InstanceOrder, r.InstanceOrder)
 				if tc.expectResults[i].State == Error {
 					require.EqualError(t, tc.expectResults[i].Error, r.Error.Error())
 				}
@@ -340,3 +360,17 @@ func TestEvaluateExecutionResultsNoData(t *testing.T) {
 		require.ElementsMatch(t, []string{"A,B", "C"}, refIDs)
 	})
 }
+
+func TestEvaluateExecutionResult_QueryErrors(t *testing.T) {
+	queryErrors := expr.QueryErrors{
+		{RefID: "A", Err: errors.New("datasource is down")},
+		{RefID: "B", Err: errors.New("datasource is down")},
+	}
+	res := evaluateExecutionResult(ExecutionResults{Error: queryErrors}, time.Time{})
+	require.Len(t, res, 1)
+	require.Equal(t, Error, res[0].State)
+
+	var actual expr.QueryErrors
+	require.ErrorAs(t, res[0].Error, &actual)
+	require.Equal(t, queryErrors, actual)
+}
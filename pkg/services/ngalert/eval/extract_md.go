@@ -2,6 +2,7 @@ package eval
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
@@ -70,6 +71,11 @@ func extractEvalString(frame *data.Frame) (s string) {
 // in the frame. It does not return values for classic conditions as the values
 // in classic conditions do not have a RefID. It returns nil if there are
 // no results in the frame.
+//
+// Values captured more than once for the same RefID are not overwritten. Instead,
+// the first value is stored under the RefID and the others under the keys RefID_1,
+// RefID_2, and so on, skipping keys that are the RefID of another value. Var is kept
+// as the RefID so the duplicates can be detected.
 func extractValues(frame *data.Frame) map[string]NumberValueCapture {
 	if frame == nil {
 		return nil
@@ -78,11 +84,68 @@ func extractValues(frame *data.Frame) map[string]NumberValueCapture {
 		return nil
 	}
 	if caps, ok := frame.Meta.Custom.([]NumberValueCapture); ok {
+		refIDs := make(map[string]struct{}, len(caps))
+		for _, c := range caps {
+			refIDs[c.Var] = struct{}{}
+		}
 		v := make(map[string]NumberValueCapture, len(caps))
 		for _, c := range caps {
-			v[c.Var] = c
+			if _, ok := v[c.Var]; !ok {
+				v[c.Var] = c
+				continue
+			}
+			for i := 1; ; i++ {
+				k := fmt.Sprintf("%s_%d", c.Var, i)
+				_, used := v[k]
+				_, reserved := refIDs[k]
+				if !used && !reserved {
+					v[k] = c
+					break
+				}
+			}
 		}
 		return v
 	}
 	return nil
 }
+
+// extractLabelOrder returns the names of the labels of the field in the order they were
+// returned by the datasource. Labels are a map, so the order is only known from a series
+// name such as metric{job="api", instance="a"}, which is taken from the display name of
+// the field set by the datasource, or from the name of the field. It returns nil if
+// neither is a series name. Names that are not labels of the field are skipped.
+func extractLabelOrder(field *data.Field) []string {
+	if field == nil || len(field.Labels) == 0 {
+		return nil
+	}
+	name := field.Name
+	if field.Config != nil && field.Config.DisplayNameFromDS != "" {
+		name = field.Config.DisplayNameFromDS
+	}
+	start := strings.IndexByte(name, '{')
+	if start < 0 || !strings.HasSuffix(name, "}") {
+		return nil
+	}
+	rest := name[start+1 : len(name)-1]
+	var order []string
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			return order
+		}
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil
+		}
+		label := strings.TrimSpace(rest[:eq])
+		rest = strings.TrimLeft(rest[eq+1:], " ")
+		value, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil
+		}
+		rest = rest[len(value):]
+		if _, ok := field.Labels[label]; ok {
+			order = append(order, label)
+		}
+	}
+}
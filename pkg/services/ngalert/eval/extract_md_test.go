@@ -88,6 +88,32 @@ func TestExtractValues(t *testing.T) {
 			"A": {Var: "A", Labels: data.Labels{"host": "foo"}, Value: ptr.Float64(1)},
 			"B": {Var: "B", Value: ptr.Float64(2)},
 		},
+	}, {
+		desc: "duplicate RefIDs",
+		inFrame: newMetaFrame([]NumberValueCapture{
+			{Var: "A", Labels: data.Labels{"host": "foo"}, Value: ptr.Float64(1)},
+			{Var: "A", Labels: data.Labels{"host": "bar"}, Value: ptr.Float64(2)},
+			{Var: "A_1", Labels: nil, Value: ptr.Float64(3)},
+		}, ptr.Float64(1)),
+		values: map[string]NumberValueCapture{
+			"A":   {Var: "A", Labels: data.Labels{"host": "foo"}, Value: ptr.Float64(1)},
+			"A_2": {Var: "A", Labels: data.Labels{"host": "bar"}, Value: ptr.Float64(2)},
+			"A_1": {Var: "A_1", Value: ptr.Float64(3)},
+		},
+	}, {
+		desc: "duplicate RefIDs after a RefID that collides with their keys",
+		inFrame: newMetaFrame([]NumberValueCapture{
+			{Var: "A_1", Labels: nil, Value: ptr.Float64(3)},
+			{Var: "A", Labels: data.Labels{"host": "foo"}, Value: ptr.Float64(1)},
+			{Var: "A", Labels: data.Labels{"host": "bar"}, Value: ptr.Float64(2)},
+			{Var: "A", Labels: data.Labels{"host": "baz"}, Value: ptr.Float64(4)},
+		}, ptr.Float64(1)),
+		values: map[string]NumberValueCapture{
+			"A_1": {Var: "A_1", Value: ptr.Float64(3)},
+			"A":   {Var: "A", Labels: data.Labels{"host": "foo"}, Value: ptr.Float64(1)},
+			"A_2": {Var: "A", Labels: data.Labels{"host": "bar"}, Value: ptr.Float64(2)},
+			"A_3": {Var: "A", Labels: data.Labels{"host": "baz"}, Value: ptr.Float64(4)},
+		},
 	}}
 	for _, tc := range cases {
 		t.Run(tc.desc, func(t *testing.T) {
@@ -96,6 +122,48 @@ func TestExtractValues(t *testing.T) {
 	}
 }
 
+func TestExtractLabelOrder(t *testing.T) {
+	labels := data.Labels{"job": "api", "instance": "a", "zone": "eu"}
+	cases := []struct {
+		desc  string
+		field *data.Field
+		order []string
+	}{{
+		desc:  "display name from the datasource",
+		field: data.NewField("B", labels, []*float64{}).SetConfig(&data.FieldConfig{DisplayNameFromDS: `up{zone="eu", job="api", instance="a"}`}),
+		order: []string{"zone", "job", "instance"},
+	}, {
+		desc:  "field name",
+		field: data.NewField(`{job="api",instance="a",zone="eu"}`, labels, []*float64{}),
+		order: []string{"job", "instance", "zone"},
+	}, {
+		desc:  "quoted values with separators",
+		field: data.NewField(`up{zone="eu, \"west\"", instance="a=b"}`, labels, []*float64{}),
+		order: []string{"zone", "instance"},
+	}, {
+		desc:  "names that are not labels are skipped",
+		field: data.NewField(`up{__name__="up", job="api"}`, labels, []*float64{}),
+		order: []string{"job"},
+	}, {
+		desc:  "name without labels",
+		field: data.NewField("B", labels, []*float64{}),
+		order: nil,
+	}, {
+		desc:  "malformed series name",
+		field: data.NewField(`up{job=api}`, labels, []*float64{}),
+		order: nil,
+	}, {
+		desc:  "field without labels",
+		field: data.NewField(`up{job="api"}`, nil, []*float64{}),
+		order: nil,
+	}}
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.order, extractLabelOrder(tc.field))
+		})
+	}
+}
+
 func newMetaFrame(custom interface{}, val *float64) *data.Frame {
 	return data.NewFrame("",
 		data.NewField("", nil, []*float64{val})).
@@ -42,6 +42,7 @@ func (executionErrorState ExecutionErrorState) String() string {
 const (
 	AlertingErrState ExecutionErrorState = "Alerting"
 	ErrorErrState    ExecutionErrorState = "Error"
+	OkErrState       ExecutionErrorState = "OK"
 )
 
 const (
@@ -51,6 +52,22 @@ const (
 	// Annotations are actually a set of labels, so technically this is the label name of an annotation.
 	DashboardUIDAnnotation = "__dashboardUid__"
 	PanelIDAnnotation      = "__panelId__"
+	// WillFireAtAnnotation is the annotation with the time a Pending alert fires if
+	// its condition persists. See AlertRule.AnnotateWillFireAt.
+	WillFireAtAnnotation = "will_fire_at"
+	// TemplateErrorAnnotation is the annotation with the errors of the annotation
+	// templates that could not be expanded. The templates are kept unexpanded.
+	TemplateErrorAnnotation = "template_error"
+	// LastErrorAnnotation is the annotation with the last error of an alert that
+	// recovered from Error.
+	LastErrorAnnotation = "last_error"
+
+	// EscalationLabel is the label with the severity of the escalation band of a firing
+	// alert. See AlertRule.EscalationBands.
+	EscalationLabel = "escalation"
+	// StaleAnnotation marks the annotations of an alert that are kept from its last
+	// evaluation with data. See NoDataAnnotationsMarkStale.
+	StaleAnnotation = "stale"
 )
 
 // AlertRule is the model for alert rules in unified alerting.
@@ -75,6 +92,115 @@ type AlertRule struct {
 	For         time.Duration
 	Annotations map[string]string
 	Labels      map[string]string
+
+	// The following fields configure how the state of the rule is processed
+	// and are not persisted.
+
+	// ValueFormats contains an optional fmt format per RefID, such as "%.2f",
+	// used to print the values of the RefID in labels and annotations.
+	ValueFormats map[string]string `xorm:"-"`
+	// KeepFiringOnNoData keeps a firing alert firing when it returns no data
+	// instead of changing its state according to NoDataState.
+	KeepFiringOnNoData bool `xorm:"-"`
+	// AnnotateWillFireAt adds the WillFireAtAnnotation to Pending alerts.
+	AnnotateWillFireAt bool `xorm:"-"`
+	// Threshold, if set, is the threshold at which the rule breaches. It is used to
+	// predict how the alerts of the rule change.
+	Threshold *Threshold `xorm:"-"`
+	// EscalationBands, if set, escalate firing alerts through severities over time or
+	// as their value grows. The severity of the last band that applies is set as the
+	// EscalationLabel of the alert.
+	EscalationBands []EscalationBand `xorm:"-"`
+	// NoDataAnnotations configures the annotations of alerts that return no data.
+	NoDataAnnotations NoDataAnnotationsPolicy `xorm:"-"`
+	// MinMaturityBeforeResolve, if set, is how long an alert must have been firing
+	// before it can resolve. Resolving younger alerts is deferred until then.
+	MinMaturityBeforeResolve time.Duration `xorm:"-"`
+	// MinResolvedDwell, if set, is how long the condition of a firing alert must have
+	// been clear for it to resolve. Resolving it earlier is deferred until then, to avoid
+	// resolving alerts that fire again soon after.
+	MinResolvedDwell time.Duration `xorm:"-"`
+	// ErrorEndsAtMultiplier, if set, is the multiple of the interval or resend delay after
+	// which Error alerts resolve by themselves when ExecErrState is Error, instead of 3.
+	// A longer timeout avoids resolving them while the datasource is recovering.
+	ErrorEndsAtMultiplier int64 `xorm:"-"`
+	// DeduplicateErrors combines the errors of queries that failed with the same message
+	// in the Error annotation, instead of repeating the message for each RefID.
+	DeduplicateErrors bool `xorm:"-"`
+	// ValueClamps, if set, clamp the values of RefIDs to a range in label and annotation
+	// templates, so that extreme values, such as from sensor glitches, are not printed.
+	ValueClamps map[string]ValueClamp `xorm:"-"`
+	// PinTransitioningEvaluation keeps the evaluation that caused the current state of an
+	// alert in its results for as long as the state persists, even if it is older than
+	// the evaluations that are otherwise retained.
+	PinTransitioningEvaluation bool `xorm:"-"`
+	// ProximityMargin, if set, is the fraction of the Threshold within which the value of
+	// a Normal alert is close enough to the threshold to warn about it before it breaches.
+	ProximityMargin float64 `xorm:"-"`
+}
+
+// NoDataAnnotationsPolicy configures the annotations of an alert that returns no data.
+type NoDataAnnotationsPolicy string
+
+const (
+	// NoDataAnnotationsUpdate expands the annotations on each evaluation, also
+	// without data. This is the default.
+	NoDataAnnotationsUpdate NoDataAnnotationsPolicy = ""
+	// NoDataAnnotationsPersist keeps the annotations of the last evaluation with data.
+	NoDataAnnotationsPersist NoDataAnnotationsPolicy = "Persist"
+	// NoDataAnnotationsClear removes the annotations.
+	NoDataAnnotationsClear NoDataAnnotationsPolicy = "Clear"
+	// NoDataAnnotationsMarkStale keeps the annotations of the last evaluation with data
+	// and adds the StaleAnnotation.
+	NoDataAnnotationsMarkStale NoDataAnnotationsPolicy = "MarkStale"
+)
+
+// EscalationBand is a severity that a firing alert escalates to.
+type EscalationBand struct {
+	// Severity is the severity of alerts in the band, such as "warning" or "critical".
+	Severity string
+	// After is how long an alert must have been firing to be in the band.
+	After time.Duration
+	// RefID and MinValue, if set, also require the latest value of the RefID to be
+	// at least MinValue.
+	RefID    string
+	MinValue *float64
+}
+
+// ValueClamp is the range that the value of a RefID is clamped to.
+type ValueClamp struct {
+	// Min and Max, if set, are the lowest and highest values of the range.
+	Min *float64
+	Max *float64
+}
+
+// Clamp returns the value clamped to the range, and true if it was outside of it.
+func (c ValueClamp) Clamp(v float64) (float64, bool) {
+	if c.Min != nil && v < *c.Min {
+		return *c.Min, true
+	}
+	if c.Max != nil && v > *c.Max {
+		return *c.Max, true
+	}
+	return v, false
+}
+
+// Threshold is the value of a RefID at which an alert rule breaches.
+type Threshold struct {
+	// RefID is the query or expression whose value is compared to the threshold.
+	RefID string
+	// Value is the threshold. The rule breaches when the value of the RefID is above it.
+	Value float64
+	// Below is true if the rule breaches when the value of the RefID is below Value instead.
+	Below bool
+}
+
+// Breached returns true if the value breaches the threshold.
+func (t Threshold) Breached(v float64) bool {
+	if t.Below {
+		return v < t.Value
+	}
+	return v > t.Value
 }
 
 // AlertRuleKey is the alert definition identifier
@@ -113,27 +113,43 @@ func FromAlertStateToPostableAlerts(firingStates []*state.State, stateManager *s
 	alerts := apimodels.PostableAlerts{PostableAlerts: make([]models.PostableAlert, 0, len(firingStates))}
 	var sentAlerts []*state.State
 	ts := time.Now()
+	policy := stateManager.SendPolicy()
 
 	for _, alertState := range firingStates {
-		if !alertState.NeedsSending(stateManager.ResendDelay) {
+		if !alertState.NeedsSending(policy) {
 			continue
 		}
 		alert := stateToPostableAlert(alertState, appURL)
+		if n := len(alertState.Results); policy.LatestValues && n > 0 {
+			alert.Annotations["__value_string__"] = alertState.Results[n-1].EvaluationString
+		}
 		alerts.PostableAlerts = append(alerts.PostableAlerts, *alert)
-		alertState.LastSentAt = ts
+		alertState.MarkSent(ts)
 		sentAlerts = append(sentAlerts, alertState)
 	}
 	stateManager.Put(sentAlerts)
 	return alerts
 }
 
+// FromOrphanedStatesToPostableAlerts converts the resolved orphaned states of a rule to
+// models.PostableAlert that are accepted by notifiers. Unlike FromAlertStateToPostableAlerts,
+// the states are not marked as sent and put back to the state manager, as they are
+// already removed from it.
+func FromOrphanedStatesToPostableAlerts(orphanedStates []*state.State, appURL *url.URL) apimodels.PostableAlerts {
+	alerts := apimodels.PostableAlerts{PostableAlerts: make([]models.PostableAlert, 0, len(orphanedStates))}
+	for _, alertState := range orphanedStates {
+		alerts.PostableAlerts = append(alerts.PostableAlerts, *stateToPostableAlert(alertState, appURL))
+	}
+	return alerts
+}
+
 // FromAlertsStateToStoppedAlert converts firingStates that have evaluation state either eval.Alerting or eval.NoData or eval.Error to models.PostableAlert that are accepted by notifiers.
 // Returns a list of alert instances that have expiration time.Now
 func FromAlertsStateToStoppedAlert(firingStates []*state.State, appURL *url.URL, clock clock.Clock) apimodels.PostableAlerts {
 	alerts := apimodels.PostableAlerts{PostableAlerts: make([]models.PostableAlert, 0, len(firingStates))}
 	ts := clock.Now()
 	for _, alertState := range firingStates {
-		if alertState.State == eval.Normal || alertState.State == eval.Pending {
+		if !alertState.IsActive() {
 			continue
 		}
 		postableAlert := stateToPostableAlert(alertState, appURL)
@@ -10,10 +10,13 @@ import (
 	"github.com/benbjohnson/clock"
 	"github.com/go-openapi/strfmt"
 	"github.com/prometheus/alertmanager/api/v2/models"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/stretchr/testify/require"
 
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	"github.com/grafana/grafana/pkg/services/ngalert/metrics"
 	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
 	"github.com/grafana/grafana/pkg/services/ngalert/state"
 	"github.com/grafana/grafana/pkg/util"
@@ -225,6 +228,50 @@ func Test_FromAlertsStateToStoppedAlert(t *testing.T) {
 	require.Equal(t, expected, result.PostableAlerts)
 }
 
+func Test_FromAlertStateToPostableAlerts_LatestValues(t *testing.T) {
+	appURL := &url.URL{
+		Scheme: "http:",
+		Host:   fmt.Sprintf("host-%d", rand.Int()),
+		Path:   fmt.Sprintf("path-%d", rand.Int()),
+	}
+	stateManager := state.NewManager(log.New("test"), metrics.NewNGAlert(prometheus.NewPedanticRegistry()).GetStateMetrics(), nil, nil, &FakeInstanceStore{})
+
+	testCases := []struct {
+		name         string
+		latestValues bool
+		expected     string
+	}{
+		{
+			name:         "resend carries the latest values",
+			latestValues: true,
+			expected:     "[ var='A' value=3 ]",
+		},
+		{
+			name:         "resend carries the oldest values when disabled",
+			latestValues: false,
+			expected:     "[ var='A' value=1 ]",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stateManager.SendLatestValues = tc.latestValues
+			alertState := randomState(eval.Alerting)
+			alertState.LastEvaluationTime = time.Now()
+			alertState.LastSentAt = alertState.LastEvaluationTime.Add(-time.Hour)
+			alertState.Results = []state.Evaluation{
+				{EvaluationTime: alertState.LastEvaluationTime.Add(-20 * time.Second), EvaluationString: "[ var='A' value=1 ]"},
+				{EvaluationTime: alertState.LastEvaluationTime.Add(-10 * time.Second), EvaluationString: "[ var='A' value=2 ]"},
+				{EvaluationTime: alertState.LastEvaluationTime, EvaluationString: "[ var='A' value=3 ]"},
+			}
+
+			result := FromAlertStateToPostableAlerts([]*state.State{alertState}, stateManager, appURL)
+			require.Len(t, result.PostableAlerts, 1)
+			require.Equal(t, tc.expected, result.PostableAlerts[0].Annotations["__value_string__"])
+		})
+	}
+}
+
 func randomMapOfStrings() map[string]string {
 	max := 5
 	result := make(map[string]string, max)
@@ -544,11 +544,7 @@ func (sch *schedule) ruleRoutine(grafanaCtx context.Context, key models.AlertRul
 		}
 		logger.Debug("alert rule evaluated", "results", results, "duration", dur)
 
-		processedStates := sch.stateManager.ProcessEvalResults(context.Background(), alertRule, results)
-		sch.saveAlertStates(processedStates)
-		alerts := FromAlertStateToPostableAlerts(processedStates, sch.stateManager, sch.appURL)
-
-		notify(alerts, logger)
+		notify(sch.processEvalResults(alertRule, results), logger)
 		return nil
 	}
 
@@ -625,6 +621,17 @@ func (sch *schedule) ruleRoutine(grafanaCtx context.Context, key models.AlertRul
 	}
 }
 
+// processEvalResults processes the evaluation results of the rule, saves the processed
+// states and returns the alerts to send. The resolved orphaned states are sent but not
+// saved, as they are already removed from the cache and the database.
+func (sch *schedule) processEvalResults(alertRule *models.AlertRule, results eval.Results) definitions.PostableAlerts {
+	processedStates, orphanedStates := sch.stateManager.ProcessEvalResultsAndOrphans(context.Background(), alertRule, results)
+	sch.saveAlertStates(processedStates)
+	alerts := FromAlertStateToPostableAlerts(processedStates, sch.stateManager, sch.appURL)
+	alerts.PostableAlerts = append(alerts.PostableAlerts, FromOrphanedStatesToPostableAlerts(orphanedStates, sch.appURL).PostableAlerts...)
+	return alerts
+}
+
 func (sch *schedule) saveAlertStates(states []*state.State) {
 	sch.log.Debug("saving alert states", "count", len(states))
 	for _, s := range states {
@@ -894,6 +894,58 @@ func TestSchedule_DeleteAlertRule(t *testing.T) {
 	})
 }
 
+func TestSchedule_processEvalResults_ResolvedOrphanedStates(t *testing.T) {
+	instanceStore := &FakeInstanceStore{}
+	sch, mockedClock := setupScheduler(t, newFakeRuleStore(t), instanceStore, newFakeAdminConfigStore(t), nil)
+	sch.stateManager.Clock = mockedClock
+	sch.stateManager.ResolveOrphanedStates = true
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+
+	first := mockedClock.Now()
+	alerts := sch.processEvalResults(rule, eval.Results{
+		{Instance: data.Labels{"instance": "a", "version": "1"}, State: eval.Alerting, EvaluatedAt: first},
+	})
+	require.Len(t, alerts.PostableAlerts, 1)
+
+	// The labels of the series change, so the state of the old labels becomes stale.
+	next := first.Add(30 * time.Second)
+	mockedClock.Set(next)
+	instanceStore.mtx.Lock()
+	instanceStore.recordedOps = nil
+	instanceStore.mtx.Unlock()
+	alerts = sch.processEvalResults(rule, eval.Results{
+		{Instance: data.Labels{"instance": "a", "version": "2"}, State: eval.Alerting, EvaluatedAt: next},
+	})
+
+	// The resolve of the orphaned state is sent.
+	var resolved int
+	for _, a := range alerts.PostableAlerts {
+		if a.Labels["version"] == "1" {
+			require.True(t, next.Equal(time.Time(a.EndsAt)))
+			resolved++
+		}
+	}
+	require.Equal(t, 1, resolved)
+
+	// The orphaned state does not reappear in the cache or the database.
+	states := sch.stateManager.GetStatesForRuleUID(rule.OrgID, rule.UID)
+	require.Len(t, states, 1)
+	require.Equal(t, "2", states[0].Labels["version"])
+	instanceStore.mtx.Lock()
+	defer instanceStore.mtx.Unlock()
+	for _, op := range instanceStore.recordedOps {
+		if cmd, ok := op.(models.SaveAlertInstanceCommand); ok {
+			require.Equal(t, "2", cmd.Labels["version"])
+		}
+	}
+}
+
 func generateRuleKey() models.AlertRuleKey {
 	return models.AlertRuleKey{
 		OrgID: rand.Int63(),
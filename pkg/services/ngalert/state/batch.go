@@ -0,0 +1,243 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+)
+
+// BlastRadius returns the number of other firing states in all that share the
+// target's values for each of the given label keys.
+func BlastRadius(target *State, all []*State, labelKeys []string) int {
+	count := 0
+	for _, s := range all {
+		if s == target || s.State != eval.Alerting {
+			continue
+		}
+		if sameLabelValues(target, s, labelKeys) {
+			count++
+		}
+	}
+	return count
+}
+
+// ConvergenceTime returns how long it took the states to converge back to Normal
+// after a mass event, that is the time from the earliest evaluation that was not
+// Normal to the last evaluation that returned to Normal. It returns zero if any of
+// the states has not converged or if none of the states left Normal.
+func ConvergenceTime(states []*State) time.Duration {
+	var start, end time.Time
+	for _, s := range states {
+		if s.State != eval.Normal {
+			return 0
+		}
+		for i, r := range s.Results {
+			if r.EvaluationState != eval.Normal {
+				if start.IsZero() || r.EvaluationTime.Before(start) {
+					start = r.EvaluationTime
+				}
+			} else if i > 0 && s.Results[i-1].EvaluationState != eval.Normal {
+				if r.EvaluationTime.After(end) {
+					end = r.EvaluationTime
+				}
+			}
+		}
+	}
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// sameLabelValues returns true if a and b have the same value for each of the keys.
+func sameLabelValues(a, b *State, keys []string) bool {
+	for _, k := range keys {
+		if a.Labels[k] != b.Labels[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// stateSeverity orders states from the least to the most severe.
+var stateSeverity = map[eval.State]int{
+	eval.Normal:   0,
+	eval.Pending:  1,
+	eval.NoData:   2,
+	eval.Error:    3,
+	eval.Alerting: 4,
+}
+
+// CombinedState returns the most severe state of the states of different rules for
+// the same series, from least to most severe Normal, Pending, NoData, Error and
+// Alerting. It returns Normal if there are no states.
+func CombinedState(states []*State) eval.State {
+	combined := eval.Normal
+	for _, s := range states {
+		if stateSeverity[s.State] > stateSeverity[combined] {
+			combined = s.State
+		}
+	}
+	return combined
+}
+
+// seriesKey identifies the series of a state across batches.
+type seriesKey struct {
+	ruleUID     string
+	fingerprint uint64
+}
+
+// TransitionsByRule returns the number of series of each rule, by AlertRuleUID, whose
+// state changed between the before and after snapshots of a batch. Series are matched
+// by their Fingerprint. A series that is not in before is considered Normal before the
+// batch, and a series that is not in after is not counted.
+func TransitionsByRule(before, after []*State) map[string]int {
+	previous := make(map[seriesKey]eval.State, len(before))
+	for _, s := range before {
+		previous[seriesKey{s.AlertRuleUID, s.Fingerprint()}] = s.State
+	}
+	transitions := make(map[string]int)
+	for _, s := range after {
+		old, ok := previous[seriesKey{s.AlertRuleUID, s.Fingerprint()}]
+		if !ok {
+			old = eval.Normal
+		}
+		if old != s.State {
+			transitions[s.AlertRuleUID]++
+		}
+	}
+	return transitions
+}
+
+// GroupState summarizes the states of the children of a group, such as a parent alert
+// that aggregates them.
+type GroupState struct {
+	// Firing is the number of children that are Alerting.
+	Firing int
+	// Total is the number of children.
+	Total int
+	// Worst is the most severe state of the children, as in CombinedState.
+	Worst eval.State
+}
+
+// String returns a summary such as "1 of 5 firing".
+func (g GroupState) String() string {
+	return fmt.Sprintf("%d of %d firing", g.Firing, g.Total)
+}
+
+// ContributeToGroup returns how the children contribute to the state of their group.
+func ContributeToGroup(children []*State) GroupState {
+	g := GroupState{Total: len(children), Worst: CombinedState(children)}
+	for _, s := range children {
+		if s.State == eval.Alerting {
+			g.Firing++
+		}
+	}
+	return g
+}
+
+// RollupState returns a synthetic rule-level state for the states of the series of a
+// rule. Its state is the most severe state of the series, as in CombinedState, from
+// the earliest StartsAt to the latest EndsAt of the series in that state. Its labels
+// are the labels that all series have in common, and its annotations are the number
+// of series in each state, such as "alerting": "2", and a "summary" such as "2 of 5
+// firing". It returns nil if there are no series.
+func RollupState(series []*State) *State {
+	if len(series) == 0 {
+		return nil
+	}
+	rollup := &State{
+		AlertRuleUID: series[0].AlertRuleUID,
+		OrgID:        series[0].OrgID,
+		State:        CombinedState(series),
+		Labels:       series[0].Labels.Copy(),
+		Annotations: map[string]string{
+			"summary": ContributeToGroup(series).String(),
+		},
+	}
+	counts := make(map[eval.State]int)
+	for _, s := range series {
+		counts[s.State]++
+		for k, v := range rollup.Labels {
+			if s.Labels[k] != v {
+				delete(rollup.Labels, k)
+			}
+		}
+		if s.LastEvaluationTime.After(rollup.LastEvaluationTime) {
+			rollup.LastEvaluationTime = s.LastEvaluationTime
+		}
+		if s.State != rollup.State {
+			continue
+		}
+		if rollup.StartsAt.IsZero() || s.StartsAt.Before(rollup.StartsAt) {
+			rollup.StartsAt = s.StartsAt
+		}
+		if s.EndsAt.After(rollup.EndsAt) {
+			rollup.EndsAt = s.EndsAt
+		}
+	}
+	for state, n := range counts {
+		rollup.Annotations[strings.ToLower(state.String())] = strconv.Itoa(n)
+	}
+	return rollup
+}
+
+// FiringCorrelation returns how much the two states tend to fire together, as the
+// Jaccard index of the times they were firing: the number of times both were firing
+// over the number of times either was. The times are those of the evaluations of
+// either state in the time range covered by the Results of both, and the state of
+// each at a time is that of its latest evaluation at or before it. It returns zero if
+// neither was firing.
+func FiringCorrelation(a, b *State) float64 {
+	if len(a.Results) == 0 || len(b.Results) == 0 {
+		return 0
+	}
+	from, to := a.Results[0].EvaluationTime, a.Results[len(a.Results)-1].EvaluationTime
+	if t := b.Results[0].EvaluationTime; t.After(from) {
+		from = t
+	}
+	if t := b.Results[len(b.Results)-1].EvaluationTime; t.Before(to) {
+		to = t
+	}
+
+	var times []time.Time
+	for _, s := range []*State{a, b} {
+		for _, r := range s.Results {
+			if !r.EvaluationTime.Before(from) && !r.EvaluationTime.After(to) {
+				times = append(times, r.EvaluationTime)
+			}
+		}
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+	var both, either int
+	for i, t := range times {
+		if i > 0 && t.Equal(times[i-1]) {
+			continue
+		}
+		af, bf := a.firingAt(t), b.firingAt(t)
+		if af && bf {
+			both++
+		}
+		if af || bf {
+			either++
+		}
+	}
+	if either == 0 {
+		return 0
+	}
+	return float64(both) / float64(either)
+}
+
+// firingAt returns true if the latest evaluation in Results at or before t is Alerting.
+func (a *State) firingAt(t time.Time) bool {
+	i := sort.Search(len(a.Results), func(i int) bool {
+		return a.Results[i].EvaluationTime.After(t)
+	})
+	return i > 0 && a.Results[i-1].EvaluationState == eval.Alerting
+}
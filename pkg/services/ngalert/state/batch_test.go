@@ -0,0 +1,283 @@
+package state
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+)
+
+func TestBlastRadius(t *testing.T) {
+	target := &State{State: eval.Alerting, Labels: data.Labels{"cluster": "prod", "namespace": "api", "pod": "a"}}
+	all := []*State{
+		target,
+		{State: eval.Alerting, Labels: data.Labels{"cluster": "prod", "namespace": "api", "pod": "b"}},
+		{State: eval.Alerting, Labels: data.Labels{"cluster": "prod", "namespace": "api", "pod": "c"}},
+		{State: eval.Alerting, Labels: data.Labels{"cluster": "prod", "namespace": "db", "pod": "d"}},
+		{State: eval.Normal, Labels: data.Labels{"cluster": "prod", "namespace": "api", "pod": "e"}},
+		{State: eval.Pending, Labels: data.Labels{"cluster": "prod", "namespace": "api", "pod": "f"}},
+		{State: eval.Alerting, Labels: data.Labels{"cluster": "dev", "namespace": "api", "pod": "g"}},
+	}
+
+	testCases := []struct {
+		name      string
+		labelKeys []string
+		expected  int
+	}{
+		{
+			name:      "firing states in the same cluster",
+			labelKeys: []string{"cluster"},
+			expected:  3,
+		},
+		{
+			name:      "firing states in the same cluster and namespace",
+			labelKeys: []string{"cluster", "namespace"},
+			expected:  2,
+		},
+		{
+			name:      "no label keys matches all other firing states",
+			labelKeys: nil,
+			expected:  4,
+		},
+		{
+			name:      "no firing state shares a unique label",
+			labelKeys: []string{"pod"},
+			expected:  0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, BlastRadius(target, all, tc.labelKeys))
+		})
+	}
+}
+
+func TestConvergenceTime(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	results := func(states ...eval.State) []Evaluation {
+		r := make([]Evaluation, 0, len(states))
+		for i, s := range states {
+			r = append(r, Evaluation{
+				EvaluationTime:  evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				EvaluationState: s,
+			})
+		}
+		return r
+	}
+
+	testCases := []struct {
+		name     string
+		states   []*State
+		expected time.Duration
+	}{
+		{
+			name: "states that converged back to normal",
+			states: []*State{
+				{State: eval.Normal, Results: results(eval.Normal, eval.Alerting, eval.Alerting, eval.Normal, eval.Normal)},
+				{State: eval.Normal, Results: results(eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal)},
+				{State: eval.Normal, Results: results(eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Normal)},
+			},
+			expected: 30 * time.Second,
+		},
+		{
+			name: "a state that has not converged",
+			states: []*State{
+				{State: eval.Normal, Results: results(eval.Normal, eval.Alerting, eval.Normal)},
+				{State: eval.Alerting, Results: results(eval.Normal, eval.Alerting, eval.Alerting)},
+			},
+			expected: 0,
+		},
+		{
+			name: "states that never left normal",
+			states: []*State{
+				{State: eval.Normal, Results: results(eval.Normal, eval.Normal)},
+			},
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, ConvergenceTime(tc.states))
+		})
+	}
+}
+
+func TestCombinedState(t *testing.T) {
+	testCases := []struct {
+		name     string
+		states   []eval.State
+		expected eval.State
+	}{
+		{
+			name:     "no states",
+			expected: eval.Normal,
+		},
+		{
+			name:     "all normal",
+			states:   []eval.State{eval.Normal, eval.Normal},
+			expected: eval.Normal,
+		},
+		{
+			name:     "normal and alerting",
+			states:   []eval.State{eval.Normal, eval.Alerting},
+			expected: eval.Alerting,
+		},
+		{
+			name:     "alerting is worse than error",
+			states:   []eval.State{eval.Alerting, eval.Error, eval.NoData},
+			expected: eval.Alerting,
+		},
+		{
+			name:     "error is worse than no data and pending",
+			states:   []eval.State{eval.Pending, eval.Error, eval.NoData},
+			expected: eval.Error,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			states := make([]*State, 0, len(tc.states))
+			for i, s := range tc.states {
+				states = append(states, &State{AlertRuleUID: fmt.Sprintf("rule-%d", i), State: s})
+			}
+			assert.Equal(t, tc.expected, CombinedState(states))
+		})
+	}
+}
+
+func TestTransitionsByRule(t *testing.T) {
+	series := func(ruleUID, instance string, state eval.State) *State {
+		return &State{AlertRuleUID: ruleUID, Labels: data.Labels{"instance": instance}, State: state}
+	}
+	before := []*State{
+		series("rule-1", "a", eval.Normal),
+		series("rule-1", "b", eval.Normal),
+		series("rule-1", "c", eval.Alerting),
+		series("rule-2", "a", eval.Alerting),
+		series("rule-2", "b", eval.Pending),
+		series("rule-3", "a", eval.Normal),
+	}
+	after := []*State{
+		series("rule-1", "a", eval.Alerting),
+		series("rule-1", "b", eval.Normal),
+		series("rule-1", "c", eval.Normal),
+		series("rule-2", "a", eval.Alerting),
+		series("rule-2", "b", eval.Alerting),
+		// New series.
+		series("rule-2", "c", eval.Alerting),
+		series("rule-3", "a", eval.Normal),
+		series("rule-3", "b", eval.Normal),
+	}
+
+	assert.Equal(t, map[string]int{
+		"rule-1": 2,
+		"rule-2": 2,
+	}, TransitionsByRule(before, after))
+}
+
+func TestContributeToGroup(t *testing.T) {
+	children := []*State{
+		{State: eval.Alerting},
+		{State: eval.Normal},
+		{State: eval.Pending},
+		{State: eval.Error},
+		{State: eval.Normal},
+	}
+
+	g := ContributeToGroup(children)
+	assert.Equal(t, GroupState{Firing: 1, Total: 5, Worst: eval.Alerting}, g)
+	assert.Equal(t, "1 of 5 firing", g.String())
+
+	assert.Equal(t, GroupState{Worst: eval.Normal}, ContributeToGroup(nil))
+}
+
+func TestRollupState(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	labels := func(instance string) data.Labels {
+		return data.Labels{"alertname": "test_title", "team": "a", "instance": instance}
+	}
+	series := []*State{
+		{AlertRuleUID: "rule", OrgID: 1, State: eval.Normal, Labels: labels("1"), LastEvaluationTime: evaluationTime},
+		{AlertRuleUID: "rule", OrgID: 1, State: eval.Alerting, Labels: labels("2"), StartsAt: evaluationTime.Add(-time.Hour), EndsAt: evaluationTime.Add(time.Minute), LastEvaluationTime: evaluationTime},
+		{AlertRuleUID: "rule", OrgID: 1, State: eval.Alerting, Labels: labels("3"), StartsAt: evaluationTime.Add(-time.Minute), EndsAt: evaluationTime.Add(2 * time.Minute), LastEvaluationTime: evaluationTime.Add(time.Second)},
+		{AlertRuleUID: "rule", OrgID: 1, State: eval.Error, Labels: labels("4"), StartsAt: evaluationTime.Add(-2 * time.Hour), EndsAt: evaluationTime.Add(time.Hour), LastEvaluationTime: evaluationTime},
+		{AlertRuleUID: "rule", OrgID: 1, State: eval.Normal, Labels: labels("5"), LastEvaluationTime: evaluationTime},
+	}
+
+	assert.Equal(t, &State{
+		AlertRuleUID:       "rule",
+		OrgID:              1,
+		State:              eval.Alerting,
+		StartsAt:           evaluationTime.Add(-time.Hour),
+		EndsAt:             evaluationTime.Add(2 * time.Minute),
+		LastEvaluationTime: evaluationTime.Add(time.Second),
+		Labels:             data.Labels{"alertname": "test_title", "team": "a"},
+		Annotations: map[string]string{
+			"summary":  "2 of 5 firing",
+			"normal":   "2",
+			"alerting": "2",
+			"error":    "1",
+		},
+	}, RollupState(series))
+
+	assert.Nil(t, RollupState(nil))
+}
+
+func TestFiringCorrelation(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	results := func(offset time.Duration, states ...eval.State) []Evaluation {
+		return makeResults(evaluationTime.Add(offset), states...)
+	}
+	a := &State{Results: results(0, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal)}
+
+	testCases := []struct {
+		name     string
+		b        []Evaluation
+		expected float64
+	}{
+		{
+			name:     "fire together",
+			b:        results(0, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal),
+			expected: 1,
+		},
+		{
+			name:     "fire together, evaluated half an interval later",
+			b:        results(5*time.Second, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal),
+			expected: 0.6,
+		},
+		{
+			name:     "fire at different times",
+			b:        results(0, eval.Alerting, eval.Normal, eval.Normal, eval.Alerting, eval.Normal, eval.Normal, eval.Alerting),
+			expected: 0,
+		},
+		{
+			name:     "fire partly together",
+			b:        results(0, eval.Normal, eval.Alerting, eval.Normal, eval.Normal, eval.Normal, eval.Alerting, eval.Normal),
+			expected: 0.5,
+		},
+		{
+			name:     "never fire",
+			b:        results(0, eval.Normal, eval.Normal),
+			expected: 0,
+		},
+		{
+			name:     "no overlap",
+			b:        results(time.Hour, eval.Alerting, eval.Alerting),
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &State{Results: tc.b}
+			assert.InDelta(t, tc.expected, FiringCorrelation(a, b), 0.0001)
+			assert.InDelta(t, tc.expected, FiringCorrelation(b, a), 0.0001)
+		})
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 
@@ -33,14 +35,18 @@ func newCache(logger log.Logger, metrics *metrics.State, externalURL *url.URL) *
 	}
 }
 
-func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
+// getOrCreate returns the state of the result, creating it if it does not exist. The
+// annotations of an existing state are updated, unless the result is out of order and
+// keepNewerAnnotations is true. It also returns true if the annotations of the rule
+// changed for an existing state.
+func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result, loc *time.Location, keepNewerAnnotations bool, siblingLabels SiblingLabels) (*State, bool) {
 	c.mtxStates.Lock()
 	defer c.mtxStates.Unlock()
 
 	// clone the labels so we don't change eval.Result
 	labels := result.Instance.Copy()
 	attachRuleLabels(labels, alertRule)
-	ruleLabels, annotations := c.expandRuleLabelsAndAnnotations(ctx, alertRule, labels, result)
+	ruleLabels, _ := c.expand(ctx, alertRule, alertRule.Labels, labels, result, nil, nil, loc)
 
 	// if duplicate labels exist, alertRule label will take precedence
 	lbs := mergeLabels(ruleLabels, result.Instance)
@@ -59,11 +65,34 @@ func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule,
 		c.states[alertRule.OrgID][alertRule.UID] = make(map[string]*State)
 	}
 
+	var siblings map[string]data.Labels
+	if siblingLabels != nil {
+		siblings = siblingLabels(alertRule, lbs)
+	}
+
 	if state, ok := c.states[alertRule.OrgID][alertRule.UID][id]; ok {
+		if keepNewerAnnotations && result.EvaluatedAt.Before(state.LastEvaluationTime) {
+			return state, false
+		}
+		// The result is not in Results yet, so the last evaluation is the previous one.
+		var previous map[string]*float64
+		if n := len(state.Results); n > 0 {
+			previous = state.Results[n-1].Values
+		}
+		annotations := c.expandAnnotations(ctx, alertRule, labels, result, previous, siblings, loc)
+		if result.State == eval.NoData {
+			annotations = noDataAnnotations(alertRule.NoDataAnnotations, state.Annotations, annotations)
+		}
 		// Annotations can change over time for the same alert.
-		state.Annotations = annotations
+		changed := ruleAnnotationsChanged(alertRule.Annotations, state.Annotations, annotations)
+		state.setAnnotations(annotations)
 		c.states[alertRule.OrgID][alertRule.UID][id] = state
-		return state
+		return state, changed
+	}
+
+	annotations := c.expandAnnotations(ctx, alertRule, labels, result, nil, siblings, loc)
+	if result.State == eval.NoData && alertRule.NoDataAnnotations == ngModels.NoDataAnnotationsClear {
+		annotations = map[string]string{}
 	}
 
 	// If the first result we get is alerting, set StartsAt to EvaluatedAt because we
@@ -72,15 +101,50 @@ func (c *cache) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule,
 		AlertRuleUID:       alertRule.UID,
 		OrgID:              alertRule.OrgID,
 		CacheId:            id,
-		Labels:             lbs,
 		Annotations:        annotations,
 		EvaluationDuration: result.EvaluationDuration,
 	}
+	newState.SetLabels(lbs)
 	if result.State == eval.Alerting {
 		newState.StartsAt = result.EvaluatedAt
 	}
 	c.states[alertRule.OrgID][alertRule.UID][id] = newState
-	return newState
+	return newState, false
+}
+
+// ruleAnnotationsChanged returns true if any of the annotations of the rule differ between
+// the previous and the expanded annotations of a state. Annotations that are added to the
+// state rather than expanded from the rule, such as Error, are not compared, as they are
+// only in the previous annotations.
+func ruleAnnotationsChanged(rule, previous, expanded map[string]string) bool {
+	for k := range rule {
+		p, hadPrevious := previous[k]
+		e, hasExpanded := expanded[k]
+		if hadPrevious != hasExpanded || p != e {
+			return true
+		}
+	}
+	return false
+}
+
+// noDataAnnotations returns the annotations of an alert that returned no data according
+// to the policy, given its previous annotations and the annotations expanded without data.
+func noDataAnnotations(policy ngModels.NoDataAnnotationsPolicy, previous, expanded map[string]string) map[string]string {
+	switch policy {
+	case ngModels.NoDataAnnotationsPersist:
+		return previous
+	case ngModels.NoDataAnnotationsClear:
+		return map[string]string{}
+	case ngModels.NoDataAnnotationsMarkStale:
+		stale := make(map[string]string, len(previous)+1)
+		for k, v := range previous {
+			stale[k] = v
+		}
+		stale[ngModels.StaleAnnotation] = "true"
+		return stale
+	default:
+		return expanded
+	}
 }
 
 func attachRuleLabels(m map[string]string, alertRule *ngModels.AlertRule) {
@@ -89,22 +153,34 @@ func attachRuleLabels(m map[string]string, alertRule *ngModels.AlertRule) {
 	m[prometheusModel.AlertNameLabel] = alertRule.Title
 }
 
-func (c *cache) expandRuleLabelsAndAnnotations(ctx context.Context, alertRule *ngModels.AlertRule, labels map[string]string, alertInstance eval.Result) (map[string]string, map[string]string) {
-	expand := func(original map[string]string) map[string]string {
-		expanded := make(map[string]string, len(original))
-		for k, v := range original {
-			ev, err := expandTemplate(ctx, alertRule.Title, v, labels, alertInstance, c.externalURL)
-			expanded[k] = ev
-			if err != nil {
-				c.log.Error("error in expanding template", "name", k, "value", v, "err", err.Error())
-				// Store the original template on error.
-				expanded[k] = v
-			}
+// expand expands the templates in original. The originals of the templates that could
+// not be expanded are kept, and the errors are returned.
+func (c *cache) expand(ctx context.Context, alertRule *ngModels.AlertRule, original, labels map[string]string, alertInstance eval.Result, previous map[string]*float64, siblings map[string]data.Labels, loc *time.Location) (map[string]string, []string) {
+	expanded := make(map[string]string, len(original))
+	var errs []string
+	for k, v := range original {
+		ev, err := expandTemplate(ctx, alertRule, v, labels, alertInstance, previous, siblings, c.externalURL, loc)
+		expanded[k] = ev
+		if err != nil {
+			c.log.Error("error in expanding template", "name", k, "value", v, "err", err.Error())
+			// Store the original template on error.
+			expanded[k] = v
+			errs = append(errs, fmt.Sprintf("%s: %s", k, err))
 		}
+	}
+	return expanded, errs
+}
 
-		return expanded
+// expandAnnotations expands the annotations of the rule given the values of the previous
+// evaluation, if any, and the labels of the siblings of the state.
+func (c *cache) expandAnnotations(ctx context.Context, alertRule *ngModels.AlertRule, labels map[string]string, alertInstance eval.Result, previous map[string]*float64, siblings map[string]data.Labels, loc *time.Location) map[string]string {
+	expanded, errs := c.expand(ctx, alertRule, alertRule.Annotations, labels, alertInstance, previous, siblings, loc)
+	if len(errs) > 0 {
+		// Record why the annotations were not expanded, so it is visible in the alert.
+		sort.Strings(errs)
+		expanded[ngModels.TemplateErrorAnnotation] = strings.Join(errs, "; ")
 	}
-	return expand(alertRule.Labels), expand(alertRule.Annotations)
+	return expanded
 }
 
 func (c *cache) set(entry *State) {
@@ -157,6 +233,33 @@ func (c *cache) removeByRuleUID(orgID int64, uid string) {
 	delete(c.states[orgID], uid)
 }
 
+// reparent moves the entries of the rule from the organization oldOrgID to the
+// organization of the rule, replacing the entries of the rule in that organization.
+// The rule labels of the entries are updated, and the entries are keyed by their
+// new CacheId.
+func (c *cache) reparent(oldOrgID int64, alertRule *ngModels.AlertRule) {
+	c.mtxStates.Lock()
+	defer c.mtxStates.Unlock()
+	states, ok := c.states[oldOrgID][alertRule.UID]
+	if !ok {
+		return
+	}
+	delete(c.states[oldOrgID], alertRule.UID)
+
+	moved := make(map[string]*State, len(states))
+	for _, s := range states {
+		labels := s.Labels.Copy()
+		attachRuleLabels(labels, alertRule)
+		s.SetLabels(labels)
+		s.Reparent(alertRule.OrgID)
+		moved[s.CacheId] = s
+	}
+	if _, ok := c.states[alertRule.OrgID]; !ok {
+		c.states[alertRule.OrgID] = make(map[string]map[string]*State)
+	}
+	c.states[alertRule.OrgID][alertRule.UID] = moved
+}
+
 func (c *cache) reset() {
 	c.mtxStates.Lock()
 	defer c.mtxStates.Unlock()
@@ -0,0 +1,1069 @@
+package state
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// RetainedWindow returns the wall-clock span covered by the retained Results,
+// that is the time between the oldest and the newest evaluation. It returns
+// zero if fewer than two evaluations are retained.
+func (a *State) RetainedWindow() time.Duration {
+	if len(a.Results) < 2 {
+		return 0
+	}
+	return a.Results[len(a.Results)-1].EvaluationTime.Sub(a.Results[0].EvaluationTime)
+}
+
+// HasEverFired returns true if any of the retained Results is Alerting, even if
+// the state is no longer Alerting.
+func (a *State) HasEverFired() bool {
+	for _, r := range a.Results {
+		if r.EvaluationState == eval.Alerting {
+			return true
+		}
+	}
+	return false
+}
+
+// FiringHourHistogram returns the number of Alerting evaluations in Results per
+// hour of the day in UTC. An alert that fires at the same time each day is often
+// caused by a recurring job rather than a real problem.
+func (a *State) FiringHourHistogram() map[int]int {
+	histogram := make(map[int]int)
+	for _, r := range a.Results {
+		if r.EvaluationState == eval.Alerting {
+			histogram[r.EvaluationTime.UTC().Hour()]++
+		}
+	}
+	return histogram
+}
+
+// episode is a run of consecutive Alerting evaluations in Results.
+type episode struct {
+	// start and end are the indexes of the first and last Alerting evaluation.
+	start, end int
+}
+
+// firingEpisodes returns the firing episodes in Results in chronological order.
+func (a *State) firingEpisodes() []episode {
+	var episodes []episode
+	for i, r := range a.Results {
+		if r.EvaluationState != eval.Alerting {
+			continue
+		}
+		if n := len(episodes); n > 0 && episodes[n-1].end == i-1 {
+			episodes[n-1].end = i
+			continue
+		}
+		episodes = append(episodes, episode{start: i, end: i})
+	}
+	return episodes
+}
+
+// episodeDuration returns how long the episode was firing, from its first evaluation
+// until the evaluation that resolved it, and whether it resolved. The duration of an
+// episode that is still firing is until the latest evaluation.
+func (a *State) episodeDuration(e episode) (time.Duration, bool) {
+	started := a.Results[e.start].EvaluationTime
+	if e.end < len(a.Results)-1 {
+		return a.Results[e.end+1].EvaluationTime.Sub(started), true
+	}
+	return a.Results[len(a.Results)-1].EvaluationTime.Sub(started), false
+}
+
+// RecurrenceCount returns the number of distinct firing episodes in Results that
+// were firing within the period before now. A long episode is counted once.
+func (a *State) RecurrenceCount(period time.Duration, now time.Time) int {
+	from := now.Add(-period)
+	count := 0
+	for _, e := range a.firingEpisodes() {
+		if a.Results[e.end].EvaluationTime.Before(from) || a.Results[e.start].EvaluationTime.After(now) {
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+// EligibleForAutoSilence returns true if the state changed between consecutive
+// evaluations in Results at least transitionThreshold times within the window before
+// now, so that the alert is flapping too often to be useful and can be silenced.
+func (a *State) EligibleForAutoSilence(transitionThreshold int, window time.Duration, now time.Time) bool {
+	from := now.Add(-window)
+	transitions := 0
+	for i := 1; i < len(a.Results); i++ {
+		r := a.Results[i]
+		if r.EvaluationTime.Before(from) || r.EvaluationTime.After(now) {
+			continue
+		}
+		if r.EvaluationState != a.Results[i-1].EvaluationState {
+			transitions++
+		}
+	}
+	return transitions >= transitionThreshold
+}
+
+// LongestFiringStreak returns how long the longest firing episode in Results was firing,
+// from its first evaluation until the evaluation that resolved it, or until the latest
+// evaluation if it is still firing. It returns zero if the state never fired.
+func (a *State) LongestFiringStreak() time.Duration {
+	var longest time.Duration
+	for _, e := range a.firingEpisodes() {
+		if d, _ := a.episodeDuration(e); d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+// MeanTimeBetweenFailures returns the average time from the evaluation that resolved a
+// firing episode in Results until the next episode started firing. It returns zero if
+// there are fewer than two episodes.
+func (a *State) MeanTimeBetweenFailures() time.Duration {
+	episodes := a.firingEpisodes()
+	if len(episodes) < 2 {
+		return 0
+	}
+	var total time.Duration
+	for i := 1; i < len(episodes); i++ {
+		// Every episode but the last is followed by the evaluation that resolved it.
+		resolved := a.Results[episodes[i-1].end+1].EvaluationTime
+		total += a.Results[episodes[i].start].EvaluationTime.Sub(resolved)
+	}
+	return total / time.Duration(len(episodes)-1)
+}
+
+// StateEntropy returns the Shannon entropy, in bits, of the distribution of
+// states in Results. It is zero when all evaluations have the same state, and
+// grows as the rule flaps between states. It returns zero if there are no Results.
+func (a *State) StateEntropy() float64 {
+	if len(a.Results) == 0 {
+		return 0
+	}
+	counts := make(map[eval.State]int)
+	for _, r := range a.Results {
+		counts[r.EvaluationState]++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		p := float64(c) / float64(len(a.Results))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// AuditTransitions returns a description of each transition of the state that
+// should not be possible under the rule's configuration, such as evaluations out
+// of chronological order in Results or the state firing before the rule's For
+// duration has elapsed. The state fires at StartsAt while it is Alerting and at
+// each Alerting point in Transitions. The time it was pending is derived from the
+// consecutive Alerting evaluations in Results up to then, so firings after a run
+// that started before the retained Results are not audited. It returns nil if no
+// anomalies are found.
+func (a *State) AuditTransitions(alertRule *ngModels.AlertRule) []string {
+	var anomalies []string
+	for i := 1; i < len(a.Results); i++ {
+		r, prev := a.Results[i], a.Results[i-1]
+		if r.EvaluationTime.Before(prev.EvaluationTime) {
+			anomalies = append(anomalies, fmt.Sprintf("evaluation %d at %s is before the previous evaluation at %s",
+				i, r.EvaluationTime.Format(time.RFC3339), prev.EvaluationTime.Format(time.RFC3339)))
+		}
+	}
+
+	var firedAt []time.Time
+	for _, p := range a.Transitions {
+		if p.State == eval.Alerting {
+			firedAt = append(firedAt, p.Time)
+		}
+	}
+	if a.State == eval.Alerting && (len(firedAt) == 0 || !firedAt[len(firedAt)-1].Equal(a.StartsAt)) {
+		firedAt = append(firedAt, a.StartsAt)
+	}
+	for _, at := range firedAt {
+		pending, ok := a.pendingBefore(at)
+		if ok && pending < alertRule.For {
+			anomalies = append(anomalies, fmt.Sprintf("state fired at %s after %s of Alerting evaluations but the rule requires %s",
+				at.Format(time.RFC3339), pending, alertRule.For))
+		}
+	}
+	return anomalies
+}
+
+// pendingBefore returns how long the condition of the state had been Alerting when
+// the state fired at the given time, from the first of the consecutive Alerting
+// evaluations in Results that end with the evaluation at that time. It returns false
+// if there is no Alerting evaluation at that time, or if the run of Alerting
+// evaluations started before the retained Results.
+func (a *State) pendingBefore(at time.Time) (time.Duration, bool) {
+	end := -1
+	for i, r := range a.Results {
+		if r.EvaluationTime.Equal(at) {
+			end = i
+		}
+	}
+	if end < 0 || a.Results[end].EvaluationState != eval.Alerting {
+		return 0, false
+	}
+	start := end
+	for start > 0 && a.Results[start-1].EvaluationState == eval.Alerting {
+		start--
+	}
+	if start == 0 {
+		return 0, false
+	}
+	return at.Sub(a.Results[start].EvaluationTime), true
+}
+
+// ForecastDailyNotifications estimates how many notifications the state sends per
+// day if it keeps behaving as it did over the retained Results. Each firing episode
+// counts one notification when it fires, one each time resendDelay passes while it
+// is firing, and one when it resolves. It returns zero if the retained Results span
+// no time.
+func (a *State) ForecastDailyNotifications(resendDelay time.Duration) float64 {
+	window := a.RetainedWindow()
+	if window <= 0 {
+		return 0
+	}
+	notifications := 0
+	for _, e := range a.firingEpisodes() {
+		notifications++
+		if resendDelay > 0 {
+			firing := a.Results[e.end].EvaluationTime.Sub(a.Results[e.start].EvaluationTime)
+			notifications += int(firing / resendDelay)
+		}
+		if e.end < len(a.Results)-1 {
+			notifications++
+		}
+	}
+	return float64(notifications) * float64(24*time.Hour) / float64(window)
+}
+
+// FirstFireLatency returns the time from the first evaluation in which the condition
+// of an Alerting state was met to when the state started firing. This includes the
+// For duration of the rule. It returns zero if the state is not Alerting or the
+// evaluation that fired is no longer retained in Results.
+func (a *State) FirstFireLatency() time.Duration {
+	if a.State != eval.Alerting {
+		return 0
+	}
+	for _, e := range a.firingEpisodes() {
+		for i := e.start; i <= e.end; i++ {
+			if a.Results[i].EvaluationTime.Equal(a.StartsAt) {
+				return a.StartsAt.Sub(a.Results[e.start].EvaluationTime)
+			}
+		}
+	}
+	return 0
+}
+
+// DetectionLatencies returns, for each firing episode in Results that fired, the time
+// from the first evaluation in which the condition was met to the evaluation at which
+// the state started firing. This is the For of the state plus the time until the next
+// evaluation after it. Episodes that resolved before they fired are skipped. Results
+// do not record when the state fired, so the time each episode fired is derived from
+// For, as the rule of the state was configured at its latest evaluation.
+func (a *State) DetectionLatencies() []time.Duration {
+	var latencies []time.Duration
+	for _, e := range a.firingEpisodes() {
+		started := a.Results[e.start].EvaluationTime
+		for i := e.start; i <= e.end; i++ {
+			// The state fires once the condition is met for longer than For, as in resultAlerting.
+			if latency := a.Results[i].EvaluationTime.Sub(started); a.For == 0 || latency > a.For {
+				latencies = append(latencies, latency)
+				break
+			}
+		}
+	}
+	return latencies
+}
+
+// TransitionPoint is the time at which the evaluations of a state changed to State.
+type TransitionPoint struct {
+	Time  time.Time
+	State eval.State
+}
+
+// CompactTimeline returns the Results collapsed into the points at which the state
+// of the evaluation changed. The first point is the first retained evaluation.
+func (a *State) CompactTimeline() []TransitionPoint {
+	var timeline []TransitionPoint
+	for i, r := range a.Results {
+		if i > 0 && a.Results[i-1].EvaluationState == r.EvaluationState {
+			continue
+		}
+		timeline = append(timeline, TransitionPoint{Time: r.EvaluationTime, State: r.EvaluationState})
+	}
+	return timeline
+}
+
+// ChangePoints returns the times of the evaluations in Results whose state is different
+// from that of the previous evaluation, in chronological order. Unlike CompactTimeline,
+// the first retained evaluation is not a change point.
+func (a *State) ChangePoints() []time.Time {
+	timeline := a.CompactTimeline()
+	if len(timeline) < 2 {
+		return nil
+	}
+	points := make([]time.Time, 0, len(timeline)-1)
+	for _, p := range timeline[1:] {
+		points = append(points, p.Time)
+	}
+	return points
+}
+
+// RollingStability returns the stability of the state over windows of the given
+// length, ending at now and at every step before now back to the first retained
+// evaluation, from the oldest window to the newest. The stability of a window is
+// the fraction of consecutive evaluations in it that have the same state, from 0
+// for a state that changes on every evaluation to 1 for a state that never changes.
+func (a *State) RollingStability(window, step time.Duration, now time.Time) []float64 {
+	if len(a.Results) == 0 || step <= 0 {
+		return nil
+	}
+	var scores []float64
+	for end := now; end.After(a.Results[0].EvaluationTime); end = end.Add(-step) {
+		scores = append(scores, a.stability(end.Add(-window), end))
+	}
+	for i, j := 0, len(scores)-1; i < j; i, j = i+1, j-1 {
+		scores[i], scores[j] = scores[j], scores[i]
+	}
+	return scores
+}
+
+// stability returns the stability of the evaluations in Results after from and
+// until to. It returns 1 if there are fewer than two evaluations.
+func (a *State) stability(from, to time.Time) float64 {
+	var prev *Evaluation
+	pairs, changes := 0, 0
+	for i := range a.Results {
+		r := &a.Results[i]
+		if !r.EvaluationTime.After(from) || r.EvaluationTime.After(to) {
+			continue
+		}
+		if prev != nil {
+			pairs++
+			if prev.EvaluationState != r.EvaluationState {
+				changes++
+			}
+		}
+		prev = r
+	}
+	if pairs == 0 {
+		return 1
+	}
+	return 1 - float64(changes)/float64(pairs)
+}
+
+// ResolvedBeforeSend returns true if the state resolved after firing without the
+// firing being sent, because every firing evaluation was within resendDelay of the
+// last time the state was sent. The scheduler can use it to send the firing alert
+// anyway, so the alert is not missed.
+func (a *State) ResolvedBeforeSend(resendDelay time.Duration) bool {
+	if a.State != eval.Normal || !a.Resolved {
+		return false
+	}
+	episodes := a.firingEpisodes()
+	if len(episodes) == 0 {
+		return false
+	}
+	last := episodes[len(episodes)-1]
+	start, end := a.Results[last.start].EvaluationTime, a.Results[last.end].EvaluationTime
+	return a.LastSentAt.Before(start) && end.Before(a.LastSentAt.Add(resendDelay))
+}
+
+// ValueStats summarizes the values of a RefID across Results.
+type ValueStats struct {
+	// Count is the number of values. The other fields are zero if it is zero.
+	Count int
+	Min   float64
+	Max   float64
+	Mean  float64
+	P50   float64
+	P90   float64
+	P99   float64
+}
+
+// ValueStats returns the distribution of the values of the RefID across Results,
+// skipping evaluations without a value and NaN values. The percentiles are linearly
+// interpolated between the closest values.
+func (a *State) ValueStats(refID string) ValueStats {
+	var values []float64
+	for _, r := range a.Results {
+		if v := r.Values[refID]; v != nil && !math.IsNaN(*v) {
+			values = append(values, *v)
+		}
+	}
+	if len(values) == 0 {
+		return ValueStats{}
+	}
+	sort.Float64s(values)
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return ValueStats{
+		Count: len(values),
+		Min:   values[0],
+		Max:   values[len(values)-1],
+		Mean:  sum / float64(len(values)),
+		P50:   percentile(values, 0.5),
+		P90:   percentile(values, 0.9),
+		P99:   percentile(values, 0.99),
+	}
+}
+
+// ValueVolatility returns the coefficient of variation of the values of the RefID across
+// Results, the standard deviation of the values relative to their mean, skipping
+// evaluations without a value and NaN values. It is zero for a value that does not
+// change, and grows with the spread of the values. It returns zero if there are no
+// values or their mean is zero.
+func (a *State) ValueVolatility(refID string) float64 {
+	var values []float64
+	for _, r := range a.Results {
+		if v := r.Values[refID]; v != nil && !math.IsNaN(*v) {
+			values = append(values, *v)
+		}
+	}
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	if mean == 0 {
+		return 0
+	}
+	var variance float64
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+	variance /= float64(len(values))
+	return math.Sqrt(variance) / math.Abs(mean)
+}
+
+// percentile returns the p-th percentile, between 0 and 1, of the sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := p * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(rank-float64(lower))
+}
+
+// BreachOscillations returns the number of times the condition was breached and then
+// cleared in the evaluations within the rule's For duration of the latest evaluation.
+// It is zero for a sustained breach, and grows for a condition that oscillates around
+// its threshold.
+func (a *State) BreachOscillations(alertRule *ngModels.AlertRule) int {
+	if len(a.Results) == 0 {
+		return 0
+	}
+	from := a.Results[len(a.Results)-1].EvaluationTime.Add(-alertRule.For)
+	oscillations := 0
+	for i := 1; i < len(a.Results); i++ {
+		if a.Results[i-1].EvaluationTime.Before(from) {
+			continue
+		}
+		if a.Results[i-1].EvaluationState == eval.Alerting && a.Results[i].EvaluationState != eval.Alerting {
+			oscillations++
+		}
+	}
+	return oscillations
+}
+
+// FiringAverageValue returns the time-weighted average of the values of the RefID
+// in the current firing episode, integrating linearly between evaluations so that
+// uneven evaluation intervals do not skew the average. It returns nil if the state
+// is not Alerting or the episode has no values for the RefID.
+func (a *State) FiringAverageValue(refID string) *float64 {
+	if a.State != eval.Alerting {
+		return nil
+	}
+	episodes := a.firingEpisodes()
+	if len(episodes) == 0 || episodes[len(episodes)-1].end != len(a.Results)-1 {
+		return nil
+	}
+	current := episodes[len(episodes)-1]
+
+	var prev *Evaluation
+	var area, duration float64
+	for i := current.start; i <= current.end; i++ {
+		r := &a.Results[i]
+		v := r.Values[refID]
+		if v == nil || math.IsNaN(*v) {
+			continue
+		}
+		if prev != nil {
+			dt := r.EvaluationTime.Sub(prev.EvaluationTime).Seconds()
+			area += (*prev.Values[refID] + *v) / 2 * dt
+			duration += dt
+		}
+		prev = r
+	}
+	if prev == nil {
+		return nil
+	}
+	avg := *prev.Values[refID]
+	if duration > 0 {
+		avg = area / duration
+	}
+	return &avg
+}
+
+// HealthScore returns the health of the rule of the state from 0 to 1, based on how
+// many of the evaluations in Results failed with an error. Recent errors are
+// penalized more than older ones, with the weight of each evaluation increasing
+// linearly from the oldest to the newest. It returns 1 if there are no Results.
+func (a *State) HealthScore() float64 {
+	var total, failed float64
+	for i, r := range a.Results {
+		weight := float64(i + 1)
+		total += weight
+		if r.EvaluationState == eval.Error {
+			failed += weight
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+	return 1 - failed/total
+}
+
+// fireProbabilityWindow is the number of most recent values used by FireProbability.
+const fireProbabilityWindow = 5
+
+// FireProbability estimates the probability that the next evaluation breaches the
+// threshold of the rule. It extrapolates the linear trend of the most recent values of
+// the threshold's RefID to the next evaluation, and treats the mean absolute change
+// between consecutive values as the uncertainty of the prediction. The probability is
+// that of a normal distribution centered on the prediction with that spread exceeding
+// the threshold. Values that approach the threshold increase the probability, and
+// values that recede from it decrease it.
+//
+// A single value, or values that do not change, are treated as certain. It returns
+// zero if the rule has no threshold or there are no values.
+func (a *State) FireProbability(alertRule *ngModels.AlertRule) float64 {
+	if alertRule.Threshold == nil {
+		return 0
+	}
+	threshold := *alertRule.Threshold
+	var values []float64
+	for _, r := range a.Results {
+		if v := r.Values[threshold.RefID]; v != nil && !math.IsNaN(*v) {
+			values = append(values, *v)
+		}
+	}
+	if len(values) > fireProbabilityWindow {
+		values = values[len(values)-fireProbabilityWindow:]
+	}
+	if len(values) == 0 {
+		return 0
+	}
+
+	n := float64(len(values))
+	var spread float64
+	for i := 1; i < len(values); i++ {
+		spread += math.Abs(values[i] - values[i-1])
+	}
+	predicted := values[0]
+	if len(values) > 1 {
+		slope, intercept := linearFit(values)
+		predicted = intercept + slope*n
+		spread /= n - 1
+	}
+
+	if spread == 0 {
+		if threshold.Breached(predicted) {
+			return 1
+		}
+		return 0
+	}
+	z := (predicted - threshold.Value) / spread
+	if threshold.Below {
+		z = -z
+	}
+	return 0.5 * (1 + math.Erf(z/math.Sqrt2))
+}
+
+// PredictNextState predicts the state after the next evaluation of the rule. It assumes
+// the condition of the rule is breached on the next evaluation if the FireProbability of
+// the threshold of the rule is at least a half, or if the rule has no threshold and the
+// state is Pending or Alerting. From there, it applies the timers of the rule:
+//
+//   - A Pending state whose breach persists fires if the next evaluation is more than
+//     For after it started, and stays Pending otherwise.
+//   - An Alerting state whose breach is predicted to clear resolves to Normal.
+//   - A Normal state whose breach is predicted becomes Pending, or Alerting if For is zero.
+//
+// NoData and Error states are predicted to stay as they are, as they do not depend on
+// the values.
+func (a *State) PredictNextState(alertRule *ngModels.AlertRule) eval.State {
+	if a.State == eval.NoData || a.State == eval.Error {
+		return a.State
+	}
+	breached := a.State != eval.Normal
+	if alertRule.Threshold != nil {
+		breached = a.FireProbability(alertRule) >= 0.5
+	}
+	if !breached {
+		return eval.Normal
+	}
+	switch a.State {
+	case eval.Alerting:
+		return eval.Alerting
+	case eval.Pending:
+		next := a.LastEvaluationTime.Add(time.Duration(alertRule.IntervalSeconds) * time.Second)
+		if next.Sub(a.StartsAt) > alertRule.For {
+			return eval.Alerting
+		}
+		return eval.Pending
+	default:
+		if alertRule.For > 0 {
+			return eval.Pending
+		}
+		return eval.Alerting
+	}
+}
+
+const (
+	// resolutionConfidenceEvaluations is the number of consecutive Normal evaluations for
+	// full confidence in a resolve. See ResolutionConfidence.
+	resolutionConfidenceEvaluations = 3
+	// resolutionConfidenceMargin is the margin of the latest value from the threshold,
+	// relative to the threshold, for full confidence in a resolve.
+	resolutionConfidenceMargin = 0.1
+)
+
+// ResolutionConfidence returns the confidence, from 0 to 1, that the state has truly
+// recovered rather than momentarily dipped below its threshold. It is the product of
+// the number of latest consecutive Normal evaluations, up to
+// resolutionConfidenceEvaluations, and the margin of the latest value of the threshold's
+// RefID from the threshold, up to resolutionConfidenceMargin of the threshold, each
+// scaled to 1. The margin is not considered if the rule has no threshold or the latest
+// evaluation has no value for it. It returns zero if the latest evaluation is not Normal.
+func (a *State) ResolutionConfidence(alertRule *ngModels.AlertRule) float64 {
+	normal := 0
+	for i := len(a.Results) - 1; i >= 0 && a.Results[i].EvaluationState == eval.Normal; i-- {
+		normal++
+	}
+	if normal == 0 {
+		return 0
+	}
+	confidence := math.Min(float64(normal)/resolutionConfidenceEvaluations, 1)
+
+	if alertRule.Threshold == nil {
+		return confidence
+	}
+	threshold := *alertRule.Threshold
+	v := a.Results[len(a.Results)-1].Values[threshold.RefID]
+	if v == nil || math.IsNaN(*v) {
+		return confidence
+	}
+	margin := threshold.Value - *v
+	if threshold.Below {
+		margin = -margin
+	}
+	if scale := math.Abs(threshold.Value); scale > 0 {
+		margin /= scale
+	}
+	return confidence * math.Max(0, math.Min(margin/resolutionConfidenceMargin, 1))
+}
+
+// FiringHeatmap returns the number of Alerting evaluations in Results by the weekday,
+// from Sunday as 0, and hour of their evaluation time, in the location of the time.
+func (a *State) FiringHeatmap() map[[2]int]int {
+	heatmap := make(map[[2]int]int)
+	for _, r := range a.Results {
+		if r.EvaluationState == eval.Alerting {
+			heatmap[[2]int{int(r.EvaluationTime.Weekday()), r.EvaluationTime.Hour()}]++
+		}
+	}
+	return heatmap
+}
+
+// linearFit returns the slope and intercept of the least squares fit of the values
+// against their index. There must be at least two values.
+func linearFit(values []float64) (slope, intercept float64) {
+	n := float64(len(values))
+	var sumX, sumY, sumXY, sumXX float64
+	for i, v := range values {
+		x := float64(i)
+		sumX += x
+		sumY += v
+		sumXY += x * v
+		sumXX += x * x
+	}
+	slope = (n*sumXY - sumX*sumY) / (n*sumXX - sumX*sumX)
+	intercept = (sumY - slope*sumX) / n
+	return slope, intercept
+}
+
+// EstimatedRecoveryTime estimates when the value of the threshold's RefID stops
+// breaching the threshold of the rule. It extrapolates the linear trend of the most
+// recent values, as FireProbability does, to when it crosses the threshold, assuming
+// evaluations continue at their average spacing. It returns zero if the rule has no
+// threshold, there are fewer than two values, the latest value does not breach the
+// threshold, or the values are not trending toward recovery.
+func (a *State) EstimatedRecoveryTime(alertRule *ngModels.AlertRule) time.Time {
+	if alertRule.Threshold == nil {
+		return time.Time{}
+	}
+	threshold := *alertRule.Threshold
+	var values []float64
+	var times []time.Time
+	for _, r := range a.Results {
+		if v := r.Values[threshold.RefID]; v != nil && !math.IsNaN(*v) {
+			values = append(values, *v)
+			times = append(times, r.EvaluationTime)
+		}
+	}
+	if len(values) > fireProbabilityWindow {
+		values = values[len(values)-fireProbabilityWindow:]
+		times = times[len(times)-fireProbabilityWindow:]
+	}
+	last := len(values) - 1
+	if last < 1 || !threshold.Breached(values[last]) {
+		return time.Time{}
+	}
+
+	slope, intercept := linearFit(values)
+	// Values above the threshold recover as they fall, and values below it as they rise.
+	if slope == 0 || (slope > 0) != threshold.Below {
+		return time.Time{}
+	}
+	remaining := (threshold.Value-intercept)/slope - float64(last)
+	if remaining < 0 {
+		remaining = 0
+	}
+	step := times[last].Sub(times[0]) / time.Duration(last)
+	return times[last].Add(time.Duration(remaining * float64(step)))
+}
+
+// Driver is what caused a state to enter its current value.
+type Driver int
+
+const (
+	// DriverData means the state was entered because of the data returned by the queries.
+	DriverData Driver = iota
+	// DriverError means the state was entered because the evaluation failed.
+	DriverError
+	// DriverNoData means the state was entered because the queries returned no data.
+	DriverNoData
+)
+
+func (d Driver) String() string {
+	switch d {
+	case DriverError:
+		return "Error"
+	case DriverNoData:
+		return "NoData"
+	default:
+		return "Data"
+	}
+}
+
+// TransitionDriver returns what caused the state to enter its current value, such as to
+// tell alerts that fire because of their data from those that fire because their rule
+// failed. The state entered its value at the first of the latest evaluations that kept
+// it there: those that did not return Normal for Alerting and Pending states, and those
+// that did not return Alerting for Normal states. It returns DriverData if there are no
+// Results.
+func (a *State) TransitionDriver() Driver {
+	switch a.State {
+	case eval.Error:
+		return DriverError
+	case eval.NoData:
+		return DriverNoData
+	}
+	// breaks is the evaluation state that would have left the current state.
+	breaks := eval.Normal
+	if a.State == eval.Normal {
+		breaks = eval.Alerting
+	}
+	i := len(a.Results) - 1
+	if i < 0 {
+		return DriverData
+	}
+	for i > 0 && a.Results[i-1].EvaluationState != breaks {
+		i--
+	}
+	switch a.Results[i].EvaluationState {
+	case eval.Error:
+		return DriverError
+	case eval.NoData:
+		return DriverNoData
+	default:
+		return DriverData
+	}
+}
+
+// Trend is the direction in which a value is moving.
+type Trend int
+
+const (
+	// TrendFlat means the value did not change by more than the deadband, or there
+	// are not enough values to tell.
+	TrendFlat Trend = iota
+	// TrendRising means the value increased.
+	TrendRising
+	// TrendFalling means the value decreased.
+	TrendFalling
+)
+
+func (t Trend) String() string {
+	switch t {
+	case TrendRising:
+		return "Rising"
+	case TrendFalling:
+		return "Falling"
+	default:
+		return "Flat"
+	}
+}
+
+// ValueTrend returns the direction in which the value of the RefID moved between the
+// last two evaluations. Changes of at most deadband are considered Flat, to ignore
+// noise. It returns TrendFlat if either evaluation has no value for the RefID.
+func (a *State) ValueTrend(refID string, deadband float64) Trend {
+	if len(a.Results) < 2 {
+		return TrendFlat
+	}
+	prev, last := a.Results[len(a.Results)-2].Values[refID], a.Results[len(a.Results)-1].Values[refID]
+	if prev == nil || last == nil {
+		return TrendFlat
+	}
+	switch delta := *last - *prev; {
+	case delta > deadband:
+		return TrendRising
+	case delta < -deadband:
+		return TrendFalling
+	default:
+		return TrendFlat
+	}
+}
+
+// StuckInError returns true if the evaluations of the state have continuously failed
+// with an error for at least threshold at the time now, such as when a data source is
+// permanently misconfigured. It is based on the evaluations rather than the state so
+// that errors are detected regardless of the ExecErrState of the rule.
+func (a *State) StuckInError(threshold time.Duration, now time.Time) bool {
+	i := len(a.Results) - 1
+	if i < 0 || a.Results[i].EvaluationState != eval.Error {
+		return false
+	}
+	for i > 0 && a.Results[i-1].EvaluationState == eval.Error {
+		i--
+	}
+	return now.Sub(a.Results[i].EvaluationTime) >= threshold
+}
+
+// EvaluationSuccessRate returns the fraction of the evaluations in Results that returned
+// data without an error, from 0 to 1. It returns 1 if there are no Results.
+func (a *State) EvaluationSuccessRate() float64 {
+	if len(a.Results) == 0 {
+		return 1
+	}
+	succeeded := 0
+	for _, r := range a.Results {
+		if r.EvaluationState != eval.Error && r.EvaluationState != eval.NoData {
+			succeeded++
+		}
+	}
+	return float64(succeeded) / float64(len(a.Results))
+}
+
+// EvaluationCoverage returns the fraction of the period before now that was evaluated,
+// from 0 to 1, as the number of evaluations in Results within the period against the
+// number expected at expectedInterval. Missed evaluations, such as while the scheduler
+// was overloaded, lower the coverage. It returns zero if the period or the interval is
+// not positive.
+func (a *State) EvaluationCoverage(period time.Duration, expectedInterval time.Duration, now time.Time) float64 {
+	if period <= 0 || expectedInterval <= 0 {
+		return 0
+	}
+	from := now.Add(-period)
+	evaluated := 0
+	for _, r := range a.Results {
+		if r.EvaluationTime.After(from) && !r.EvaluationTime.After(now) {
+			evaluated++
+		}
+	}
+	expected := int(period / expectedInterval)
+	if expected == 0 {
+		expected = 1
+	}
+	return math.Min(float64(evaluated)/float64(expected), 1)
+}
+
+// ErrorTaxonomy returns the number of failed evaluations in Results by the reason they
+// failed. Failed evaluations recorded without a reason are counted as ErrorReasonOther.
+func (a *State) ErrorTaxonomy() map[ErrorReason]int {
+	taxonomy := make(map[ErrorReason]int)
+	for _, r := range a.Results {
+		if r.EvaluationState != eval.Error {
+			continue
+		}
+		reason := r.ErrorReason
+		if reason == "" {
+			reason = ErrorReasonOther
+		}
+		taxonomy[reason]++
+	}
+	return taxonomy
+}
+
+// ResultConsistency returns the fraction of consecutive evaluations in Results that have
+// the same state, from 0 to 1. A low consistency can point to a flaky query. It returns
+// 1 if there are fewer than two Results.
+func (a *State) ResultConsistency() float64 {
+	if len(a.Results) < 2 {
+		return 1
+	}
+	same := 0
+	for i := 1; i < len(a.Results); i++ {
+		if a.Results[i].EvaluationState == a.Results[i-1].EvaluationState {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a.Results)-1)
+}
+
+// signalMinFiringDuration is how long a firing episode must last to be a meaningful
+// fire rather than noise. See SignalToNoise.
+const signalMinFiringDuration = 5 * time.Minute
+
+// SignalToNoise returns the ratio of meaningful fires to noise in Results. A firing
+// episode is meaningful if it lasted at least signalMinFiringDuration, or if it is
+// the current episode and it is acknowledged. It is noise if it resolved before then.
+// An episode that is still firing is not classified until it is either. It returns
+// the number of meaningful fires if there is no noise.
+func (a *State) SignalToNoise() float64 {
+	var signal, noise int
+	for _, e := range a.firingEpisodes() {
+		duration, resolved := a.episodeDuration(e)
+		switch {
+		case duration >= signalMinFiringDuration:
+			signal++
+		case !resolved && !a.AcknowledgedAt.IsZero():
+			signal++
+		case resolved:
+			noise++
+		}
+	}
+	if noise == 0 {
+		return float64(signal)
+	}
+	return float64(signal) / float64(noise)
+}
+
+// TimeAboveThreshold returns the cumulative time in Results that the value of the RefID
+// was above the threshold. Each evaluation above the threshold counts until the next
+// evaluation, so the latest evaluation does not count yet. Evaluations without a value
+// for the RefID are not above the threshold.
+func (a *State) TimeAboveThreshold(refID string, threshold float64) time.Duration {
+	var total time.Duration
+	for i := 0; i < len(a.Results)-1; i++ {
+		if v := a.Results[i].Values[refID]; v != nil && *v > threshold {
+			total += a.Results[i+1].EvaluationTime.Sub(a.Results[i].EvaluationTime)
+		}
+	}
+	return total
+}
+
+// FiringDuring returns true if any evaluation in Results between from and to, inclusive,
+// is Alerting.
+func (a *State) FiringDuring(from, to time.Time) bool {
+	for _, r := range a.Results {
+		if r.EvaluationState == eval.Alerting && !r.EvaluationTime.Before(from) && !r.EvaluationTime.After(to) {
+			return true
+		}
+	}
+	return false
+}
+
+// FalsePositiveLikelihood returns the fraction of the firing episodes in Results that
+// resolved within signalMinFiringDuration, as the likelihood that the alert is a false
+// positive. Episodes that are still firing are not counted. It returns zero if no
+// episode resolved.
+func (a *State) FalsePositiveLikelihood() float64 {
+	var resolved, short int
+	for _, e := range a.firingEpisodes() {
+		duration, ok := a.episodeDuration(e)
+		if !ok {
+			continue
+		}
+		resolved++
+		if duration < signalMinFiringDuration {
+			short++
+		}
+	}
+	if resolved == 0 {
+		return 0
+	}
+	return float64(short) / float64(resolved)
+}
+
+// DominantBreachRefID returns the RefID that breached in the most evaluations of the
+// latest firing episode in Results. The RefIDs that can breach are the expressions
+// other than the Condition whose values in the episode are all 0 or 1, such as the
+// comparisons A and B of a condition "$A || $B", and a RefID breaches in an evaluation
+// when its value is 1. The values of queries and reductions are not
+// counted, as a value that is not zero does not mean it breached. Ties are broken by
+// the RefID in alphabetical order. It returns an empty string if no RefID breached or
+// there is no firing episode.
+func (a *State) DominantBreachRefID() string {
+	episodes := a.firingEpisodes()
+	if len(episodes) == 0 {
+		return ""
+	}
+	e := episodes[len(episodes)-1]
+	results := a.Results[e.start : e.end+1]
+	comparisons := make(map[string]bool)
+	for _, r := range results {
+		for refID, v := range r.Values {
+			if refID == a.Condition {
+				continue
+			}
+			isComparison, ok := comparisons[refID]
+			comparisons[refID] = (isComparison || !ok) && v != nil && (*v == 0 || *v == 1)
+		}
+	}
+	counts := make(map[string]int)
+	for _, r := range results {
+		for refID, v := range r.Values {
+			if comparisons[refID] && *v == 1 {
+				counts[refID]++
+			}
+		}
+	}
+	var dominant string
+	for refID, n := range counts {
+		if n > counts[dominant] || (n == counts[dominant] && refID < dominant) {
+			dominant = refID
+		}
+	}
+	return dominant
+}
+
+// CadenceDrift returns the slope of the gaps between consecutive evaluations in
+// Results, in seconds per evaluation. It is zero for a steady cadence and positive
+// when the evaluations get further apart, such as when the scheduler is degrading.
+// It returns zero if there are fewer than three evaluations.
+func (a *State) CadenceDrift() float64 {
+	if len(a.Results) < 3 {
+		return 0
+	}
+	gaps := make([]float64, 0, len(a.Results)-1)
+	for i := 1; i < len(a.Results); i++ {
+		gaps = append(gaps, a.Results[i].EvaluationTime.Sub(a.Results[i-1].EvaluationTime).Seconds())
+	}
+	slope, _ := linearFit(gaps)
+	return slope
+}
@@ -0,0 +1,1825 @@
+package state
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ptr "github.com/xorcare/pointer"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+func TestRetainedWindow(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected time.Duration
+	}{
+		{
+			name:     "no results",
+			expected: 0,
+		},
+		{
+			name: "single result",
+			results: []Evaluation{
+				{EvaluationTime: evaluationTime},
+			},
+			expected: 0,
+		},
+		{
+			name: "multiple results span from the first to the last evaluation",
+			results: []Evaluation{
+				{EvaluationTime: evaluationTime},
+				{EvaluationTime: evaluationTime.Add(10 * time.Second)},
+				{EvaluationTime: evaluationTime.Add(20 * time.Second)},
+				{EvaluationTime: evaluationTime.Add(30 * time.Second)},
+			},
+			expected: 30 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.RetainedWindow())
+		})
+	}
+}
+
+func TestHasEverFired(t *testing.T) {
+	testCases := []struct {
+		name     string
+		state    *State
+		expected bool
+	}{
+		{
+			name: "never fired",
+			state: &State{
+				State: eval.Normal,
+				Results: []Evaluation{
+					{EvaluationState: eval.Normal},
+					{EvaluationState: eval.NoData},
+					{EvaluationState: eval.Normal},
+				},
+			},
+			expected: false,
+		},
+		{
+			name: "previously fired and now normal",
+			state: &State{
+				State: eval.Normal,
+				Results: []Evaluation{
+					{EvaluationState: eval.Normal},
+					{EvaluationState: eval.Alerting},
+					{EvaluationState: eval.Normal},
+				},
+			},
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.state.HasEverFired())
+		})
+	}
+}
+
+func TestFiringHourHistogram(t *testing.T) {
+	day, _ := time.Parse("2006-01-02", "2021-03-25")
+	at := func(days, hours, minutes int) time.Time {
+		return day.AddDate(0, 0, days).Add(time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute)
+	}
+
+	s := &State{
+		Results: []Evaluation{
+			{EvaluationTime: at(0, 2, 0), EvaluationState: eval.Alerting},
+			{EvaluationTime: at(0, 2, 30), EvaluationState: eval.Alerting},
+			{EvaluationTime: at(0, 3, 0), EvaluationState: eval.Normal},
+			{EvaluationTime: at(0, 14, 0), EvaluationState: eval.Normal},
+			{EvaluationTime: at(1, 2, 10), EvaluationState: eval.Alerting},
+			{EvaluationTime: at(1, 3, 5), EvaluationState: eval.Alerting},
+			{EvaluationTime: at(1, 14, 0), EvaluationState: eval.Pending},
+			{EvaluationTime: at(2, 2, 15), EvaluationState: eval.Alerting},
+		},
+	}
+	assert.Equal(t, map[int]int{2: 4, 3: 1}, s.FiringHourHistogram())
+
+	s = &State{Results: []Evaluation{{EvaluationTime: at(0, 2, 0), EvaluationState: eval.Normal}}}
+	assert.Empty(t, s.FiringHourHistogram())
+}
+
+// makeResults returns evaluations with the given states, 10 seconds apart.
+func makeResults(start time.Time, states ...eval.State) []Evaluation {
+	results := make([]Evaluation, 0, len(states))
+	for i, s := range states {
+		results = append(results, Evaluation{
+			EvaluationTime:  start.Add(time.Duration(i) * 10 * time.Second),
+			EvaluationState: s,
+		})
+	}
+	return results
+}
+
+func TestRecurrenceCount(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	now := evaluationTime.Add(100 * time.Second)
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		period   time.Duration
+		expected int
+	}{
+		{
+			name:     "never fired",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal),
+			period:   time.Hour,
+			expected: 0,
+		},
+		{
+			name:     "multiple episodes",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting),
+			period:   time.Hour,
+			expected: 3,
+		},
+		{
+			name:     "a single long episode counts once",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			period:   time.Hour,
+			expected: 1,
+		},
+		{
+			name:     "episodes before the period are not counted",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Alerting, eval.Alerting),
+			period:   50 * time.Second,
+			expected: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.RecurrenceCount(tc.period, now))
+		})
+	}
+}
+
+func TestEligibleForAutoSilence(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	now := evaluationTime.Add(100 * time.Second)
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		window   time.Duration
+		expected bool
+	}{
+		{
+			name:     "flapping",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting),
+			window:   time.Hour,
+			expected: true,
+		},
+		{
+			name:     "stable",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			window:   time.Hour,
+			expected: false,
+		},
+		{
+			name:     "flapping before the window",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			window:   50 * time.Second,
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.EligibleForAutoSilence(4, tc.window, now))
+		})
+	}
+}
+
+func TestMeanTimeBetweenFailures(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected time.Duration
+	}{
+		{
+			name:     "no episodes",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal),
+			expected: 0,
+		},
+		{
+			name:     "single episode",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Normal),
+			expected: 0,
+		},
+		{
+			name: "multiple episodes",
+			// Resolved at 20s and fired again at 30s, resolved at 40s and fired again at 70s.
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Normal, eval.Normal, eval.Alerting),
+			expected: 20 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.MeanTimeBetweenFailures())
+		})
+	}
+}
+
+func TestLongestFiringStreak(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected time.Duration
+	}{
+		{
+			name:     "never fired",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal),
+			expected: 0,
+		},
+		{
+			name:     "longest of multiple streaks",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal),
+			expected: 30 * time.Second,
+		},
+		{
+			name:     "streak still firing",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: 20 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.LongestFiringStreak())
+		})
+	}
+}
+
+func TestStateEntropy(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected float64
+	}{
+		{
+			name:     "no results",
+			expected: 0,
+		},
+		{
+			name:     "stable history has no entropy",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal, eval.Normal),
+			expected: 0,
+		},
+		{
+			name:     "mostly stable history has low entropy",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal, eval.Alerting),
+			expected: 0.8113,
+		},
+		{
+			name:     "chaotic history has high entropy",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.NoData, eval.Error),
+			expected: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.StateEntropy(), 0.0001)
+		})
+	}
+}
+
+func TestAuditTransitions(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngModels.AlertRule{For: 30 * time.Second}
+
+	outOfOrder := makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal)
+	outOfOrder[2].EvaluationTime = evaluationTime.Add(-time.Second)
+
+	testCases := []struct {
+		name        string
+		state       eval.State
+		startsAt    time.Time
+		transitions []TransitionPoint
+		results     []Evaluation
+		expected    []string
+	}{
+		{
+			name:     "no results",
+			expected: nil,
+		},
+		{
+			name:     "Alerting after For has elapsed",
+			state:    eval.Alerting,
+			startsAt: evaluationTime.Add(40 * time.Second),
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: nil,
+		},
+		{
+			name:     "Alerting before For has elapsed",
+			state:    eval.Alerting,
+			startsAt: evaluationTime.Add(30 * time.Second),
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: []string{
+				"state fired at 2021-03-25T00:00:30Z after 20s of Alerting evaluations but the rule requires 30s",
+			},
+		},
+		{
+			name:  "an earlier firing in Transitions is audited",
+			state: eval.Normal,
+			transitions: []TransitionPoint{
+				{Time: evaluationTime.Add(10 * time.Second), State: eval.Pending},
+				{Time: evaluationTime.Add(20 * time.Second), State: eval.Alerting},
+				{Time: evaluationTime.Add(30 * time.Second), State: eval.Normal},
+			},
+			results: makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal),
+			expected: []string{
+				"state fired at 2021-03-25T00:00:20Z after 10s of Alerting evaluations but the rule requires 30s",
+			},
+		},
+		{
+			name:     "Alerting that started before the retained results is not audited",
+			state:    eval.Alerting,
+			startsAt: evaluationTime.Add(10 * time.Second),
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Alerting),
+			expected: nil,
+		},
+		{
+			name:    "evaluations out of order",
+			results: outOfOrder,
+			expected: []string{
+				"evaluation 2 at 2021-03-24T23:59:59Z is before the previous evaluation at 2021-03-25T00:00:10Z",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, StartsAt: tc.startsAt, Transitions: tc.transitions, Results: tc.results}
+			assert.Equal(t, tc.expected, s.AuditTransitions(rule))
+		})
+	}
+}
+
+func TestForecastDailyNotifications(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name        string
+		results     []Evaluation
+		resendDelay time.Duration
+		expected    float64
+	}{
+		{
+			name:        "no results",
+			resendDelay: time.Minute,
+			expected:    0,
+		},
+		{
+			name:        "stable normal rule sends nothing",
+			results:     makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Normal),
+			resendDelay: time.Minute,
+			expected:    0,
+		},
+		{
+			name:        "stable firing rule sends one notification per resend delay",
+			results:     makeResults(evaluationTime, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			resendDelay: 30 * time.Second,
+			// 1 firing and 2 resends in 1 minute.
+			expected: 3 * 24 * 60,
+		},
+		{
+			name:        "noisy rule sends a notification each time it fires and resolves",
+			results:     makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting),
+			resendDelay: 30 * time.Second,
+			// 4 firing and 3 resolved in 1 minute.
+			expected: 7 * 24 * 60,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.ForecastDailyNotifications(tc.resendDelay), 0.0001)
+		})
+	}
+}
+
+func TestFirstFireLatency(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		forDur   time.Duration
+		results  []Evaluation
+		expected time.Duration
+	}{
+		{
+			name:     "fires immediately without For",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting),
+			expected: 0,
+		},
+		{
+			name:     "fires on the first evaluation after For",
+			forDur:   30 * time.Second,
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: 40 * time.Second,
+		},
+		{
+			name:     "an earlier episode that did not fire is ignored",
+			forDur:   10 * time.Second,
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: 20 * time.Second,
+		},
+		{
+			name:     "not firing",
+			forDur:   time.Minute,
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting),
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &ngModels.AlertRule{IntervalSeconds: 10, For: tc.forDur}
+			s := &State{}
+			for _, r := range tc.results {
+				s.Results = append(s.Results, r)
+				result := eval.Result{State: r.EvaluationState, EvaluatedAt: r.EvaluationTime}
+				if r.EvaluationState == eval.Alerting {
+					s.resultAlerting(rule, result)
+				} else {
+					s.resultNormal(rule, result)
+				}
+			}
+			assert.Equal(t, tc.expected, s.FirstFireLatency())
+		})
+	}
+}
+
+func TestDetectionLatencies(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	// Episodes start at 0s, 40s and 90s. The last one resolves before it fires with a For.
+	results := makeResults(evaluationTime,
+		eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal,
+		eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal,
+		eval.Alerting, eval.Normal,
+	)
+
+	testCases := []struct {
+		name     string
+		forDur   time.Duration
+		expected []time.Duration
+	}{
+		{
+			name:     "episodes fire after For",
+			forDur:   15 * time.Second,
+			expected: []time.Duration{20 * time.Second, 20 * time.Second},
+		},
+		{
+			name:     "episodes fire immediately without For",
+			forDur:   0,
+			expected: []time.Duration{0, 0, 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: results, For: tc.forDur}
+			assert.Equal(t, tc.expected, s.DetectionLatencies())
+		})
+	}
+
+	t.Run("no episodes", func(t *testing.T) {
+		s := &State{Results: makeResults(evaluationTime, eval.Normal)}
+		assert.Empty(t, s.DetectionLatencies())
+	})
+}
+
+func TestCompactTimeline(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected []TransitionPoint
+	}{
+		{
+			name:     "no results",
+			expected: nil,
+		},
+		{
+			name:    "a single run is collapsed into one point",
+			results: makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal),
+			expected: []TransitionPoint{
+				{Time: evaluationTime, State: eval.Normal},
+			},
+		},
+		{
+			name:    "each run is collapsed into a point at its first evaluation",
+			results: makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.NoData, eval.Normal, eval.Normal),
+			expected: []TransitionPoint{
+				{Time: evaluationTime, State: eval.Normal},
+				{Time: evaluationTime.Add(20 * time.Second), State: eval.Alerting},
+				{Time: evaluationTime.Add(50 * time.Second), State: eval.NoData},
+				{Time: evaluationTime.Add(60 * time.Second), State: eval.Normal},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.CompactTimeline())
+		})
+	}
+}
+
+func TestChangePoints(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected []time.Time
+	}{
+		{
+			name:     "no results",
+			expected: nil,
+		},
+		{
+			name:     "no transitions",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Alerting),
+			expected: nil,
+		},
+		{
+			name:    "multiple transitions",
+			results: makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Error, eval.Normal, eval.Normal, eval.Alerting),
+			expected: []time.Time{
+				evaluationTime.Add(20 * time.Second),
+				evaluationTime.Add(40 * time.Second),
+				evaluationTime.Add(50 * time.Second),
+				evaluationTime.Add(70 * time.Second),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.ChangePoints())
+		})
+	}
+}
+
+func TestRollingStability(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	t.Run("no results", func(t *testing.T) {
+		s := &State{}
+		assert.Nil(t, s.RollingStability(time.Minute, 10*time.Second, evaluationTime))
+	})
+
+	t.Run("history that becomes stable over time", func(t *testing.T) {
+		s := &State{Results: makeResults(evaluationTime,
+			eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting,
+			eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Normal)}
+		now := evaluationTime.Add(100 * time.Second)
+
+		scores := s.RollingStability(40*time.Second, 20*time.Second, now)
+		expected := []float64{0, 0, 1.0 / 3, 1, 1}
+		require.Len(t, scores, len(expected))
+		for i := range expected {
+			assert.InDelta(t, expected[i], scores[i], 0.0001)
+		}
+	})
+}
+
+func TestResolvedBeforeSend(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	results := makeResults(evaluationTime.Add(10*time.Second), eval.Normal, eval.Alerting, eval.Alerting, eval.Normal)
+
+	testCases := []struct {
+		name        string
+		state       *State
+		resendDelay time.Duration
+		expected    bool
+	}{
+		{
+			name:        "fired and resolved within the resend delay",
+			state:       &State{State: eval.Normal, Resolved: true, LastSentAt: evaluationTime, Results: results},
+			resendDelay: time.Minute,
+			expected:    true,
+		},
+		{
+			name:        "firing was sent after the resend delay",
+			state:       &State{State: eval.Normal, Resolved: true, LastSentAt: evaluationTime, Results: results},
+			resendDelay: 15 * time.Second,
+			expected:    false,
+		},
+		{
+			name:        "firing was sent",
+			state:       &State{State: eval.Normal, Resolved: true, LastSentAt: evaluationTime.Add(20 * time.Second), Results: results},
+			resendDelay: time.Minute,
+			expected:    false,
+		},
+		{
+			name:        "never sent",
+			state:       &State{State: eval.Normal, Resolved: true, Results: results},
+			resendDelay: time.Minute,
+			expected:    false,
+		},
+		{
+			name:        "not resolved",
+			state:       &State{State: eval.Normal, LastSentAt: evaluationTime, Results: results},
+			resendDelay: time.Minute,
+			expected:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.state.ResolvedBeforeSend(tc.resendDelay))
+		})
+	}
+}
+
+func TestValueStats(t *testing.T) {
+	var results []Evaluation
+	for _, v := range []float64{5, 1, 9, 3, 7, 2, 10, 4, 8, 6} {
+		results = append(results, Evaluation{Values: map[string]*float64{"A": ptr.Float64(v)}})
+	}
+	// Evaluations without a value for A are skipped.
+	results = append(results,
+		Evaluation{Values: map[string]*float64{"A": nil}},
+		Evaluation{Values: map[string]*float64{"B": ptr.Float64(100)}},
+		Evaluation{Values: map[string]*float64{"A": ptr.Float64(math.NaN())}},
+	)
+	s := &State{Results: results}
+
+	stats := s.ValueStats("A")
+	assert.Equal(t, 10, stats.Count)
+	assert.Equal(t, 1.0, stats.Min)
+	assert.Equal(t, 10.0, stats.Max)
+	assert.InDelta(t, 5.5, stats.Mean, 0.0001)
+	assert.InDelta(t, 5.5, stats.P50, 0.0001)
+	assert.InDelta(t, 9.1, stats.P90, 0.0001)
+	assert.InDelta(t, 9.91, stats.P99, 0.0001)
+
+	assert.Equal(t, ValueStats{}, s.ValueStats("C"))
+}
+
+func TestValueVolatility(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	withValues := func(values ...*float64) []Evaluation {
+		results := make([]Evaluation, 0, len(values))
+		for i, v := range values {
+			results = append(results, Evaluation{
+				EvaluationTime: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				Values:         map[string]*float64{"A": v},
+			})
+		}
+		return results
+	}
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected float64
+	}{
+		{
+			name:     "no values",
+			expected: 0,
+		},
+		{
+			name:     "stable series",
+			results:  withValues(ptr.Float64(10), ptr.Float64(10), nil, ptr.Float64(10)),
+			expected: 0,
+		},
+		{
+			name:     "volatile series",
+			results:  withValues(ptr.Float64(1), ptr.Float64(19), nil, ptr.Float64(1), ptr.Float64(19)),
+			expected: 0.9,
+		},
+		{
+			name:     "zero mean",
+			results:  withValues(ptr.Float64(-1), ptr.Float64(1)),
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.ValueVolatility("A"), 0.0001)
+		})
+	}
+}
+
+func TestBreachOscillations(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngModels.AlertRule{IntervalSeconds: 10, For: time.Minute}
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected int
+	}{
+		{
+			name:     "no results",
+			expected: 0,
+		},
+		{
+			name:     "clean breach",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: 0,
+		},
+		{
+			name:     "oscillating breach",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting),
+			expected: 3,
+		},
+		{
+			name:     "oscillations before the For duration are not counted",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.BreachOscillations(rule))
+		})
+	}
+}
+
+func TestFiringAverageValue(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	withValues := func(results []Evaluation, values ...*float64) []Evaluation {
+		for i, v := range values {
+			results[i].Values = map[string]*float64{"A": v}
+		}
+		return results
+	}
+
+	testCases := []struct {
+		name     string
+		state    eval.State
+		results  []Evaluation
+		expected *float64
+	}{
+		{
+			name:     "not firing",
+			state:    eval.Normal,
+			results:  withValues(makeResults(evaluationTime, eval.Normal), ptr.Float64(1)),
+			expected: nil,
+		},
+		{
+			name:     "single value",
+			state:    eval.Alerting,
+			results:  withValues(makeResults(evaluationTime, eval.Normal, eval.Alerting), ptr.Float64(1), ptr.Float64(5)),
+			expected: ptr.Float64(5),
+		},
+		{
+			name:  "varying values are weighted by time",
+			state: eval.Alerting,
+			results: func() []Evaluation {
+				results := withValues(makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting),
+					ptr.Float64(100), ptr.Float64(2), ptr.Float64(4), ptr.Float64(10))
+				// The last interval is three times as long as the first.
+				results[3].EvaluationTime = results[2].EvaluationTime.Add(30 * time.Second)
+				return results
+			}(),
+			// (3*10 + 7*30) / 40
+			expected: ptr.Float64(6),
+		},
+		{
+			name:     "evaluations without a value are skipped",
+			state:    eval.Alerting,
+			results:  withValues(makeResults(evaluationTime, eval.Alerting, eval.Alerting, eval.Alerting), ptr.Float64(2), nil, ptr.Float64(4)),
+			expected: ptr.Float64(3),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, Results: tc.results}
+			assert.Equal(t, tc.expected, s.FiringAverageValue("A"))
+		})
+	}
+}
+
+func TestHealthScore(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected float64
+	}{
+		{
+			name:     "no results",
+			expected: 1,
+		},
+		{
+			name:     "clean rule",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.NoData, eval.Normal),
+			expected: 1,
+		},
+		{
+			name:     "error-prone rule",
+			results:  makeResults(evaluationTime, eval.Error, eval.Normal, eval.Error, eval.Error),
+			expected: 1 - 8.0/10,
+		},
+		{
+			name:     "recent errors are penalized more than old errors",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal, eval.Error),
+			expected: 1 - 4.0/10,
+		},
+		{
+			name:     "old errors are penalized less than recent errors",
+			results:  makeResults(evaluationTime, eval.Error, eval.Normal, eval.Normal, eval.Normal),
+			expected: 1 - 1.0/10,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.HealthScore(), 0.0001)
+		})
+	}
+}
+
+func TestFireProbability(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	withValues := func(values ...float64) []Evaluation {
+		results := make([]Evaluation, 0, len(values))
+		for i, v := range values {
+			results = append(results, Evaluation{
+				EvaluationTime: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				Values:         map[string]*float64{"A": ptr.Float64(v)},
+			})
+		}
+		return results
+	}
+
+	testCases := []struct {
+		name      string
+		threshold *ngModels.Threshold
+		results   []Evaluation
+		assertion func(t *testing.T, p float64)
+	}{
+		{
+			name:      "no threshold",
+			results:   withValues(2, 4, 6, 8),
+			assertion: func(t *testing.T, p float64) { assert.Equal(t, 0.0, p) },
+		},
+		{
+			name:      "no values",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 9},
+			assertion: func(t *testing.T, p float64) { assert.Equal(t, 0.0, p) },
+		},
+		{
+			name:      "approaching trend is likely to fire",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 9},
+			results:   withValues(2, 4, 6, 8),
+			assertion: func(t *testing.T, p float64) { assert.InDelta(t, 0.6915, p, 0.0001) },
+		},
+		{
+			name:      "receding trend is unlikely to fire",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 9},
+			results:   withValues(8, 6, 4, 2),
+			assertion: func(t *testing.T, p float64) { assert.Less(t, p, 0.0001) },
+		},
+		{
+			name:      "approaching trend to a lower threshold is likely to fire",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 1, Below: true},
+			results:   withValues(8, 6, 4, 2),
+			assertion: func(t *testing.T, p float64) { assert.InDelta(t, 0.6915, p, 0.0001) },
+		},
+		{
+			name:      "only the most recent values are used",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 9},
+			results:   withValues(100, 100, 100, 2, 4, 6, 8, 10),
+			assertion: func(t *testing.T, p float64) { assert.InDelta(t, 0.9332, p, 0.0001) },
+		},
+		{
+			name:      "unchanging value over the threshold fires",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 9},
+			results:   withValues(10, 10, 10),
+			assertion: func(t *testing.T, p float64) { assert.Equal(t, 1.0, p) },
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			tc.assertion(t, s.FireProbability(&ngModels.AlertRule{Threshold: tc.threshold}))
+		})
+	}
+}
+
+func TestResolutionConfidence(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	withValues := func(states []eval.State, values ...float64) []Evaluation {
+		results := makeResults(evaluationTime, states...)
+		for i, v := range values {
+			results[i].Values = map[string]*float64{"A": ptr.Float64(v)}
+		}
+		return results
+	}
+	threshold := &ngModels.Threshold{RefID: "A", Value: 10}
+
+	testCases := []struct {
+		name      string
+		results   []Evaluation
+		threshold *ngModels.Threshold
+		expected  float64
+	}{
+		{
+			name:      "marginal recovery",
+			results:   withValues([]eval.State{eval.Alerting, eval.Alerting, eval.Normal}, 12, 11, 9.9),
+			threshold: threshold,
+			expected:  1.0 / 3 * 0.1,
+		},
+		{
+			name:      "solid recovery",
+			results:   withValues([]eval.State{eval.Alerting, eval.Normal, eval.Normal, eval.Normal}, 12, 8, 6, 5),
+			threshold: threshold,
+			expected:  1,
+		},
+		{
+			name:      "solid recovery below a lower threshold",
+			results:   withValues([]eval.State{eval.Normal, eval.Normal, eval.Normal}, 12, 14, 15),
+			threshold: &ngModels.Threshold{RefID: "A", Value: 10, Below: true},
+			expected:  1,
+		},
+		{
+			name:     "recovery without threshold",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Normal),
+			expected: 2.0 / 3,
+		},
+		{
+			name:      "not recovered",
+			results:   withValues([]eval.State{eval.Normal, eval.Alerting}, 5, 12),
+			threshold: threshold,
+			expected:  0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.ResolutionConfidence(&ngModels.AlertRule{Threshold: tc.threshold}), 0.0001)
+		})
+	}
+}
+
+func TestFiringHeatmap(t *testing.T) {
+	// 2021-03-22 is a Monday.
+	monday, _ := time.Parse("2006-01-02", "2021-03-22")
+	at := func(day time.Duration, hour time.Duration, state eval.State) Evaluation {
+		return Evaluation{EvaluationTime: monday.Add(day*24*time.Hour + hour*time.Hour), EvaluationState: state}
+	}
+
+	t.Run("concentrated in business hours", func(t *testing.T) {
+		s := &State{Results: []Evaluation{
+			at(0, 9, eval.Alerting),
+			at(0, 9, eval.Alerting),
+			at(0, 10, eval.Alerting),
+			at(0, 11, eval.Normal),
+			at(1, 9, eval.Alerting),
+			at(5, 9, eval.Pending),
+			at(6, 3, eval.Alerting),
+		}}
+		assert.Equal(t, map[[2]int]int{
+			{int(time.Monday), 9}:  2,
+			{int(time.Monday), 10}: 1,
+			{int(time.Tuesday), 9}: 1,
+			{int(time.Sunday), 3}:  1,
+		}, s.FiringHeatmap())
+	})
+
+	t.Run("never firing", func(t *testing.T) {
+		s := &State{Results: makeResults(monday, eval.Normal, eval.Pending, eval.NoData)}
+		assert.Empty(t, s.FiringHeatmap())
+	})
+}
+
+func TestPredictNextState(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	withValues := func(values ...float64) []Evaluation {
+		results := make([]Evaluation, 0, len(values))
+		for i, v := range values {
+			results = append(results, Evaluation{
+				EvaluationTime: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				Values:         map[string]*float64{"A": ptr.Float64(v)},
+			})
+		}
+		return results
+	}
+	threshold := &ngModels.Threshold{RefID: "A", Value: 5}
+
+	testCases := []struct {
+		name      string
+		state     *State
+		forDur    time.Duration
+		threshold *ngModels.Threshold
+		expected  eval.State
+	}{
+		{
+			name:     "pending about to fire",
+			state:    &State{State: eval.Pending, StartsAt: evaluationTime, LastEvaluationTime: evaluationTime.Add(50 * time.Second)},
+			forDur:   55 * time.Second,
+			expected: eval.Alerting,
+		},
+		{
+			name:     "pending not yet due to fire",
+			state:    &State{State: eval.Pending, StartsAt: evaluationTime, LastEvaluationTime: evaluationTime.Add(20 * time.Second)},
+			forDur:   55 * time.Second,
+			expected: eval.Pending,
+		},
+		{
+			name:      "recovering alerting resolves",
+			state:     &State{State: eval.Alerting, Results: withValues(10, 8, 6, 4)},
+			threshold: threshold,
+			expected:  eval.Normal,
+		},
+		{
+			name:      "worsening alerting keeps firing",
+			state:     &State{State: eval.Alerting, Results: withValues(6, 8, 10, 12)},
+			threshold: threshold,
+			expected:  eval.Alerting,
+		},
+		{
+			name:      "normal approaching the threshold becomes pending",
+			state:     &State{State: eval.Normal, Results: withValues(2, 3, 4, 5)},
+			forDur:    time.Minute,
+			threshold: threshold,
+			expected:  eval.Pending,
+		},
+		{
+			name:     "error stays",
+			state:    &State{State: eval.Error},
+			expected: eval.Error,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &ngModels.AlertRule{IntervalSeconds: 10, For: tc.forDur, Threshold: tc.threshold}
+			assert.Equal(t, tc.expected, tc.state.PredictNextState(rule))
+		})
+	}
+}
+
+func TestEstimatedRecoveryTime(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	withValues := func(values ...float64) []Evaluation {
+		results := make([]Evaluation, 0, len(values))
+		for i, v := range values {
+			results = append(results, Evaluation{
+				EvaluationTime: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				Values:         map[string]*float64{"A": ptr.Float64(v)},
+			})
+		}
+		return results
+	}
+
+	testCases := []struct {
+		name      string
+		threshold *ngModels.Threshold
+		results   []Evaluation
+		expected  time.Time
+	}{
+		{
+			name:    "no threshold",
+			results: withValues(10, 8, 6, 4),
+		},
+		{
+			name:      "recovering trend crosses the threshold",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 3},
+			results:   withValues(10, 8, 6, 4),
+			expected:  evaluationTime.Add(35 * time.Second),
+		},
+		{
+			name:      "recovering trend crosses a lower threshold",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 5, Below: true},
+			results:   withValues(0, 2, 4),
+			expected:  evaluationTime.Add(25 * time.Second),
+		},
+		{
+			name:      "worsening trend does not recover",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 1},
+			results:   withValues(2, 4, 6, 8),
+		},
+		{
+			name:      "flat values do not recover",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 1},
+			results:   withValues(4, 4, 4),
+		},
+		{
+			name:      "already recovered",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 3},
+			results:   withValues(10, 8, 6, 2),
+		},
+		{
+			name:      "single value",
+			threshold: &ngModels.Threshold{RefID: "A", Value: 3},
+			results:   withValues(10),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			rule := &ngModels.AlertRule{Threshold: tc.threshold}
+			assert.Equal(t, tc.expected, s.EstimatedRecoveryTime(rule))
+		})
+	}
+}
+
+func TestTransitionDriver(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		state    eval.State
+		results  []Evaluation
+		expected Driver
+	}{
+		{
+			name:     "firing because of data",
+			state:    eval.Alerting,
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Error),
+			expected: DriverData,
+		},
+		{
+			name:     "firing because of errors",
+			state:    eval.Alerting,
+			results:  makeResults(evaluationTime, eval.Normal, eval.Error, eval.Alerting),
+			expected: DriverError,
+		},
+		{
+			name:     "firing because of no data",
+			state:    eval.Alerting,
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.NoData),
+			expected: DriverNoData,
+		},
+		{
+			name:     "resolved because of data",
+			state:    eval.Normal,
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Error),
+			expected: DriverData,
+		},
+		{
+			name:     "resolved because of errors",
+			state:    eval.Normal,
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Error, eval.Normal),
+			expected: DriverError,
+		},
+		{
+			name:     "error state",
+			state:    eval.Error,
+			results:  makeResults(evaluationTime, eval.Normal, eval.Error),
+			expected: DriverError,
+		},
+		{
+			name:     "no data state",
+			state:    eval.NoData,
+			results:  makeResults(evaluationTime, eval.Normal, eval.NoData),
+			expected: DriverNoData,
+		},
+		{
+			name:     "no results",
+			state:    eval.Alerting,
+			expected: DriverData,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, Results: tc.results}
+			assert.Equal(t, tc.expected, s.TransitionDriver())
+		})
+	}
+}
+
+func TestValueTrend(t *testing.T) {
+	withValues := func(values ...*float64) []Evaluation {
+		results := make([]Evaluation, 0, len(values))
+		for _, v := range values {
+			results = append(results, Evaluation{Values: map[string]*float64{"A": v}})
+		}
+		return results
+	}
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		deadband float64
+		expected Trend
+	}{
+		{
+			name:     "rising",
+			results:  withValues(ptr.Float64(100), ptr.Float64(1), ptr.Float64(2)),
+			expected: TrendRising,
+		},
+		{
+			name:     "falling",
+			results:  withValues(ptr.Float64(1), ptr.Float64(2), ptr.Float64(1)),
+			expected: TrendFalling,
+		},
+		{
+			name:     "unchanged is flat",
+			results:  withValues(ptr.Float64(2), ptr.Float64(2)),
+			expected: TrendFlat,
+		},
+		{
+			name:     "rising within the deadband is flat",
+			results:  withValues(ptr.Float64(2), ptr.Float64(2.5)),
+			deadband: 0.5,
+			expected: TrendFlat,
+		},
+		{
+			name:     "falling within the deadband is flat",
+			results:  withValues(ptr.Float64(2), ptr.Float64(1.6)),
+			deadband: 0.5,
+			expected: TrendFlat,
+		},
+		{
+			name:     "rising beyond the deadband",
+			results:  withValues(ptr.Float64(2), ptr.Float64(2.6)),
+			deadband: 0.5,
+			expected: TrendRising,
+		},
+		{
+			name:     "single evaluation is flat",
+			results:  withValues(ptr.Float64(2)),
+			expected: TrendFlat,
+		},
+		{
+			name:     "missing value is flat",
+			results:  withValues(nil, ptr.Float64(2)),
+			expected: TrendFlat,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.ValueTrend("A", tc.deadband))
+		})
+	}
+}
+
+func TestStuckInError(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	now := evaluationTime.Add(50 * time.Second)
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected bool
+	}{
+		{
+			name:     "no results",
+			expected: false,
+		},
+		{
+			name:     "long error",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Error, eval.Error, eval.Error, eval.Error, eval.Error),
+			expected: true,
+		},
+		{
+			name:     "transient error",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Error, eval.Error),
+			expected: false,
+		},
+		{
+			name:     "recovered from a long error",
+			results:  makeResults(evaluationTime, eval.Error, eval.Error, eval.Error, eval.Error, eval.Error, eval.Normal),
+			expected: false,
+		},
+		{
+			name:     "interrupted error",
+			results:  makeResults(evaluationTime, eval.Error, eval.Error, eval.Normal, eval.Error, eval.Error, eval.Error),
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.StuckInError(30*time.Second, now))
+		})
+	}
+}
+
+func TestEvaluationSuccessRate(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected float64
+	}{
+		{
+			name:     "no results",
+			expected: 1,
+		},
+		{
+			name:     "all successful",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Normal),
+			expected: 1,
+		},
+		{
+			name:     "mix of success, error and no data",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Error, eval.Alerting, eval.NoData, eval.Normal, eval.Error, eval.Normal, eval.Alerting),
+			expected: 5.0 / 8,
+		},
+		{
+			name:     "all failed",
+			results:  makeResults(evaluationTime, eval.Error, eval.NoData),
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.EvaluationSuccessRate(), 0.0001)
+		})
+	}
+}
+
+func TestEvaluationCoverage(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	full := makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal, eval.Normal)
+	gappy := []Evaluation{full[0], full[1], full[4], full[5]}
+	// The last evaluation is at 50s, so the minute before covers the six evaluations.
+	now := evaluationTime.Add(55 * time.Second)
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		period   time.Duration
+		expected float64
+	}{
+		{
+			name:     "full coverage",
+			results:  full,
+			period:   time.Minute,
+			expected: 1,
+		},
+		{
+			name:     "gappy coverage",
+			results:  gappy,
+			period:   time.Minute,
+			expected: 4.0 / 6,
+		},
+		{
+			name:     "evaluations before the period are not counted",
+			results:  full,
+			period:   30 * time.Second,
+			expected: 1,
+		},
+		{
+			name:     "no evaluations",
+			period:   time.Minute,
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.EvaluationCoverage(tc.period, 10*time.Second, now), 0.0001)
+		})
+	}
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	results := makeResults(evaluationTime, eval.Error, eval.Normal, eval.Error, eval.Error, eval.NoData, eval.Error, eval.Error)
+	for i, reason := range []ErrorReason{ErrorReasonTimeout, "", ErrorReasonQuery, ErrorReasonTimeout, "", ErrorReasonOther, ""} {
+		results[i].ErrorReason = reason
+	}
+	s := &State{Results: results}
+	assert.Equal(t, map[ErrorReason]int{
+		ErrorReasonTimeout: 2,
+		ErrorReasonQuery:   1,
+		ErrorReasonOther:   2,
+	}, s.ErrorTaxonomy())
+
+	assert.Empty(t, (&State{Results: makeResults(evaluationTime, eval.Normal, eval.NoData)}).ErrorTaxonomy())
+}
+
+func TestResultConsistency(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected float64
+	}{
+		{
+			name:     "no results",
+			expected: 1,
+		},
+		{
+			name:     "consistent history",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: 1,
+		},
+		{
+			name:     "inconsistent history",
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal),
+			expected: 0,
+		},
+		{
+			name:     "partly consistent history",
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Error, eval.Error, eval.Normal),
+			expected: 0.5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.ResultConsistency(), 0.0001)
+		})
+	}
+}
+
+func TestSignalToNoise(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	repeat := func(s eval.State, n int) []eval.State {
+		states := make([]eval.State, n)
+		for i := range states {
+			states[i] = s
+		}
+		return states
+	}
+	// 31 evaluations 10 seconds apart fire for 5 minutes.
+	long := repeat(eval.Alerting, 31)
+	flap := []eval.State{eval.Alerting, eval.Normal}
+
+	testCases := []struct {
+		name         string
+		states       []eval.State
+		acknowledged bool
+		expected     float64
+	}{
+		{
+			name:     "no results",
+			expected: 0,
+		},
+		{
+			name:     "noisy history",
+			states:   append(append(append(append([]eval.State{}, flap...), flap...), flap...), long...),
+			expected: 1.0 / 3,
+		},
+		{
+			name:     "clean history",
+			states:   append(append(append([]eval.State{}, long...), eval.Normal), long...),
+			expected: 2,
+		},
+		{
+			name:     "mixed history",
+			states:   append(append(append(append([]eval.State{}, long...), eval.Normal), flap...), flap...),
+			expected: 0.5,
+		},
+		{
+			name:         "acknowledged short fire is meaningful",
+			states:       append(append([]eval.State{}, flap...), eval.Alerting),
+			acknowledged: true,
+			expected:     1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: makeResults(evaluationTime, tc.states...)}
+			if tc.acknowledged {
+				s.AcknowledgedAt = evaluationTime
+			}
+			assert.InDelta(t, tc.expected, s.SignalToNoise(), 0.0001)
+		})
+	}
+}
+
+func TestTimeAboveThreshold(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	values := func(vs ...*float64) []Evaluation {
+		results := make([]Evaluation, 0, len(vs))
+		for i, v := range vs {
+			results = append(results, Evaluation{
+				EvaluationTime: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				Values:         map[string]*float64{"A": v},
+			})
+		}
+		return results
+	}
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected time.Duration
+	}{
+		{
+			name:     "no results",
+			expected: 0,
+		},
+		{
+			name:     "never above the threshold",
+			results:  values(ptr.Float64(1), ptr.Float64(5), ptr.Float64(2)),
+			expected: 0,
+		},
+		{
+			name:     "crossing the threshold multiple times",
+			results:  values(ptr.Float64(1), ptr.Float64(8), ptr.Float64(9), ptr.Float64(3), ptr.Float64(7), ptr.Float64(2), ptr.Float64(6)),
+			expected: 30 * time.Second,
+		},
+		{
+			name:     "missing values are not above the threshold",
+			results:  values(ptr.Float64(8), nil, ptr.Float64(8), ptr.Float64(1)),
+			expected: 20 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.TimeAboveThreshold("A", 5))
+		})
+	}
+}
+
+func TestFiringDuring(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	// Fires from 20s to 40s.
+	s := &State{Results: makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal, eval.Normal)}
+
+	testCases := []struct {
+		name     string
+		from, to time.Duration
+		expected bool
+	}{
+		{
+			name:     "inside the range",
+			from:     10 * time.Second,
+			to:       50 * time.Second,
+			expected: true,
+		},
+		{
+			name:     "range inside the episode",
+			from:     25 * time.Second,
+			to:       35 * time.Second,
+			expected: true,
+		},
+		{
+			name:     "partially overlapping the start of the range",
+			from:     35 * time.Second,
+			to:       time.Minute,
+			expected: true,
+		},
+		{
+			name:     "partially overlapping the end of the range",
+			from:     0,
+			to:       20 * time.Second,
+			expected: true,
+		},
+		{
+			name:     "before the range",
+			from:     45 * time.Second,
+			to:       time.Minute,
+			expected: false,
+		},
+		{
+			name:     "after the range",
+			from:     0,
+			to:       15 * time.Second,
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, s.FiringDuring(evaluationTime.Add(tc.from), evaluationTime.Add(tc.to)))
+		})
+	}
+}
+
+func TestFalsePositiveLikelihood(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	// 31 evaluations 10 seconds apart fire for 5 minutes.
+	sustained := make([]eval.State, 31)
+	for i := range sustained {
+		sustained[i] = eval.Alerting
+	}
+	short := []eval.State{eval.Alerting, eval.Normal}
+
+	testCases := []struct {
+		name     string
+		states   []eval.State
+		expected float64
+	}{
+		{
+			name:     "no results",
+			expected: 0,
+		},
+		{
+			name:     "always short",
+			states:   append(append(append([]eval.State{eval.Normal}, short...), short...), short...),
+			expected: 1,
+		},
+		{
+			name:     "sustained",
+			states:   append(append(append([]eval.State{}, sustained...), eval.Normal), sustained...),
+			expected: 0,
+		},
+		{
+			name:     "mostly short",
+			states:   append(append(append(append([]eval.State{}, short...), short...), short...), append(sustained, eval.Normal)...),
+			expected: 0.75,
+		},
+		{
+			name:     "episode still firing is not counted",
+			states:   append(append([]eval.State{}, short...), eval.Alerting),
+			expected: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: makeResults(evaluationTime, tc.states...)}
+			assert.InDelta(t, tc.expected, s.FalsePositiveLikelihood(), 0.0001)
+		})
+	}
+}
+
+func TestDominantBreachRefID(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	// QA and QB are queries, A and B are the comparisons "$QA > 80" and "$QB > 90", and
+	// C is the condition "$A || $B".
+	evaluation := func(i int, state eval.State, qa, qb float64) Evaluation {
+		values := map[string]*float64{"QA": ptr.Float64(qa), "QB": ptr.Float64(qb), "A": ptr.Float64(0), "B": ptr.Float64(0), "C": ptr.Float64(0)}
+		if qa > 80 {
+			values["A"], values["C"] = ptr.Float64(1), ptr.Float64(1)
+		}
+		if qb > 90 {
+			values["B"], values["C"] = ptr.Float64(1), ptr.Float64(1)
+		}
+		return Evaluation{
+			EvaluationTime:  evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+			EvaluationState: state,
+			Values:          values,
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected string
+	}{
+		{
+			name:     "no results",
+			expected: "",
+		},
+		{
+			name: "B dominates the episode",
+			results: []Evaluation{
+				evaluation(0, eval.Alerting, 85, 50),
+				evaluation(1, eval.Alerting, 85, 95),
+				evaluation(2, eval.Alerting, 50, 95),
+				evaluation(3, eval.Alerting, 50, 95),
+			},
+			expected: "B",
+		},
+		{
+			name: "the values of queries are not counted",
+			results: []Evaluation{
+				evaluation(0, eval.Alerting, 70, 95),
+				evaluation(1, eval.Alerting, 70, 95),
+				evaluation(2, eval.Alerting, 85, 50),
+			},
+			expected: "B",
+		},
+		{
+			name: "only the latest episode is tallied",
+			results: []Evaluation{
+				evaluation(0, eval.Alerting, 85, 50),
+				evaluation(1, eval.Alerting, 85, 50),
+				evaluation(2, eval.Alerting, 85, 50),
+				evaluation(3, eval.Normal, 50, 50),
+				evaluation(4, eval.Alerting, 50, 95),
+				evaluation(5, eval.Normal, 50, 50),
+			},
+			expected: "B",
+		},
+		{
+			name: "ties are broken alphabetically",
+			results: []Evaluation{
+				evaluation(0, eval.Alerting, 50, 95),
+				evaluation(1, eval.Alerting, 85, 50),
+			},
+			expected: "A",
+		},
+		{
+			name: "a query with values other than 0 or 1 is not counted",
+			results: []Evaluation{
+				{EvaluationTime: evaluationTime, EvaluationState: eval.Alerting, Values: map[string]*float64{"QA": ptr.Float64(1), "A": ptr.Float64(1), "C": ptr.Float64(1)}},
+				{EvaluationTime: evaluationTime.Add(10 * time.Second), EvaluationState: eval.Alerting, Values: map[string]*float64{"QA": ptr.Float64(1), "A": ptr.Float64(0), "C": ptr.Float64(1)}},
+				{EvaluationTime: evaluationTime.Add(20 * time.Second), EvaluationState: eval.Alerting, Values: map[string]*float64{"QA": ptr.Float64(2), "A": ptr.Float64(0), "C": ptr.Float64(1)}},
+			},
+			expected: "A",
+		},
+		{
+			name: "the condition is not counted",
+			results: []Evaluation{
+				{EvaluationTime: evaluationTime, EvaluationState: eval.Alerting, Values: map[string]*float64{"QA": ptr.Float64(85), "C": ptr.Float64(1)}},
+			},
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results, Condition: "C"}
+			assert.Equal(t, tc.expected, s.DominantBreachRefID())
+		})
+	}
+}
+
+func TestCadenceDrift(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	withGaps := func(gaps ...time.Duration) []Evaluation {
+		results := []Evaluation{{EvaluationTime: evaluationTime}}
+		at := evaluationTime
+		for _, g := range gaps {
+			at = at.Add(g)
+			results = append(results, Evaluation{EvaluationTime: at})
+		}
+		return results
+	}
+
+	testCases := []struct {
+		name     string
+		results  []Evaluation
+		expected float64
+	}{
+		{
+			name:     "too few evaluations",
+			results:  withGaps(10 * time.Second),
+			expected: 0,
+		},
+		{
+			name:     "steady cadence",
+			results:  withGaps(10*time.Second, 10*time.Second, 10*time.Second, 10*time.Second),
+			expected: 0,
+		},
+		{
+			name:     "degrading cadence",
+			results:  withGaps(10*time.Second, 12*time.Second, 14*time.Second, 16*time.Second),
+			expected: 2,
+		},
+		{
+			name:     "recovering cadence",
+			results:  withGaps(20*time.Second, 15*time.Second, 10*time.Second),
+			expected: -5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.InDelta(t, tc.expected, s.CadenceDrift(), 0.0001)
+		})
+	}
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/services/annotations"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
@@ -28,9 +33,143 @@ type Manager struct {
 	cache       *cache
 	quit        chan struct{}
 	ResendDelay time.Duration
+	// ResendDelayResolver, if set, overrides the other resend delays on a per-state basis,
+	// such as for the states of a rule. The other delays are used for the states it
+	// returns zero for.
+	ResendDelayResolver ResendDelayResolver
+	// OrgResendDelays, if set, are the default resend delays of organizations, used instead
+	// of ResendDelay and NoDataResendDelay for the states of the organizations they are
+	// set for, unless ResendDelayResolver returns a delay for the state.
+	OrgResendDelays map[int64]time.Duration
+	// NoDataResendDelay, if set, is the resend delay for NoData states instead of ResendDelay.
+	NoDataResendDelay time.Duration
+	// SuppressionWindows are the windows of time during which matching states are not sent.
+	SuppressionWindows []SuppressionWindow
+	// ResolveCoalesceWindow, if set, is how long a state must stay resolved before it is
+	// sent as resolved. Resolves of a flapping alert within the window are not sent.
+	ResolveCoalesceWindow time.Duration
+	// AckTTL, if set, is how long an acknowledgement of a state lasts. The state is
+	// re-sent and the acknowledgement is cleared once it expires.
+	AckTTL time.Duration
+	// MaxEvaluationLag, if set, is how stale the last evaluation of a state can be for
+	// it to be re-sent. It prevents resends based on stale evaluations when evaluations lag.
+	MaxEvaluationLag time.Duration
+	// SendPredicates, if set, decide whether the states of the rules they are set for
+	// are sent to the Alertmanager, instead of the built-in logic of NeedsSending.
+	SendPredicates map[ngModels.AlertRuleKey]SendPredicate
+	// SendLatestValues sends states with the values of their latest evaluation, so that
+	// resends of long-firing alerts carry the current values. Otherwise, they are sent
+	// with the values of their oldest retained evaluation.
+	SendLatestValues bool
+	// ResendOnAnnotationChange re-sends active states on the evaluation at which the
+	// annotations of their rule expand differently, such as when their severity
+	// escalates, regardless of the resend delay. Annotations added to the states, such as
+	// Error, do not count as changes.
+	ResendOnAnnotationChange bool
+	// PreservePrePendingStartsAt keeps the StartsAt of a Normal state in PrePendingStartsAt
+	// while the state is Pending.
+	PreservePrePendingStartsAt bool
+	// SkipFirstFire withholds firing on the first evaluation of a state after it is
+	// created or the cache is reset, even when For is 0. This avoids false alarms on startup.
+	SkipFirstFire bool
+	// OrgTimezone, if set, returns the timezone used to render timestamps in the labels and
+	// annotations of an organization's alerts. UTC is used when unset or when it returns nil.
+	OrgTimezone func(orgID int64) *time.Location
+	// MinResolveTimeout, if set, is the minimum time from now until an active alert
+	// resolves by itself. It prevents stale results from resolving alerts immediately.
+	MinResolveTimeout time.Duration
+	// MaxResolveTimeout, if set, is the maximum time from the evaluation until an active
+	// alert resolves by itself. It prevents alerts of rules with a long interval from
+	// lingering in the Alertmanager if they are no longer evaluated.
+	MaxResolveTimeout time.Duration
+	// RejectZeroEvaluatedAt rejects results without an evaluation time. Otherwise, the
+	// current time is used as their evaluation time.
+	RejectZeroEvaluatedAt bool
+	// ProcessResultsInArrivalOrder processes the results of a batch in the order they
+	// arrive. Otherwise, they are processed in order of evaluation, so that the final
+	// state is that of the latest result regardless of the order in which the results
+	// for the same alert arrive in the batch.
+	ProcessResultsInArrivalOrder bool
+	// RejectDuplicateRefIDs processes results with more than one value for the same RefID
+	// as errors. Otherwise, the duplicate values are kept under disambiguated keys.
+	RejectDuplicateRefIDs bool
+	// MaxEvaluationValues, if set, is the maximum number of RefIDs whose values are recorded
+	// with each evaluation in Results, to bound the memory of queries that return values
+	// for many RefIDs. The values of the other RefIDs are dropped and counted in the
+	// DroppedValues of the evaluation.
+	MaxEvaluationValues int
+	// CompactNilValues records the values of an evaluation in Results as nil, rather than
+	// as a map, when none of its RefIDs has a value, such as for classic conditions.
+	CompactNilValues bool
+	// TransitionObserver, if set, is called with each state after it is processed,
+	// according to EmissionMode.
+	TransitionObserver TransitionObserver
+	// EventObserver, if set, is called with the events of each state after it is
+	// processed, such as EventNoLongerNoData, regardless of EmissionMode.
+	EventObserver EventObserver
+	// EmissionMode configures whether TransitionObserver is called when a state changes
+	// or on every evaluation.
+	EmissionMode EmissionMode
+	// ResultArchiver, if set, is called with the evaluations trimmed from the Results of
+	// states instead of discarding them.
+	ResultArchiver ResultArchiver
+	// AnnotationHistory configures whether the annotations of states are recorded with
+	// each evaluation in their Results.
+	AnnotationHistory AnnotationHistory
+	// RetainLastError keeps the error of a state that recovers from Error as the
+	// LastErrorAnnotation until the state is Error again, for post-mortems.
+	RetainLastError bool
+	// TransitionBufferSize, if set, is the number of the latest changes of each state
+	// kept in its Transitions, such as for a live debug view.
+	TransitionBufferSize int
+	// MergeSameTimeResults combines results for the same state evaluated at the same time,
+	// such as of queries to synchronized datasources, into one evaluation in Results.
+	// The state is processed with the most severe state of the results. Otherwise, each
+	// result is a separate evaluation.
+	MergeSameTimeResults bool
+	// Backfill processes results as historical data, such as when backfilling the
+	// history of a rule. The states are updated but are not sent while it is set.
+	Backfill bool
+	// PausePolicy configures whether the states of a paused rule are resolved or kept.
+	// See PauseRule.
+	PausePolicy PausePolicy
+	// OutOfOrderResults configures how results evaluated before the last evaluation of
+	// their state are processed. They are processed as they arrive by default.
+	OutOfOrderResults OutOfOrderResults
+	// ResolveMissingSeries resolves the active states of a rule whose series are missing
+	// from the results of an evaluation, while other series of the rule are still
+	// evaluated. The resolved states are returned with the processed states so that the
+	// resolves are sent per series. Otherwise, they keep firing until they are stale.
+	ResolveMissingSeries bool
+	// PreserveLabelOrder records the labels of each result in the order they were
+	// returned by the datasource with its evaluation in Results, for integrations that
+	// render labels in their original order.
+	PreserveLabelOrder bool
+	// SiblingLabels, if set, returns the labels of states related to a state, such as
+	// of other series, that the annotation templates of the rule can reference with the
+	// sibling function.
+	SiblingLabels SiblingLabels
+	// ResolveOrphanedStates resolves the firing states of a rule that are removed because
+	// their series is no longer evaluated, such as when its labels change. The resolved
+	// states are returned by ProcessEvalResultsAndOrphans so that the resolves are sent
+	// after the states are removed. Otherwise, they are removed as they are.
+	ResolveOrphanedStates bool
+	// DatasourceOutages are the known outages of datasources. The states of rules that
+	// query a datasource do not change during its outages.
+	DatasourceOutages []DatasourceOutage
+	// StartupResolveGrace, if set, is how long after the cache is warmed at startup the
+	// resolves of restored states are held until the next evaluation confirms them. This
+	// avoids spurious resolves of alerts that still fire but do not look like it on the
+	// first evaluation after a restart.
+	StartupResolveGrace time.Duration
+	// Clock is used to get the current time.
+	Clock clock.Clock
 
 	ruleStore     store.RuleStore
 	instanceStore store.InstanceStore
+
+	// warmedAt is when the cache was last warmed, which is at startup.
+	warmedAt time.Time
 }
 
 func NewManager(logger log.Logger, metrics *metrics.State, externalURL *url.URL, ruleStore store.RuleStore, instanceStore store.InstanceStore) *Manager {
@@ -38,6 +177,7 @@ func NewManager(logger log.Logger, metrics *metrics.State, externalURL *url.URL,
 		cache:         newCache(logger, metrics, externalURL),
 		quit:          make(chan struct{}),
 		ResendDelay:   ResendDelay, // TODO: make this configurable
+		Clock:         clock.New(),
 		log:           logger,
 		metrics:       metrics,
 		ruleStore:     ruleStore,
@@ -47,6 +187,36 @@ func NewManager(logger log.Logger, metrics *metrics.State, externalURL *url.URL,
 	return manager
 }
 
+// ResendDelayFor returns the resend delay for a state with the given labels.
+// It uses ResendDelayResolver when set and it returns a delay for the labels, and
+// falls back to ResendDelay otherwise. The delays of organizations are not used.
+func (st *Manager) ResendDelayFor(labels data.Labels) time.Duration {
+	if st.ResendDelayResolver != nil {
+		if delay := st.ResendDelayResolver(labels); delay != 0 {
+			return delay
+		}
+	}
+	return st.ResendDelay
+}
+
+// SendPolicy returns the policy used to decide when states are sent to the Alertmanager.
+func (st *Manager) SendPolicy() SendPolicy {
+	return SendPolicy{
+		ResendDelay:           func(data.Labels) time.Duration { return st.ResendDelay },
+		StateResendDelay:      st.ResendDelayResolver,
+		NoDataResendDelay:     st.NoDataResendDelay,
+		OrgResendDelays:       st.OrgResendDelays,
+		SuppressionWindows:    st.SuppressionWindows,
+		ResolveCoalesceWindow: st.ResolveCoalesceWindow,
+		AckTTL:                st.AckTTL,
+		MaxEvaluationLag:      st.MaxEvaluationLag,
+		Predicates:            st.SendPredicates,
+		LatestValues:          st.SendLatestValues,
+		OnAnnotationChange:    st.ResendOnAnnotationChange,
+		Now:                   st.Clock.Now,
+	}
+}
+
 func (st *Manager) Close() {
 	st.quit <- struct{}{}
 }
@@ -54,6 +224,7 @@ func (st *Manager) Close() {
 func (st *Manager) Warm() {
 	st.log.Info("warming cache for startup")
 	st.ResetCache()
+	st.warmedAt = st.Clock.Now()
 
 	orgIds, err := st.instanceStore.FetchOrgIds()
 	if err != nil {
@@ -99,14 +270,15 @@ func (st *Manager) Warm() {
 				AlertRuleUID:       entry.RuleUID,
 				OrgID:              entry.RuleOrgID,
 				CacheId:            cacheId,
-				Labels:             lbs,
 				State:              translateInstanceState(entry.CurrentState),
 				Results:            []Evaluation{},
 				StartsAt:           entry.CurrentStateSince,
 				EndsAt:             entry.CurrentStateEnd,
 				LastEvaluationTime: entry.LastEvalTime,
-				Annotations:        ruleForEntry.Annotations,
+				Annotations:        copyAnnotations(ruleForEntry.Annotations),
+				restored:           true,
 			}
+			stateForEntry.SetLabels(lbs)
 			states = append(states, stateForEntry)
 		}
 	}
@@ -116,8 +288,18 @@ func (st *Manager) Warm() {
 	}
 }
 
-func (st *Manager) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
-	return st.cache.getOrCreate(ctx, alertRule, result)
+func (st *Manager) getOrCreate(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) (*State, bool) {
+	return st.cache.getOrCreate(ctx, alertRule, result, st.orgLocation(alertRule.OrgID), st.OutOfOrderResults != OutOfOrderProcess, st.SiblingLabels)
+}
+
+// orgLocation returns the timezone of the organization, defaulting to UTC.
+func (st *Manager) orgLocation(orgID int64) *time.Location {
+	if st.OrgTimezone != nil {
+		if loc := st.OrgTimezone(orgID); loc != nil {
+			return loc
+		}
+	}
+	return time.UTC
 }
 
 func (st *Manager) set(entry *State) {
@@ -138,55 +320,214 @@ func (st *Manager) RemoveByRuleUID(orgID int64, ruleUID string) {
 	st.cache.removeByRuleUID(orgID, ruleUID)
 }
 
+// Reparent moves the states of the rule from the organization oldOrgID to the
+// organization of the rule, when the rule was moved between organizations. The
+// history of the states is kept, and their labels and CacheId are updated for the
+// rule in its new organization.
+func (st *Manager) Reparent(oldOrgID int64, alertRule *ngModels.AlertRule) {
+	st.cache.reparent(oldOrgID, alertRule)
+}
+
 func (st *Manager) ProcessEvalResults(ctx context.Context, alertRule *ngModels.AlertRule, results eval.Results) []*State {
+	states, _ := st.ProcessEvalResultsAndOrphans(ctx, alertRule, results)
+	return states
+}
+
+// ProcessEvalResultsAndOrphans is like ProcessEvalResults, but also returns the orphaned
+// states of the rule that were resolved if ResolveOrphanedStates is enabled. The orphaned
+// states are already removed from the cache and the database, so they must be sent
+// without being saved again.
+func (st *Manager) ProcessEvalResultsAndOrphans(ctx context.Context, alertRule *ngModels.AlertRule, results eval.Results) ([]*State, []*State) {
 	st.log.Debug("state manager processing evaluation results", "uid", alertRule.UID, "resultCount", len(results))
 	var states []*State
 	processedResults := make(map[string]*State, len(results))
+	sorted := make(eval.Results, 0, len(results))
 	for _, result := range results {
+		if result.EvaluatedAt.IsZero() {
+			if st.RejectZeroEvaluatedAt {
+				st.log.Warn("rejecting result without evaluation time", "uid", alertRule.UID, "instance", result.Instance)
+				continue
+			}
+			st.log.Warn("result without evaluation time, using the current time", "uid", alertRule.UID, "instance", result.Instance)
+			result.EvaluatedAt = st.Clock.Now()
+		}
+		sorted = append(sorted, result)
+	}
+	if !st.ProcessResultsInArrivalOrder {
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].EvaluatedAt.Before(sorted[j].EvaluatedAt)
+		})
+	}
+	var latest time.Time
+	for _, result := range sorted {
 		s := st.setNextState(ctx, alertRule, result)
 		states = append(states, s)
 		processedResults[s.CacheId] = s
+		if result.EvaluatedAt.After(latest) {
+			latest = result.EvaluatedAt
+		}
 	}
-	st.staleResultsHandler(alertRule, processedResults)
-	return states
+	if st.ResolveMissingSeries && len(sorted) > 0 {
+		states = append(states, st.resolveMissingSeries(alertRule, processedResults, latest)...)
+	}
+	return states, st.staleResultsHandler(alertRule, processedResults)
 }
 
 // Set the current state based on evaluation results
 func (st *Manager) setNextState(ctx context.Context, alertRule *ngModels.AlertRule, result eval.Result) *State {
-	currentState := st.getOrCreate(ctx, alertRule, result)
+	if st.RejectDuplicateRefIDs {
+		if refIDs := duplicateRefIDs(result.Values); len(refIDs) > 0 {
+			result.State = eval.Error
+			result.Error = fmt.Errorf("%w: %s", ErrDuplicateRefID, strings.Join(refIDs, ", "))
+		}
+	}
 
-	currentState.LastEvaluationTime = result.EvaluatedAt
-	currentState.EvaluationDuration = result.EvaluationDuration
-	currentState.Results = append(currentState.Results, Evaluation{
+	currentState, annotationsChanged := st.getOrCreate(ctx, alertRule, result)
+
+	queriedFrom, queriedTo := queryTimeRange(alertRule, result.EvaluatedAt)
+	evaluation := Evaluation{
 		EvaluationTime:   result.EvaluatedAt,
 		EvaluationState:  result.State,
 		EvaluationString: result.EvaluationString,
 		Values:           NewEvaluationValues(result.Values),
-	})
-	currentState.TrimResults(alertRule)
+		QueriedFrom:      queriedFrom,
+		QueriedTo:        queriedTo,
+	}
+	if result.State == eval.Error {
+		evaluation.ErrorReason = errorReason(result.Error)
+	}
+	if len(alertRule.ValueClamps) > 0 {
+		evaluation.ClampedRefIDs = clampedRefIDs(alertRule.ValueClamps, evaluation.Values)
+		if len(evaluation.ClampedRefIDs) > 0 {
+			st.log.Debug("clamped values of evaluation out of range", "uid", alertRule.UID, "instance", result.Instance, "refIDs", evaluation.ClampedRefIDs)
+		}
+	}
+	if st.MaxEvaluationValues > 0 {
+		evaluation.Values, evaluation.DroppedValues = capValues(evaluation.Values, st.MaxEvaluationValues)
+		if evaluation.DroppedValues > 0 {
+			st.log.Debug("dropped values of evaluation over the limit", "uid", alertRule.UID, "instance", result.Instance, "dropped", evaluation.DroppedValues)
+		}
+	}
+	if st.CompactNilValues {
+		evaluation.Values = compactValues(evaluation.Values)
+	}
+	if st.PreserveLabelOrder {
+		evaluation.OrderedLabels = orderedLabels(result.Instance, result.InstanceOrder)
+	}
+
+	if result.EvaluatedAt.Before(currentState.LastEvaluationTime) {
+		switch st.OutOfOrderResults {
+		case OutOfOrderReject:
+			st.log.Warn("rejecting result evaluated before the last evaluation", "uid", alertRule.UID, "instance", result.Instance, "evaluatedAt", result.EvaluatedAt)
+			return currentState
+		case OutOfOrderReorder:
+			st.log.Debug("recording result evaluated before the last evaluation", "uid", alertRule.UID, "instance", result.Instance, "evaluatedAt", result.EvaluatedAt)
+			currentState.insertResult(evaluation)
+			currentState.TrimResults(alertRule, st.ResultArchiver)
+			return currentState
+		}
+	}
+
+	currentState.Backfill = st.Backfill
+	currentState.Condition = alertRule.Condition
+	currentState.For = alertRule.For
+	if st.ResendOnAnnotationChange && annotationsChanged {
+		currentState.AnnotationsChangedAt = result.EvaluatedAt
+	}
+	currentState.Paused = false
+	currentState.LastEvaluationTime = result.EvaluatedAt
+	currentState.EvaluationDuration = result.EvaluationDuration
+	if n := len(currentState.Results); st.MergeSameTimeResults && n > 0 && currentState.Results[n-1].EvaluationTime.Equal(result.EvaluatedAt) {
+		currentState.Results[n-1] = currentState.Results[n-1].merge(evaluation)
+		result.State = currentState.Results[n-1].EvaluationState
+	} else {
+		currentState.Results = append(currentState.Results, evaluation)
+	}
+	currentState.recordClear(result.State, result.EvaluatedAt)
+	currentState.TrimResults(alertRule, st.ResultArchiver)
 	oldState := currentState.State
+	wasActive := currentState.IsActive()
+	oldStartsAt := currentState.StartsAt
+	oldError := currentState.Error
 
 	st.log.Debug("setting alert state", "uid", alertRule.UID)
-	switch result.State {
-	case eval.Normal:
+	switch {
+	case st.frozen(alertRule, result.EvaluatedAt):
+		st.log.Debug("state is frozen during a datasource outage", "uid", alertRule.UID)
+		currentState.resultFrozen(alertRule, result)
+	case result.State == eval.Normal && st.holdStartupResolve(currentState, result):
+		st.log.Debug("holding resolve of restored state until it is confirmed", "uid", alertRule.UID, "instance", result.Instance)
+		currentState.resultFrozen(alertRule, result)
+	case result.State == eval.Normal:
 		currentState.resultNormal(alertRule, result)
-	case eval.Alerting:
+	case result.State == eval.Alerting:
 		currentState.resultAlerting(alertRule, result)
-	case eval.Error:
+		if st.SkipFirstFire && len(currentState.Results) == 1 && oldState != eval.Alerting && currentState.State == eval.Alerting {
+			// The state fires on the next evaluation if the condition persists.
+			currentState.State = eval.Pending
+		}
+	case result.State == eval.Error:
 		currentState.resultError(alertRule, result)
-	case eval.NoData:
+	case result.State == eval.NoData:
 		currentState.resultNoData(alertRule, result)
-	case eval.Pending: // we do not emit results with this state
+	case result.State == eval.Pending: // we do not emit results with this state
 	}
 
+	if st.MaxResolveTimeout > 0 {
+		currentState.capEndsAt(result.EvaluatedAt.Add(st.MaxResolveTimeout))
+	}
+	if st.MinResolveTimeout > 0 && currentState.IsActive() {
+		currentState.clampEndsAt(st.Clock.Now().Add(st.MinResolveTimeout))
+	}
+
+	if !currentState.AcknowledgedAt.IsZero() && (currentState.State == eval.Normal || !currentState.acknowledged(st.AckTTL)) {
+		// Acknowledgements apply to a firing alert until it resolves or they expire.
+		currentState.AcknowledgedAt = time.Time{}
+	}
+
+	if st.PreservePrePendingStartsAt {
+		switch {
+		case oldState == eval.Normal && currentState.State == eval.Pending && len(currentState.Results) > 1:
+			currentState.PrePendingStartsAt = oldStartsAt
+		case currentState.State != eval.Pending:
+			currentState.PrePendingStartsAt = time.Time{}
+		}
+	}
+
+	if len(alertRule.EscalationBands) > 0 {
+		currentState.escalate(alertRule)
+	}
+
+	if st.RetainLastError {
+		currentState.retainLastError(oldState, oldError)
+	}
+
+	if st.TransitionBufferSize > 0 && oldState != currentState.State {
+		currentState.recordTransition(TransitionPoint{Time: result.EvaluatedAt, State: currentState.State}, st.TransitionBufferSize)
+	}
+
+	currentState.recordAnnotations(st.AnnotationHistory)
+
 	// Set Resolved property so the scheduler knows to send a postable alert
-	// to Alertmanager.
-	currentState.Resolved = oldState == eval.Alerting && currentState.State == eval.Normal
+	// to Alertmanager. Any active state was sent, so it is resolved as in resolve.
+	resolved := wasActive && currentState.State == eval.Normal
+	// A resolve that is held back to coalesce it with later flaps is kept until it is sent.
+	coalescing := st.ResolveCoalesceWindow > 0 && oldState == eval.Normal && currentState.State == eval.Normal &&
+		currentState.Resolved && currentState.LastSentAt.Before(currentState.StartsAt)
+	currentState.Resolved = resolved || coalescing
 
 	st.set(currentState)
 	if oldState != currentState.State {
 		go st.createAlertAnnotation(ctx, currentState.State, alertRule, result, oldState)
 	}
+	if st.TransitionObserver != nil && st.EmissionMode.shouldEmit(oldState, currentState) {
+		st.TransitionObserver(alertRule, oldState, currentState)
+	}
+	if st.EventObserver != nil {
+		for _, event := range stateEvents(alertRule, oldState, currentState) {
+			st.EventObserver(event, alertRule, oldState, currentState)
+		}
+	}
 	return currentState
 }
 
@@ -216,12 +557,57 @@ func (st *Manager) recordMetrics() {
 	}
 }
 
+// Acknowledge acknowledges a state at the given time, so it is not re-sent while it
+// keeps firing.
+func (st *Manager) Acknowledge(orgID int64, alertRuleUID, stateID string, at time.Time) error {
+	s, err := st.cache.get(orgID, alertRuleUID, stateID)
+	if err != nil {
+		return err
+	}
+	s.Acknowledge(at)
+	return nil
+}
+
+// PauseRule marks the states of a rule that is paused at the given time as paused,
+// according to PausePolicy, and returns them so that resolved states can be sent.
+func (st *Manager) PauseRule(orgID int64, alertRuleUID string, at time.Time) []*State {
+	states := st.GetStatesForRuleUID(orgID, alertRuleUID)
+	for _, s := range states {
+		s.Pause(st.PausePolicy, at)
+		st.set(s)
+	}
+	return states
+}
+
 func (st *Manager) Put(states []*State) {
 	for _, s := range states {
 		st.set(s)
 	}
 }
 
+// ImportStates adds states of the rule that were created outside of the manager, such
+// as those of migrated rules, to the cache. The Results of the states are normalized
+// before they are processed with live evaluations.
+func (st *Manager) ImportStates(alertRule *ngModels.AlertRule, states []*State) {
+	for _, s := range states {
+		s.OrgID = alertRule.OrgID
+		s.AlertRuleUID = alertRule.UID
+		if s.CacheId == "" {
+			il := ngModels.InstanceLabels(s.Labels)
+			cacheId, err := il.StringKey()
+			if err != nil {
+				st.log.Error("error getting cacheId for imported state, ignoring", "uid", alertRule.UID, "msg", err.Error())
+				continue
+			}
+			s.CacheId = cacheId
+		}
+		if dropped := s.normalizeResults(alertRule, st.ResultArchiver); dropped > 0 {
+			st.log.Warn("dropped invalid results of imported state", "uid", alertRule.UID, "cacheId", s.CacheId, "dropped", dropped)
+		}
+		st.set(s)
+	}
+}
+
 func translateInstanceState(state ngModels.InstanceStateType) eval.State {
 	switch {
 	case state == ngModels.InstanceStateFiring:
@@ -279,12 +665,21 @@ func (st *Manager) createAlertAnnotation(ctx context.Context, new eval.State, al
 	}
 }
 
-func (st *Manager) staleResultsHandler(alertRule *ngModels.AlertRule, states map[string]*State) {
+// staleResultsHandler removes the states of the rule that are stale because they are not
+// in the processed states, and returns the active states among them resolved if
+// ResolveOrphanedStates is enabled.
+func (st *Manager) staleResultsHandler(alertRule *ngModels.AlertRule, states map[string]*State) []*State {
+	var resolved []*State
+	now := st.Clock.Now()
 	allStates := st.GetStatesForRuleUID(alertRule.OrgID, alertRule.UID)
 	for _, s := range allStates {
 		_, ok := states[s.CacheId]
-		if !ok && isItStale(s.LastEvaluationTime, alertRule.IntervalSeconds) {
+		if !ok && isItStale(s.LastEvaluationTime, alertRule.IntervalSeconds, now) {
 			st.log.Debug("removing stale state entry", "orgID", s.OrgID, "alertRuleUID", s.AlertRuleUID, "cacheID", s.CacheId)
+			if st.ResolveOrphanedStates && s.IsActive() {
+				s.resolve(now)
+				resolved = append(resolved, s)
+			}
 			st.cache.deleteEntry(s.OrgID, s.AlertRuleUID, s.CacheId)
 			ilbs := ngModels.InstanceLabels(s.Labels)
 			_, labelsHash, err := ilbs.StringAndHash()
@@ -297,8 +692,49 @@ func (st *Manager) staleResultsHandler(alertRule *ngModels.AlertRule, states map
 			}
 		}
 	}
+	return resolved
+}
+
+// frozen returns true if the states of the rule are frozen by a datasource outage at time t.
+func (st *Manager) frozen(alertRule *ngModels.AlertRule, t time.Time) bool {
+	for _, o := range st.DatasourceOutages {
+		if o.Freezes(alertRule, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// holdStartupResolve returns true if the result would resolve a state restored at
+// startup within StartupResolveGrace, and the evaluation before it did not already
+// confirm the resolve. The result is already the latest evaluation in Results.
+func (st *Manager) holdStartupResolve(s *State, result eval.Result) bool {
+	if st.StartupResolveGrace <= 0 || !s.restored || s.State != eval.Alerting {
+		return false
+	}
+	if result.EvaluatedAt.After(st.warmedAt.Add(st.StartupResolveGrace)) {
+		return false
+	}
+	n := len(s.Results)
+	return n < 2 || s.Results[n-2].EvaluationState != eval.Normal
+}
+
+// resolveMissingSeries resolves the active states of the rule that are not in the
+// processed states, and returns them.
+func (st *Manager) resolveMissingSeries(alertRule *ngModels.AlertRule, processed map[string]*State, evaluatedAt time.Time) []*State {
+	var resolved []*State
+	for _, s := range st.GetStatesForRuleUID(alertRule.OrgID, alertRule.UID) {
+		if _, ok := processed[s.CacheId]; ok || !s.IsActive() {
+			continue
+		}
+		st.log.Debug("resolving missing series", "orgID", s.OrgID, "alertRuleUID", s.AlertRuleUID, "cacheID", s.CacheId)
+		s.resolve(evaluatedAt)
+		st.set(s)
+		resolved = append(resolved, s)
+	}
+	return resolved
 }
 
-func isItStale(lastEval time.Time, intervalSeconds int64) bool {
-	return lastEval.Add(2 * time.Duration(intervalSeconds) * time.Second).Before(time.Now())
+func isItStale(lastEval time.Time, intervalSeconds int64, now time.Time) bool {
+	return lastEval.Add(2 * time.Duration(intervalSeconds) * time.Second).Before(now)
 }
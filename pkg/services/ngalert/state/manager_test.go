@@ -4,9 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
+
 	"github.com/grafana/grafana/pkg/services/annotations"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
@@ -83,6 +86,7 @@ func TestProcessEvalResults(t *testing.T) {
 						},
 					},
 					LastEvaluationTime: evaluationTime,
+					ClearSince:         evaluationTime,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -137,6 +141,7 @@ func TestProcessEvalResults(t *testing.T) {
 						},
 					},
 					LastEvaluationTime: evaluationTime,
+					ClearSince:         evaluationTime,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -222,6 +227,7 @@ func TestProcessEvalResults(t *testing.T) {
 						},
 					},
 					LastEvaluationTime: evaluationTime.Add(1 * time.Minute),
+					ClearSince:         evaluationTime,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -362,6 +368,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime.Add(80 * time.Second),
 					EndsAt:             evaluationTime.Add(80 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(80 * time.Second),
+					For:                1 * time.Minute,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -461,6 +468,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime.Add(30 * time.Second),
 					EndsAt:             evaluationTime.Add(30 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(40 * time.Second),
+					For:                20 * time.Second,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -552,6 +560,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime,
 					EndsAt:             evaluationTime.Add(30 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(30 * time.Second),
+					For:                20 * time.Second,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -616,6 +625,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime.Add(10 * time.Second),
 					EndsAt:             evaluationTime.Add(10 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(10 * time.Second),
+					For:                1 * time.Minute,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -680,6 +690,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime,
 					EndsAt:             evaluationTime.Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(10 * time.Second),
+					For:                1 * time.Minute,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -997,6 +1008,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           time.Time{},
 					EndsAt:             time.Time{},
 					LastEvaluationTime: evaluationTime.Add(20 * time.Second),
+					ClearSince:         evaluationTime.Add(20 * time.Second),
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -1125,6 +1137,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime.Add(10 * time.Second),
 					EndsAt:             evaluationTime.Add(10 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(10 * time.Second),
+					For:                1 * time.Minute,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -1184,12 +1197,14 @@ func TestProcessEvalResults(t *testing.T) {
 						{
 							EvaluationTime:  evaluationTime.Add(10 * time.Second),
 							EvaluationState: eval.Error,
+							ErrorReason:     state.ErrorReasonOther,
 							Values:          make(map[string]*float64),
 						},
 					},
 					StartsAt:           evaluationTime.Add(10 * time.Second),
 					EndsAt:             evaluationTime.Add(10 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(10 * time.Second),
+					For:                1 * time.Minute,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -1259,16 +1274,22 @@ func TestProcessEvalResults(t *testing.T) {
 							EvaluationTime:  evaluationTime,
 							EvaluationState: eval.Normal,
 							Values:          make(map[string]*float64),
+							QueriedFrom:     evaluationTime,
+							QueriedTo:       evaluationTime,
 						},
 						{
 							EvaluationTime:  evaluationTime.Add(10 * time.Second),
 							EvaluationState: eval.Error,
+							ErrorReason:     state.ErrorReasonQuery,
 							Values:          make(map[string]*float64),
+							QueriedFrom:     evaluationTime.Add(10 * time.Second),
+							QueriedTo:       evaluationTime.Add(10 * time.Second),
 						},
 					},
 					StartsAt:           evaluationTime.Add(10 * time.Second),
 					EndsAt:             evaluationTime.Add(10 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(10 * time.Second),
+					For:                1 * time.Minute,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test", "Error": "failed to execute query A: this is an error"},
 				},
@@ -1349,6 +1370,7 @@ func TestProcessEvalResults(t *testing.T) {
 						{
 							EvaluationTime:  evaluationTime.Add(40 * time.Second),
 							EvaluationState: eval.Error,
+							ErrorReason:     state.ErrorReasonOther,
 							Values:          make(map[string]*float64),
 						},
 						{
@@ -1360,6 +1382,7 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime.Add(70 * time.Second),
 					EndsAt:             evaluationTime.Add(70 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(70 * time.Second),
+					For:                30 * time.Second,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
@@ -1441,6 +1464,7 @@ func TestProcessEvalResults(t *testing.T) {
 						{
 							EvaluationTime:  evaluationTime.Add(40 * time.Second),
 							EvaluationState: eval.Error,
+							ErrorReason:     state.ErrorReasonOther,
 							Values:          make(map[string]*float64),
 						},
 						{
@@ -1452,11 +1476,111 @@ func TestProcessEvalResults(t *testing.T) {
 					StartsAt:           evaluationTime.Add(30 * time.Second),
 					EndsAt:             evaluationTime.Add(50 * time.Second).Add(state.ResendDelay * 3),
 					LastEvaluationTime: evaluationTime.Add(50 * time.Second),
+					For:                30 * time.Second,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"annotation": "test"},
 				},
 			},
 		},
+		{
+			desc: "normal -> nodata -> error - it should keep the time data stopped",
+			alertRule: &models.AlertRule{
+				OrgID:        1,
+				Title:        "test_title",
+				UID:          "test_alert_rule_uid_2",
+				NamespaceUID: "test_namespace_uid",
+				Data: []models.AlertQuery{{
+					RefID:         "A",
+					DatasourceUID: "datasource_uid_1",
+				}},
+				Annotations:     map[string]string{"annotation": "test"},
+				Labels:          map[string]string{"label": "test"},
+				IntervalSeconds: 10,
+				NoDataState:     models.NoData,
+				ExecErrState:    models.ErrorErrState,
+			},
+			evalResults: []eval.Results{
+				{
+					eval.Result{
+						Instance:           data.Labels{"instance_label": "test"},
+						State:              eval.Normal,
+						EvaluatedAt:        evaluationTime,
+						EvaluationDuration: evaluationDuration,
+					},
+				},
+				{
+					eval.Result{
+						Instance:           data.Labels{"instance_label": "test"},
+						State:              eval.NoData,
+						EvaluatedAt:        evaluationTime.Add(10 * time.Second),
+						EvaluationDuration: evaluationDuration,
+					},
+				},
+				{
+					eval.Result{
+						Instance: data.Labels{"instance_label": "test"},
+						Error: expr.QueryError{
+							RefID: "A",
+							Err:   errors.New("this is an error"),
+						},
+						State:              eval.Error,
+						EvaluatedAt:        evaluationTime.Add(20 * time.Second),
+						EvaluationDuration: evaluationDuration,
+					},
+				},
+			},
+			expectedAnnotations: 2,
+			expectedStates: map[string]*state.State{
+				`[["__alert_rule_namespace_uid__","test_namespace_uid"],["__alert_rule_uid__","test_alert_rule_uid_2"],["alertname","test_title"],["instance_label","test"],["label","test"]]`: {
+					AlertRuleUID: "test_alert_rule_uid_2",
+					OrgID:        1,
+					CacheId:      `[["__alert_rule_namespace_uid__","test_namespace_uid"],["__alert_rule_uid__","test_alert_rule_uid_2"],["alertname","test_title"],["instance_label","test"],["label","test"]]`,
+					Labels: data.Labels{
+						"__alert_rule_namespace_uid__": "test_namespace_uid",
+						"__alert_rule_uid__":           "test_alert_rule_uid_2",
+						"alertname":                    "test_title",
+						"label":                        "test",
+						"instance_label":               "test",
+						"datasource_uid":               "datasource_uid_1",
+						"ref_id":                       "A",
+					},
+					State: eval.Error,
+					Error: expr.QueryError{
+						RefID: "A",
+						Err:   errors.New("this is an error"),
+					},
+					Results: []state.Evaluation{
+						{
+							EvaluationTime:  evaluationTime,
+							EvaluationState: eval.Normal,
+							Values:          make(map[string]*float64),
+							QueriedFrom:     evaluationTime,
+							QueriedTo:       evaluationTime,
+						},
+						{
+							EvaluationTime:  evaluationTime.Add(10 * time.Second),
+							EvaluationState: eval.NoData,
+							Values:          make(map[string]*float64),
+							QueriedFrom:     evaluationTime.Add(10 * time.Second),
+							QueriedTo:       evaluationTime.Add(10 * time.Second),
+						},
+						{
+							EvaluationTime:  evaluationTime.Add(20 * time.Second),
+							EvaluationState: eval.Error,
+							ErrorReason:     state.ErrorReasonQuery,
+							Values:          make(map[string]*float64),
+							QueriedFrom:     evaluationTime.Add(20 * time.Second),
+							QueriedTo:       evaluationTime.Add(20 * time.Second),
+						},
+					},
+					StartsAt:           evaluationTime.Add(10 * time.Second),
+					EndsAt:             evaluationTime.Add(20 * time.Second).Add(state.ResendDelay * 3),
+					LastEvaluationTime: evaluationTime.Add(20 * time.Second),
+					EvaluationDuration: evaluationDuration,
+					Annotations:        map[string]string{"annotation": "test", "Error": "failed to execute query A: this is an error"},
+				},
+			},
+		},
 		{
 			desc: "template is correctly expanded",
 			alertRule: &models.AlertRule{
@@ -1502,6 +1626,7 @@ func TestProcessEvalResults(t *testing.T) {
 						},
 					},
 					LastEvaluationTime: evaluationTime,
+					ClearSince:         evaluationTime,
 					EvaluationDuration: evaluationDuration,
 					Annotations:        map[string]string{"summary": "grafana is down in us-central-1 cluster -> prod namespace"},
 				},
@@ -1525,6 +1650,8 @@ func TestProcessEvalResults(t *testing.T) {
 			for _, s := range tc.expectedStates {
 				cachedState, err := st.Get(s.OrgID, s.AlertRuleUID, s.CacheId)
 				require.NoError(t, err)
+				// The expected state is set with SetLabels to have the same fingerprint.
+				s.SetLabels(s.Labels)
 				assert.Equal(t, s, cachedState)
 			}
 
@@ -1604,9 +1731,13 @@ func TestStaleResultsHandler(t *testing.T) {
 							EvaluationTime:  evaluationTime.Add(3 * time.Minute),
 							EvaluationState: eval.Normal,
 							Values:          make(map[string]*float64),
+							QueriedFrom:     evaluationTime.Add(3 * time.Minute).Add(-5 * time.Hour),
+							QueriedTo:       evaluationTime.Add(3 * time.Minute).Add(-3 * time.Hour),
 						},
 					},
 					LastEvaluationTime: evaluationTime.Add(3 * time.Minute),
+					ClearSince:         evaluationTime.Add(3 * time.Minute),
+					Condition:          "A",
 					EvaluationDuration: 0,
 					Annotations:        map[string]string{"testAnnoKey": "testAnnoValue"},
 				},
@@ -1628,6 +1759,8 @@ func TestStaleResultsHandler(t *testing.T) {
 			for _, s := range tc.expectedStates {
 				cachedState, err := st.Get(s.OrgID, s.AlertRuleUID, s.CacheId)
 				require.NoError(t, err)
+				// The expected state is set with SetLabels to have the same fingerprint.
+				s.SetLabels(s.Labels)
 				assert.Equal(t, s, cachedState)
 			}
 		}
@@ -1637,3 +1770,2109 @@ func TestStaleResultsHandler(t *testing.T) {
 		assert.Equal(t, tc.finalStateCount, len(existingStatesForRule))
 	}
 }
+
+func TestWarm_AnnotationsAreNotShared(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	_, dbstore := tests.SetupTestEnv(t, 1)
+	rule := tests.CreateTestAlertRule(t, dbstore, 600, 1)
+	rule.ExecErrState = models.ErrorErrState
+
+	instanceLabels := func(instance string) models.InstanceLabels {
+		return models.InstanceLabels{
+			models.NamespaceUIDLabel: rule.NamespaceUID,
+			models.RuleUIDLabel:      rule.UID,
+			"alertname":              rule.Title,
+			"instance":               instance,
+		}
+	}
+	for _, instance := range []string{"a", "b"} {
+		require.NoError(t, dbstore.SaveAlertInstance(&models.SaveAlertInstanceCommand{
+			RuleOrgID:         rule.OrgID,
+			RuleUID:           rule.UID,
+			Labels:            instanceLabels(instance),
+			State:             models.InstanceStateNormal,
+			LastEvalTime:      evaluationTime,
+			CurrentStateSince: evaluationTime,
+		}))
+	}
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_warm_annotations"), testMetrics.GetStateMetrics(), nil, dbstore, dbstore)
+	st.Warm()
+	require.Len(t, st.GetStatesForRuleUID(rule.OrgID, rule.UID), 2)
+
+	next := evaluationTime.Add(10 * time.Minute)
+	states := st.ProcessEvalResults(context.Background(), rule, eval.Results{
+		{Instance: data.Labels{"instance": "b"}, State: eval.Normal, EvaluatedAt: next},
+		{
+			Instance:    data.Labels{"instance": "a"},
+			State:       eval.Error,
+			Error:       expr.QueryError{RefID: "A", Err: errors.New("boom")},
+			EvaluatedAt: next,
+		},
+	})
+	require.Len(t, states, 2)
+	// The results updated the warmed states.
+	require.Len(t, st.GetStatesForRuleUID(rule.OrgID, rule.UID), 2)
+	for _, s := range states {
+		switch s.Labels["instance"] {
+		case "a":
+			assert.Equal(t, "failed to execute query A: boom", s.Annotations["Error"])
+		case "b":
+			// The annotation written to the errored state does not leak into its siblings.
+			assert.Equal(t, map[string]string{"testAnnoKey": "testAnnoValue"}, s.Annotations)
+		}
+	}
+	assert.Equal(t, map[string]string{"testAnnoKey": "testAnnoValue"}, rule.Annotations)
+}
+
+func TestResendDelayFor(t *testing.T) {
+	st := state.NewManager(log.New("test_resend_delay_for"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	labels := data.Labels{"severity": "low"}
+
+	// Without a resolver the default resend delay is used.
+	assert.Equal(t, state.ResendDelay, st.ResendDelayFor(labels))
+
+	st.ResendDelayResolver = func(labels data.Labels) time.Duration {
+		if labels["severity"] == "low" {
+			return 10 * time.Minute
+		}
+		if labels["severity"] == "critical" {
+			return time.Minute
+		}
+		return 0
+	}
+	assert.Equal(t, 10*time.Minute, st.ResendDelayFor(labels))
+	assert.Equal(t, time.Minute, st.ResendDelayFor(data.Labels{"severity": "critical"}))
+	// The default resend delay is used if the resolver returns no delay.
+	assert.Equal(t, state.ResendDelay, st.ResendDelayFor(data.Labels{}))
+}
+
+func TestProcessEvalResults_ExecErrStateChanged(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_exec_err_state_changed"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		ExecErrState:    models.ErrorErrState,
+	}
+	result := eval.Result{
+		Instance:    data.Labels{"instance_label": "test"},
+		State:       eval.Error,
+		Error:       errors.New("test error"),
+		EvaluatedAt: evaluationTime,
+	}
+
+	states := st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+	require.Len(t, states, 1)
+	require.Equal(t, eval.Error, states[0].State)
+
+	// The rule is changed to treat errors as OK while the alert is in Error.
+	rule.ExecErrState = models.OkErrState
+	result.EvaluatedAt = evaluationTime.Add(10 * time.Second)
+	states = st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+	require.Len(t, states, 1)
+	assert.Equal(t, eval.Normal, states[0].State)
+	assert.Equal(t, result.EvaluatedAt, states[0].StartsAt)
+	assert.Equal(t, result.EvaluatedAt, states[0].EndsAt)
+	// The alert was sent as active while in Error, so it is resolved.
+	assert.True(t, states[0].Resolved)
+	assert.True(t, states[0].NeedsSending(st.SendPolicy()))
+}
+
+func TestProcessEvalResults_SkipFirstFire(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_skip_first_fire"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.SkipFirstFire = true
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+	result := eval.Result{
+		Instance:    data.Labels{"instance_label": "test"},
+		State:       eval.Alerting,
+		EvaluatedAt: evaluationTime,
+	}
+
+	for i := 0; i < 2; i++ {
+		// The first result after the state is created is withheld
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+		require.Len(t, states, 1)
+		assert.Equal(t, eval.Pending, states[0].State)
+
+		// and the second result is honored.
+		result.EvaluatedAt = result.EvaluatedAt.Add(10 * time.Second)
+		states = st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+		require.Len(t, states, 1)
+		assert.Equal(t, eval.Alerting, states[0].State)
+
+		// The same applies after the cache is reset.
+		st.ResetCache()
+		result.EvaluatedAt = result.EvaluatedAt.Add(10 * time.Second)
+	}
+}
+
+func TestProcessEvalResults_OrgTimezone(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+	loc, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_org_timezone"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.OrgTimezone = func(orgID int64) *time.Location {
+		if orgID == 2 {
+			return loc
+		}
+		return nil
+	}
+
+	for orgID, expected := range map[int64]string{
+		1: "2021-03-25 00:00:00 +0000 UTC",
+		2: "2021-03-25 01:00:00 +0100 CET",
+	} {
+		rule := &models.AlertRule{
+			OrgID:           orgID,
+			Title:           "test_title",
+			UID:             "test_alert_rule_uid",
+			NamespaceUID:    "test_namespace_uid",
+			IntervalSeconds: 10,
+			Annotations:     map[string]string{"since": `{{ "1616630400" | humanizeTimestamp }}`},
+		}
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       eval.Normal,
+			EvaluatedAt: evaluationTime,
+		}})
+		require.Len(t, states, 1)
+		assert.Equal(t, expected, states[0].Annotations["since"])
+	}
+}
+
+func TestProcessEvalResults_MinResolveTimeout(t *testing.T) {
+	now := time.Date(2021, 3, 25, 12, 0, 0, 0, time.UTC)
+	mockClock := clock.NewMock()
+	mockClock.Set(now)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+
+	testCases := []struct {
+		desc              string
+		minResolveTimeout time.Duration
+		evaluatedAt       time.Time
+		expectedEndsAt    time.Time
+	}{
+		{
+			desc:              "stale result is clamped",
+			minResolveTimeout: 5 * time.Minute,
+			evaluatedAt:       now.Add(-time.Hour),
+			expectedEndsAt:    now.Add(5 * time.Minute),
+		},
+		{
+			desc:              "recent result is not clamped",
+			minResolveTimeout: 5 * time.Second,
+			evaluatedAt:       now,
+			expectedEndsAt:    now.Add(state.ResendDelay * 3),
+		},
+		{
+			desc:              "stale result is not clamped when disabled",
+			minResolveTimeout: 0,
+			evaluatedAt:       now.Add(-time.Hour),
+			expectedEndsAt:    now.Add(-time.Hour).Add(state.ResendDelay * 3),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_min_resolve_timeout"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.Clock = mockClock
+			st.MinResolveTimeout = tc.minResolveTimeout
+
+			states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+				Instance:    data.Labels{"instance_label": "test"},
+				State:       eval.Alerting,
+				EvaluatedAt: tc.evaluatedAt,
+			}})
+			require.Len(t, states, 1)
+			assert.Equal(t, eval.Alerting, states[0].State)
+			assert.Equal(t, tc.expectedEndsAt, states[0].EndsAt)
+		})
+	}
+}
+
+func TestProcessEvalResults_RejectDuplicateRefIDs(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		ExecErrState:    models.ErrorErrState,
+	}
+	result := eval.Result{
+		Instance:    data.Labels{"instance_label": "test"},
+		State:       eval.Alerting,
+		EvaluatedAt: evaluationTime,
+		Values: map[string]eval.NumberValueCapture{
+			"A":   {Var: "A", Value: ptrFloat64(1)},
+			"A_1": {Var: "A", Value: ptrFloat64(2)},
+		},
+	}
+
+	testCases := []struct {
+		desc           string
+		reject         bool
+		expectedState  eval.State
+		expectedValues map[string]*float64
+	}{
+		{
+			desc:           "duplicates are recorded under disambiguated keys",
+			reject:         false,
+			expectedState:  eval.Alerting,
+			expectedValues: map[string]*float64{"A": ptrFloat64(1), "A_1": ptrFloat64(2)},
+		},
+		{
+			desc:           "duplicates are rejected as an error",
+			reject:         true,
+			expectedState:  eval.Error,
+			expectedValues: map[string]*float64{"A": ptrFloat64(1), "A_1": ptrFloat64(2)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_duplicate_ref_ids"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.RejectDuplicateRefIDs = tc.reject
+
+			states := st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+			require.Len(t, states, 1)
+			assert.Equal(t, tc.expectedState, states[0].State)
+			assert.Equal(t, tc.expectedValues, states[0].Results[0].Values)
+			if tc.reject {
+				assert.ErrorIs(t, states[0].Error, state.ErrDuplicateRefID)
+			} else {
+				assert.NoError(t, states[0].Error)
+			}
+		})
+	}
+}
+
+func ptrFloat64(f float64) *float64 {
+	return &f
+}
+
+func TestProcessEvalResults_OutOfOrderResults(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+	labels := data.Labels{"instance_label": "test"}
+	resolve := eval.Result{Instance: labels, State: eval.Normal, EvaluatedAt: evaluationTime.Add(10 * time.Second)}
+	fire := eval.Result{Instance: labels, State: eval.Alerting, EvaluatedAt: evaluationTime.Add(20 * time.Second)}
+
+	testCases := []struct {
+		desc           string
+		arrivalOrder   bool
+		results        eval.Results
+		expectedResult eval.Result
+	}{
+		{
+			desc:           "resolve then fire",
+			results:        eval.Results{resolve, fire},
+			expectedResult: fire,
+		},
+		{
+			desc:           "fire then resolve",
+			results:        eval.Results{fire, resolve},
+			expectedResult: fire,
+		},
+		{
+			desc:           "resolve then fire in arrival order",
+			arrivalOrder:   true,
+			results:        eval.Results{resolve, fire},
+			expectedResult: fire,
+		},
+		{
+			desc:           "fire then resolve in arrival order",
+			arrivalOrder:   true,
+			results:        eval.Results{fire, resolve},
+			expectedResult: resolve,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_out_of_order_results"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.ProcessResultsInArrivalOrder = tc.arrivalOrder
+			st.ProcessEvalResults(context.Background(), rule, eval.Results{
+				{Instance: labels, State: eval.Alerting, EvaluatedAt: evaluationTime},
+			})
+
+			st.ProcessEvalResults(context.Background(), rule, tc.results)
+			states := st.GetStatesForRuleUID(rule.OrgID, rule.UID)
+			require.Len(t, states, 1)
+			// The latest result wins, or the last result to arrive in arrival order.
+			assert.Equal(t, tc.expectedResult.State, states[0].State)
+			assert.Equal(t, tc.expectedResult.State == eval.Normal, states[0].Resolved)
+			assert.Equal(t, tc.expectedResult.EvaluatedAt, states[0].LastEvaluationTime)
+		})
+	}
+}
+
+func TestProcessEvalResults_OutOfOrderResultsAcrossEvaluations(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		Annotations:     map[string]string{"summary": "{{ $values.A }}"},
+	}
+	labels := data.Labels{"instance_label": "test"}
+	result := func(s eval.State, evaluatedAt time.Time, v float64) eval.Results {
+		return eval.Results{{
+			Instance:    labels,
+			State:       s,
+			EvaluatedAt: evaluatedAt,
+			Values:      map[string]eval.NumberValueCapture{"A": {Var: "A", Value: ptrFloat64(v)}},
+		}}
+	}
+
+	testCases := []struct {
+		desc               string
+		outOfOrderResults  state.OutOfOrderResults
+		expectedState      eval.State
+		expectedSummary    string
+		expectedEvaluation []time.Time
+	}{
+		{
+			desc:              "processed as it arrives",
+			outOfOrderResults: state.OutOfOrderProcess,
+			expectedState:     eval.Normal,
+			expectedSummary:   "1",
+			expectedEvaluation: []time.Time{
+				evaluationTime,
+				evaluationTime.Add(20 * time.Second),
+				evaluationTime.Add(10 * time.Second),
+			},
+		},
+		{
+			desc:              "rejected",
+			outOfOrderResults: state.OutOfOrderReject,
+			expectedState:     eval.Alerting,
+			expectedSummary:   "2",
+			expectedEvaluation: []time.Time{
+				evaluationTime,
+				evaluationTime.Add(20 * time.Second),
+			},
+		},
+		{
+			desc:              "reordered",
+			outOfOrderResults: state.OutOfOrderReorder,
+			expectedState:     eval.Alerting,
+			expectedSummary:   "2",
+			expectedEvaluation: []time.Time{
+				evaluationTime,
+				evaluationTime.Add(10 * time.Second),
+				evaluationTime.Add(20 * time.Second),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_out_of_order_results"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.OutOfOrderResults = tc.outOfOrderResults
+			st.ProcessEvalResults(context.Background(), rule, result(eval.Alerting, evaluationTime, 3))
+			st.ProcessEvalResults(context.Background(), rule, result(eval.Alerting, evaluationTime.Add(20*time.Second), 2))
+
+			// A retry of the evaluation in between arrives late.
+			st.ProcessEvalResults(context.Background(), rule, result(eval.Normal, evaluationTime.Add(10*time.Second), 1))
+
+			states := st.GetStatesForRuleUID(rule.OrgID, rule.UID)
+			require.Len(t, states, 1)
+			assert.Equal(t, tc.expectedState, states[0].State)
+			assert.Equal(t, tc.expectedSummary, states[0].Annotations["summary"])
+			var evaluations []time.Time
+			for _, r := range states[0].Results {
+				evaluations = append(evaluations, r.EvaluationTime)
+			}
+			assert.Equal(t, tc.expectedEvaluation, evaluations)
+		})
+	}
+}
+
+func TestProcessEvalResults_AnnotationTemplateError(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_annotation_template_error"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		Annotations: map[string]string{
+			"summary":     "{{ $labels.instance_label }} is down",
+			"description": "{{ .Missing }}",
+		},
+	}
+
+	states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+		Instance:    data.Labels{"instance_label": "test"},
+		State:       eval.Normal,
+		EvaluatedAt: evaluationTime,
+	}})
+	require.Len(t, states, 1)
+	assert.Equal(t, "test is down", states[0].Annotations["summary"])
+	// The failing template is kept as is and the error is recorded.
+	assert.Equal(t, "{{ .Missing }}", states[0].Annotations["description"])
+	assert.Contains(t, states[0].Annotations[models.TemplateErrorAnnotation], "description: ")
+	assert.Contains(t, states[0].Annotations[models.TemplateErrorAnnotation], "Missing")
+}
+
+func TestImportStates(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	st := state.NewManager(log.New("test_import_states"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	rule := &models.AlertRule{
+		OrgID:           1,
+		UID:             "test_alert_rule_uid",
+		IntervalSeconds: 10,
+	}
+	imported := &state.State{
+		State:  eval.Alerting,
+		Labels: data.Labels{"instance_label": "test"},
+		Results: []state.Evaluation{
+			{EvaluationTime: evaluationTime.Add(20 * time.Second), EvaluationState: eval.Alerting},
+			{EvaluationTime: evaluationTime, EvaluationState: eval.Normal},
+			{EvaluationState: eval.Alerting},
+			{EvaluationTime: evaluationTime.Add(10 * time.Second), EvaluationState: eval.Pending},
+			{EvaluationTime: evaluationTime.Add(10 * time.Second), EvaluationState: eval.Normal},
+			{EvaluationTime: evaluationTime.Add(10 * time.Second), EvaluationState: eval.Alerting},
+		},
+	}
+
+	st.ImportStates(rule, []*state.State{imported})
+
+	states := st.GetStatesForRuleUID(rule.OrgID, rule.UID)
+	require.Len(t, states, 1)
+	assert.Equal(t, `[["instance_label","test"]]`, states[0].CacheId)
+	assert.Equal(t, evaluationTime.Add(20*time.Second), states[0].LastEvaluationTime)
+	assert.Equal(t, []state.Evaluation{
+		{EvaluationTime: evaluationTime, EvaluationState: eval.Normal},
+		{EvaluationTime: evaluationTime.Add(10 * time.Second), EvaluationState: eval.Alerting},
+		{EvaluationTime: evaluationTime.Add(20 * time.Second), EvaluationState: eval.Alerting},
+	}, states[0].Results)
+}
+
+func TestProcessEvalResults_ResolveCoalesceWindow(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+	// The alert flaps three times and then stays resolved.
+	flaps := []eval.State{
+		eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting,
+		eval.Normal, eval.Normal, eval.Normal, eval.Normal, eval.Normal,
+	}
+
+	testCases := []struct {
+		desc             string
+		window           time.Duration
+		expectedResolves []time.Duration
+	}{
+		{
+			desc:             "every resolve is sent without a coalesce window",
+			expectedResolves: []time.Duration{10 * time.Second, 30 * time.Second, 50 * time.Second},
+		},
+		{
+			desc:             "only the final resolve is sent with a coalesce window",
+			window:           30 * time.Second,
+			expectedResolves: []time.Duration{80 * time.Second},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_resolve_coalesce_window"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.ResendDelay = 0
+			st.ResolveCoalesceWindow = tc.window
+
+			var resolves []time.Duration
+			for i, s := range flaps {
+				evaluatedAt := evaluationTime.Add(time.Duration(i) * 10 * time.Second)
+				states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+					Instance:    data.Labels{"instance_label": "test"},
+					State:       s,
+					EvaluatedAt: evaluatedAt,
+				}})
+				require.Len(t, states, 1)
+				// Send the states like the scheduler.
+				if states[0].NeedsSending(st.SendPolicy()) {
+					if states[0].State == eval.Normal {
+						resolves = append(resolves, evaluatedAt.Sub(evaluationTime))
+					}
+					states[0].LastSentAt = evaluatedAt
+				}
+			}
+			assert.Equal(t, tc.expectedResolves, resolves)
+		})
+	}
+}
+
+func TestProcessEvalResults_TransitionObserver(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		// Errors keep the state Normal, but are not successful evaluations.
+		ExecErrState: models.OkErrState,
+	}
+	evaluations := []eval.State{eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Normal, eval.Error, eval.Normal}
+
+	type emission struct {
+		oldState eval.State
+		newState eval.State
+	}
+	testCases := []struct {
+		desc     string
+		mode     state.EmissionMode
+		expected []emission
+	}{
+		{
+			desc: "emits on change",
+			mode: state.EmitOnChange,
+			expected: []emission{
+				{eval.Normal, eval.Alerting},
+				{eval.Alerting, eval.Normal},
+			},
+		},
+		{
+			desc: "emits on every evaluation",
+			mode: state.EmitOnEvaluation,
+			expected: []emission{
+				{eval.Normal, eval.Normal},
+				{eval.Normal, eval.Normal},
+				{eval.Normal, eval.Alerting},
+				{eval.Alerting, eval.Alerting},
+				{eval.Alerting, eval.Normal},
+				{eval.Normal, eval.Normal},
+				{eval.Normal, eval.Normal},
+			},
+		},
+		{
+			desc: "emits heartbeats on successful normal evaluations",
+			mode: state.EmitHeartbeat,
+			expected: []emission{
+				{eval.Normal, eval.Normal},
+				{eval.Normal, eval.Normal},
+				{eval.Normal, eval.Alerting},
+				{eval.Alerting, eval.Normal},
+				{eval.Normal, eval.Normal},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_transition_observer"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.EmissionMode = tc.mode
+			var emissions []emission
+			st.TransitionObserver = func(_ *models.AlertRule, oldState eval.State, s *state.State) {
+				emissions = append(emissions, emission{oldState, s.State})
+			}
+
+			for i, s := range evaluations {
+				st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+					Instance:    data.Labels{"instance_label": "test"},
+					State:       s,
+					EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				}})
+			}
+			assert.Equal(t, tc.expected, emissions)
+		})
+	}
+}
+
+func TestProcessEvalResults_EventNoLongerNoData(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		NoDataState:     models.NoData,
+		ExecErrState:    models.OkErrState,
+	}
+
+	type event struct {
+		event    state.Event
+		oldState eval.State
+	}
+	testCases := []struct {
+		desc        string
+		evaluations []eval.State
+		expected    []event
+	}{
+		{
+			desc:        "NoData to Normal emits the event",
+			evaluations: []eval.State{eval.Normal, eval.NoData, eval.NoData, eval.Normal, eval.Normal},
+			expected:    []event{{state.EventNoLongerNoData, eval.NoData}},
+		},
+		{
+			desc:        "Alerting to Normal does not emit the event",
+			evaluations: []eval.State{eval.Alerting, eval.Normal},
+		},
+		{
+			desc:        "NoData to Normal because of an error does not emit the event",
+			evaluations: []eval.State{eval.NoData, eval.Error},
+		},
+		{
+			desc:        "NoData to Alerting does not emit the event",
+			evaluations: []eval.State{eval.NoData, eval.Alerting},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_event_observer"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			var events []event
+			st.EventObserver = func(e state.Event, _ *models.AlertRule, oldState eval.State, s *state.State) {
+				require.Equal(t, eval.Normal, s.State)
+				events = append(events, event{e, oldState})
+			}
+
+			for i, s := range tc.evaluations {
+				st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+					Instance:    data.Labels{"instance_label": "test"},
+					State:       s,
+					EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+				}})
+			}
+			assert.Equal(t, tc.expected, events)
+		})
+	}
+}
+
+func TestProcessEvalResults_EventThresholdProximity(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		For:             time.Minute,
+		Threshold:       &models.Threshold{RefID: "A", Value: 100},
+		ProximityMargin: 0.1,
+	}
+	evaluations := []struct {
+		state eval.State
+		value float64
+	}{
+		{eval.Normal, 50},
+		{eval.Normal, 92},
+		{eval.Normal, 95},
+		{eval.Normal, 80},
+		{eval.Normal, 91},
+		{eval.Alerting, 120},
+		{eval.Normal, 99},
+	}
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_event_observer"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	var warned []float64
+	st.EventObserver = func(e state.Event, _ *models.AlertRule, _ eval.State, s *state.State) {
+		require.Equal(t, state.EventThresholdProximity, e)
+		warned = append(warned, *s.Results[len(s.Results)-1].Values["A"])
+	}
+
+	for i, e := range evaluations {
+		st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       e.state,
+			EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+			Values:      map[string]eval.NumberValueCapture{"A": {Var: "A", Value: ptrFloat64(e.value)}},
+		}})
+	}
+	// The value approaching the threshold warns once each time it enters the margin, but
+	// not while the alert is Pending.
+	assert.Equal(t, []float64{92, 91, 99}, warned)
+}
+
+func TestProcessEvalResults_EscalationBands(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		EscalationBands: []models.EscalationBand{
+			{Severity: "warning"},
+			{Severity: "critical", After: 30 * time.Second},
+			{Severity: "critical", RefID: "A", MinValue: ptrFloat64(100)},
+		},
+	}
+
+	type evaluation struct {
+		state    eval.State
+		value    float64
+		expected string
+	}
+	testCases := []struct {
+		desc        string
+		evaluations []evaluation
+	}{
+		{
+			desc: "escalates over time",
+			evaluations: []evaluation{
+				{state: eval.Normal, value: 1, expected: ""},
+				{state: eval.Alerting, value: 10, expected: "warning"},
+				{state: eval.Alerting, value: 10, expected: "warning"},
+				{state: eval.Alerting, value: 10, expected: "warning"},
+				{state: eval.Alerting, value: 10, expected: "critical"},
+				{state: eval.Normal, value: 1, expected: ""},
+			},
+		},
+		{
+			desc: "escalates by value",
+			evaluations: []evaluation{
+				{state: eval.Alerting, value: 10, expected: "warning"},
+				{state: eval.Alerting, value: 150, expected: "critical"},
+				{state: eval.Alerting, value: 10, expected: "warning"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_escalation_bands"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+
+			for i, e := range tc.evaluations {
+				states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+					Instance:    data.Labels{"instance_label": "test"},
+					State:       e.state,
+					EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+					Values:      map[string]eval.NumberValueCapture{"A": {Var: "A", Value: ptrFloat64(e.value)}},
+				}})
+				require.Len(t, states, 1)
+				assert.Equal(t, e.expected, states[0].Labels[models.EscalationLabel], "evaluation %d", i)
+			}
+		})
+	}
+}
+
+func TestProcessEvalResults_MaxResolveTimeout(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc              string
+		intervalSeconds   int64
+		maxResolveTimeout time.Duration
+		expectedEndsAt    time.Time
+	}{
+		{
+			desc:              "huge interval is capped",
+			intervalSeconds:   int64((24 * time.Hour).Seconds()),
+			maxResolveTimeout: time.Hour,
+			expectedEndsAt:    evaluationTime.Add(time.Hour),
+		},
+		{
+			desc:              "short interval is not capped",
+			intervalSeconds:   10,
+			maxResolveTimeout: time.Hour,
+			expectedEndsAt:    evaluationTime.Add(state.ResendDelay * 3),
+		},
+		{
+			desc:              "huge interval is not capped when disabled",
+			intervalSeconds:   int64((24 * time.Hour).Seconds()),
+			maxResolveTimeout: 0,
+			expectedEndsAt:    evaluationTime.Add(72 * time.Hour),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_max_resolve_timeout"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.MaxResolveTimeout = tc.maxResolveTimeout
+			rule := &models.AlertRule{
+				OrgID:           1,
+				Title:           "test_title",
+				UID:             "test_alert_rule_uid",
+				NamespaceUID:    "test_namespace_uid",
+				IntervalSeconds: tc.intervalSeconds,
+			}
+
+			states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+				Instance:    data.Labels{"instance_label": "test"},
+				State:       eval.Alerting,
+				EvaluatedAt: evaluationTime,
+			}})
+			require.Len(t, states, 1)
+			assert.Equal(t, eval.Alerting, states[0].State)
+			assert.Equal(t, tc.expectedEndsAt, states[0].EndsAt)
+		})
+	}
+}
+
+func TestProcessEvalResults_NoDataAnnotations(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	results := eval.Results{
+		{State: eval.Alerting, EvaluationString: "A=5"},
+		{State: eval.NoData},
+		{State: eval.Alerting, EvaluationString: "A=7"},
+	}
+
+	testCases := []struct {
+		desc     string
+		policy   models.NoDataAnnotationsPolicy
+		expected []map[string]string
+	}{
+		{
+			desc:   "annotations are updated",
+			policy: models.NoDataAnnotationsUpdate,
+			expected: []map[string]string{
+				{"summary": "value A=5"},
+				{"summary": "value "},
+				{"summary": "value A=7"},
+			},
+		},
+		{
+			desc:   "annotations persist",
+			policy: models.NoDataAnnotationsPersist,
+			expected: []map[string]string{
+				{"summary": "value A=5"},
+				{"summary": "value A=5"},
+				{"summary": "value A=7"},
+			},
+		},
+		{
+			desc:   "annotations are cleared",
+			policy: models.NoDataAnnotationsClear,
+			expected: []map[string]string{
+				{"summary": "value A=5"},
+				{},
+				{"summary": "value A=7"},
+			},
+		},
+		{
+			desc:   "annotations are marked stale",
+			policy: models.NoDataAnnotationsMarkStale,
+			expected: []map[string]string{
+				{"summary": "value A=5"},
+				{"summary": "value A=5", models.StaleAnnotation: "true"},
+				{"summary": "value A=7"},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_no_data_annotations"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			rule := &models.AlertRule{
+				OrgID:             1,
+				Title:             "test_title",
+				UID:               "test_alert_rule_uid",
+				NamespaceUID:      "test_namespace_uid",
+				IntervalSeconds:   10,
+				NoDataState:       models.NoData,
+				Annotations:       map[string]string{"summary": "value {{ $value }}"},
+				NoDataAnnotations: tc.policy,
+			}
+
+			for i, result := range results {
+				result.Instance = data.Labels{"instance_label": "test"}
+				result.EvaluatedAt = evaluationTime.Add(time.Duration(i) * 10 * time.Second)
+				states := st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+				require.Len(t, states, 1)
+				assert.Equal(t, tc.expected[i], states[0].Annotations, "evaluation %d", i)
+			}
+		})
+	}
+}
+
+func TestProcessEvalResults_ZeroEvaluatedAt(t *testing.T) {
+	now := time.Date(2021, 3, 25, 12, 0, 0, 0, time.UTC)
+	mockClock := clock.NewMock()
+	mockClock.Set(now)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+	result := eval.Result{
+		Instance: data.Labels{"instance_label": "test"},
+		State:    eval.Alerting,
+	}
+
+	t.Run("the current time is used", func(t *testing.T) {
+		annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+		st := state.NewManager(log.New("test_zero_evaluated_at"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+		st.Clock = mockClock
+
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+		require.Len(t, states, 1)
+		assert.Equal(t, eval.Alerting, states[0].State)
+		assert.Equal(t, now, states[0].StartsAt)
+		assert.Equal(t, now.Add(state.ResendDelay*3), states[0].EndsAt)
+		assert.Equal(t, now, states[0].LastEvaluationTime)
+	})
+
+	t.Run("the result is rejected", func(t *testing.T) {
+		annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+		st := state.NewManager(log.New("test_zero_evaluated_at"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+		st.Clock = mockClock
+		st.RejectZeroEvaluatedAt = true
+
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{result})
+		assert.Empty(t, states)
+		assert.Empty(t, st.GetStatesForRuleUID(rule.OrgID, rule.UID))
+	})
+}
+
+func TestProcessEvalResults_AckTTL(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_ack_ttl"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.ResendDelay = 0
+	st.AckTTL = 30 * time.Second
+
+	evaluate := func(i int, s eval.State) *state.State {
+		evaluatedAt := evaluationTime.Add(time.Duration(i) * 10 * time.Second)
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       s,
+			EvaluatedAt: evaluatedAt,
+		}})
+		require.Len(t, states, 1)
+		return states[0]
+	}
+
+	s := evaluate(0, eval.Alerting)
+	require.True(t, s.NeedsSending(st.SendPolicy()))
+	s.LastSentAt = s.LastEvaluationTime
+
+	require.NoError(t, st.Acknowledge(rule.OrgID, rule.UID, s.CacheId, evaluationTime.Add(5*time.Second)))
+
+	// Resends stop while the acknowledgement lasts.
+	for i := 1; i <= 3; i++ {
+		s = evaluate(i, eval.Alerting)
+		assert.False(t, s.NeedsSending(st.SendPolicy()), "evaluation %d", i)
+		assert.Equal(t, evaluationTime.Add(5*time.Second), s.AcknowledgedAt)
+	}
+
+	// Resends resume once it expires, and it is cleared.
+	s = evaluate(4, eval.Alerting)
+	assert.True(t, s.NeedsSending(st.SendPolicy()))
+	assert.True(t, s.AcknowledgedAt.IsZero())
+
+	assert.Error(t, st.Acknowledge(rule.OrgID, rule.UID, "unknown", evaluationTime))
+}
+
+func TestProcessEvalResults_AckClearedOnResolve(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_ack_cleared_on_resolve"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	results := func(s eval.State, evaluatedAt time.Time) eval.Results {
+		return eval.Results{{Instance: data.Labels{"instance_label": "test"}, State: s, EvaluatedAt: evaluatedAt}}
+	}
+
+	states := st.ProcessEvalResults(context.Background(), rule, results(eval.Alerting, evaluationTime))
+	require.Len(t, states, 1)
+	require.NoError(t, st.Acknowledge(rule.OrgID, rule.UID, states[0].CacheId, evaluationTime))
+
+	states = st.ProcessEvalResults(context.Background(), rule, results(eval.Normal, evaluationTime.Add(10*time.Second)))
+	require.Len(t, states, 1)
+	assert.True(t, states[0].AcknowledgedAt.IsZero())
+	// The resolve is sent although the alert was acknowledged.
+	assert.True(t, states[0].NeedsSending(st.SendPolicy()))
+}
+
+func TestProcessEvalResults_AnnotationHistory(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		Annotations:     map[string]string{"summary": "value {{ $value }}"},
+	}
+	evaluationStrings := []string{"A=1", "A=1", "A=1", "A=2", "A=2"}
+	expected := []map[string]string{
+		{"summary": "value A=1"},
+		{"summary": "value A=1"},
+		{"summary": "value A=1"},
+		{"summary": "value A=2"},
+		{"summary": "value A=2"},
+	}
+
+	testCases := []struct {
+		desc             string
+		mode             state.AnnotationHistory
+		expectedSnapshot int
+	}{
+		{
+			desc:             "full history copies the annotations of each evaluation",
+			mode:             state.AnnotationHistoryFull,
+			expectedSnapshot: 5,
+		},
+		{
+			desc:             "compact history shares unchanged annotations",
+			mode:             state.AnnotationHistoryCompact,
+			expectedSnapshot: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_annotation_history"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.AnnotationHistory = tc.mode
+
+			var s *state.State
+			for i, evaluationString := range evaluationStrings {
+				states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+					Instance:         data.Labels{"instance_label": "test"},
+					State:            eval.Normal,
+					EvaluatedAt:      evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+					EvaluationString: evaluationString,
+				}})
+				require.Len(t, states, 1)
+				s = states[0]
+			}
+
+			// The annotations of each evaluation are reconstructed correctly.
+			snapshots := make(map[uintptr]struct{})
+			for i, r := range s.Results {
+				assert.Equal(t, expected[i], r.Annotations, "evaluation %d", i)
+				snapshots[reflect.ValueOf(r.Annotations).Pointer()] = struct{}{}
+			}
+			assert.Len(t, snapshots, tc.expectedSnapshot)
+		})
+	}
+
+	t.Run("annotations are not recorded by default", func(t *testing.T) {
+		annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+		st := state.NewManager(log.New("test_annotation_history"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       eval.Normal,
+			EvaluatedAt: evaluationTime,
+		}})
+		require.Len(t, states, 1)
+		assert.Nil(t, states[0].Results[0].Annotations)
+	})
+}
+
+func TestProcessEvalResults_PreservePrePendingStartsAt(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		For:             20 * time.Second,
+	}
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_preserve_pre_pending_starts_at"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.PreservePrePendingStartsAt = true
+
+	evaluations := []struct {
+		state         eval.State
+		expectedState eval.State
+		expected      time.Time
+	}{
+		{eval.Alerting, eval.Pending, time.Time{}},
+		{eval.Normal, eval.Normal, time.Time{}},
+		{eval.Normal, eval.Normal, time.Time{}},
+		// Normal since the second evaluation.
+		{eval.Alerting, eval.Pending, evaluationTime.Add(10 * time.Second)},
+		{eval.Alerting, eval.Pending, evaluationTime.Add(10 * time.Second)},
+		{eval.Alerting, eval.Pending, evaluationTime.Add(10 * time.Second)},
+		{eval.Alerting, eval.Alerting, time.Time{}},
+	}
+	for i, e := range evaluations {
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       e.state,
+			EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+		}})
+		require.Len(t, states, 1)
+		assert.Equal(t, e.expectedState, states[0].State, "evaluation %d", i)
+		assert.Equal(t, e.expected, states[0].PrePendingStartsAt, "evaluation %d", i)
+	}
+}
+
+func TestProcessEvalResults_ResolveMissingSeries(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc                 string
+		resolveMissingSeries bool
+		ruleFor              time.Duration
+		missingResult        eval.State
+		expectedStates       map[string]eval.State
+		expectedResolved     []string
+		expectedMissingState eval.State
+	}{
+		{
+			desc:                 "missing series is resolved while the other series fires",
+			resolveMissingSeries: true,
+			missingResult:        eval.Alerting,
+			expectedStates:       map[string]eval.State{"a": eval.Alerting, "b": eval.Normal},
+			expectedResolved:     []string{"b"},
+			expectedMissingState: eval.Normal,
+		},
+		{
+			desc:                 "missing series in error is resolved",
+			resolveMissingSeries: true,
+			missingResult:        eval.Error,
+			expectedStates:       map[string]eval.State{"a": eval.Alerting, "b": eval.Normal},
+			expectedResolved:     []string{"b"},
+			expectedMissingState: eval.Normal,
+		},
+		{
+			desc:                 "missing pending series is not resolved",
+			resolveMissingSeries: true,
+			ruleFor:              time.Minute,
+			missingResult:        eval.Alerting,
+			expectedStates:       map[string]eval.State{"a": eval.Pending},
+			expectedMissingState: eval.Pending,
+		},
+		{
+			desc:                 "missing series keeps firing when disabled",
+			resolveMissingSeries: false,
+			missingResult:        eval.Alerting,
+			expectedStates:       map[string]eval.State{"a": eval.Alerting},
+			expectedMissingState: eval.Alerting,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_resolve_missing_series"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.ResolveMissingSeries = tc.resolveMissingSeries
+			rule := &models.AlertRule{
+				OrgID:           1,
+				Title:           "test_title",
+				UID:             "test_alert_rule_uid",
+				NamespaceUID:    "test_namespace_uid",
+				IntervalSeconds: 10,
+				For:             tc.ruleFor,
+				ExecErrState:    models.ErrorErrState,
+			}
+
+			st.ProcessEvalResults(context.Background(), rule, eval.Results{
+				{Instance: data.Labels{"instance": "a"}, State: eval.Alerting, EvaluatedAt: evaluationTime},
+				{Instance: data.Labels{"instance": "b"}, State: tc.missingResult, EvaluatedAt: evaluationTime},
+			})
+			next := evaluationTime.Add(10 * time.Second)
+			states := st.ProcessEvalResults(context.Background(), rule, eval.Results{
+				{Instance: data.Labels{"instance": "a"}, State: eval.Alerting, EvaluatedAt: next},
+			})
+
+			actual := make(map[string]eval.State, len(states))
+			var resolved []string
+			for _, s := range states {
+				actual[s.Labels["instance"]] = s.State
+				if s.Resolved {
+					resolved = append(resolved, s.Labels["instance"])
+					assert.Equal(t, next, s.EndsAt)
+				}
+			}
+			assert.Equal(t, tc.expectedStates, actual)
+			assert.Equal(t, tc.expectedResolved, resolved)
+
+			for _, s := range st.GetStatesForRuleUID(rule.OrgID, rule.UID) {
+				if s.Labels["instance"] == "b" {
+					assert.Equal(t, tc.expectedMissingState, s.State)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessEvalResults_ResolveMissingSeriesIsSent(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_resolve_missing_series"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.ResolveMissingSeries = true
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+
+	for _, s := range st.ProcessEvalResults(context.Background(), rule, eval.Results{
+		{Instance: data.Labels{"instance": "a"}, State: eval.Alerting, EvaluatedAt: evaluationTime},
+		{Instance: data.Labels{"instance": "b"}, State: eval.Alerting, EvaluatedAt: evaluationTime},
+	}) {
+		s.MarkSent(evaluationTime)
+	}
+
+	// The series is missing after the resend delay of its last notification.
+	next := evaluationTime.Add(state.ResendDelay + 10*time.Second)
+	states := st.ProcessEvalResults(context.Background(), rule, eval.Results{
+		{Instance: data.Labels{"instance": "a"}, State: eval.Alerting, EvaluatedAt: next},
+	})
+	var missing *state.State
+	for _, s := range states {
+		if s.Labels["instance"] == "b" {
+			missing = s
+		}
+	}
+	require.NotNil(t, missing)
+	require.True(t, missing.Resolved)
+	assert.Equal(t, next, missing.LastEvaluationTime)
+	assert.True(t, missing.NeedsSending(st.SendPolicy()))
+
+	var sent []time.Time
+	for _, alert := range schedule.FromAlertStateToPostableAlerts(states, st, nil).PostableAlerts {
+		if alert.Labels["instance"] == "b" {
+			sent = append(sent, time.Time(alert.EndsAt).UTC())
+		}
+	}
+	assert.Equal(t, []time.Time{next}, sent)
+}
+
+func TestProcessEvalResults_AuditTransitions(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_audit_transitions"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.TransitionBufferSize = 10
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		For:             30 * time.Second,
+	}
+
+	var s *state.State
+	for i, result := range []eval.State{eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting} {
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{
+			{Instance: data.Labels{"instance": "a"}, State: result, EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second)},
+		})
+		require.Len(t, states, 1)
+		s = states[0]
+	}
+	// The state fired twice, each time after For elapsed in Pending.
+	require.Equal(t, eval.Alerting, s.State)
+	require.Equal(t, []state.TransitionPoint{
+		{Time: evaluationTime.Add(10 * time.Second), State: eval.Pending},
+		{Time: evaluationTime.Add(50 * time.Second), State: eval.Alerting},
+		{Time: evaluationTime.Add(60 * time.Second), State: eval.Normal},
+		{Time: evaluationTime.Add(70 * time.Second), State: eval.Pending},
+		{Time: evaluationTime.Add(110 * time.Second), State: eval.Alerting},
+	}, s.Transitions)
+	assert.Nil(t, s.AuditTransitions(rule))
+
+	// The same results under a longer For could not have fired. The first firing is not
+	// audited, as the Results it was pending for are no longer retained.
+	longer := *rule
+	longer.For = time.Minute
+	assert.Equal(t, []string{
+		"state fired at 2021-03-25T00:01:50Z after 40s of Alerting evaluations but the rule requires 1m0s",
+	}, s.AuditTransitions(&longer))
+}
+
+func TestReparent(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_reparent"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+	states := st.ProcessEvalResults(context.Background(), rule, eval.Results{
+		{Instance: data.Labels{"instance": "a"}, State: eval.Alerting, EvaluatedAt: evaluationTime},
+	})
+	require.Len(t, states, 1)
+	oldCacheID := states[0].CacheId
+
+	// The rule is moved to a folder of the other organization.
+	moved := *rule
+	moved.OrgID = 2
+	moved.NamespaceUID = "other_namespace_uid"
+	st.Reparent(1, &moved)
+
+	assert.Empty(t, st.GetStatesForRuleUID(1, rule.UID))
+	_, err = st.Get(1, rule.UID, oldCacheID)
+	require.Error(t, err)
+
+	reparented := st.GetStatesForRuleUID(2, rule.UID)
+	require.Len(t, reparented, 1)
+	s := reparented[0]
+	assert.Equal(t, int64(2), s.OrgID)
+	assert.Equal(t, "other_namespace_uid", s.Labels[models.NamespaceUIDLabel])
+	assert.Equal(t, `[["__alert_rule_namespace_uid__","other_namespace_uid"],["__alert_rule_uid__","test_alert_rule_uid"],["alertname","test_title"],["instance","a"]]`, s.CacheId)
+	got, err := st.Get(2, rule.UID, s.CacheId)
+	require.NoError(t, err)
+	assert.Same(t, s, got)
+	// The history is kept.
+	assert.Equal(t, eval.Alerting, s.State)
+	assert.Equal(t, evaluationTime, s.StartsAt)
+	require.Len(t, s.Results, 1)
+	assert.Equal(t, evaluationTime, s.Results[0].EvaluationTime)
+
+	// The next evaluation in the new organization updates the same state.
+	next := evaluationTime.Add(10 * time.Second)
+	states = st.ProcessEvalResults(context.Background(), &moved, eval.Results{
+		{Instance: data.Labels{"instance": "a"}, State: eval.Alerting, EvaluatedAt: next},
+	})
+	require.Len(t, states, 1)
+	assert.Same(t, s, states[0])
+	assert.Equal(t, evaluationTime, s.StartsAt)
+	assert.Len(t, s.Results, 2)
+}
+
+func TestProcessEvalResults_MinResolvedDwellLongerThanRetention(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_min_resolved_dwell"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	rule := &models.AlertRule{
+		OrgID:            1,
+		Title:            "test_title",
+		UID:              "test_alert_rule_uid",
+		NamespaceUID:     "test_namespace_uid",
+		IntervalSeconds:  60,
+		MinResolvedDwell: 15 * time.Minute,
+	}
+	// The dwell is longer than the evaluations retained in Results.
+	require.Greater(t, rule.MinResolvedDwell, state.RetentionWindow(rule))
+
+	process := func(i int, result eval.State) *state.State {
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{
+			{Instance: data.Labels{"instance": "a"}, State: result, EvaluatedAt: evaluationTime.Add(time.Duration(i) * time.Minute)},
+		})
+		require.Len(t, states, 1)
+		return states[0]
+	}
+
+	s := process(0, eval.Alerting)
+	require.Equal(t, eval.Alerting, s.State)
+	for i := 1; i < 15; i++ {
+		s = process(i, eval.Normal)
+		require.Equal(t, eval.Alerting, s.State, "after %d minutes", i)
+	}
+	assert.Equal(t, evaluationTime.Add(time.Minute), s.ClearSince)
+
+	s = process(16, eval.Normal)
+	assert.Equal(t, eval.Normal, s.State)
+	assert.True(t, s.Resolved)
+	assert.Equal(t, evaluationTime.Add(time.Minute), s.ClearSince)
+
+	// ClearSince is reset when the condition is met again.
+	s = process(17, eval.Alerting)
+	assert.True(t, s.ClearSince.IsZero())
+}
+
+func TestProcessEvalResults_DatasourceOutage(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+	outage := state.DatasourceOutage{
+		DatasourceUID: "datasource_uid",
+		From:          evaluationTime.Add(10 * time.Second),
+		To:            evaluationTime.Add(30 * time.Second),
+	}
+
+	testCases := []struct {
+		desc           string
+		datasourceUID  string
+		previous       eval.State
+		results        []eval.State
+		expectedStates []eval.State
+	}{
+		{
+			desc:           "errors during the outage do not fire",
+			datasourceUID:  "datasource_uid",
+			previous:       eval.Normal,
+			results:        []eval.State{eval.Error, eval.NoData, eval.Error},
+			expectedStates: []eval.State{eval.Normal, eval.Normal, eval.Error},
+		},
+		{
+			desc:           "firing alert keeps firing during the outage",
+			datasourceUID:  "datasource_uid",
+			previous:       eval.Alerting,
+			results:        []eval.State{eval.Normal, eval.NoData, eval.Normal},
+			expectedStates: []eval.State{eval.Alerting, eval.Alerting, eval.Normal},
+		},
+		{
+			desc:           "rules of other datasources are not frozen",
+			datasourceUID:  "other_datasource_uid",
+			previous:       eval.Normal,
+			results:        []eval.State{eval.Error, eval.NoData, eval.Error},
+			expectedStates: []eval.State{eval.Error, eval.NoData, eval.Error},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_datasource_outage"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.DatasourceOutages = []state.DatasourceOutage{outage}
+			rule := &models.AlertRule{
+				OrgID:           1,
+				Title:           "test_title",
+				UID:             "test_alert_rule_uid",
+				NamespaceUID:    "test_namespace_uid",
+				Data:            []models.AlertQuery{{RefID: "A", DatasourceUID: tc.datasourceUID}},
+				IntervalSeconds: 10,
+				NoDataState:     models.NoData,
+				ExecErrState:    models.ErrorErrState,
+			}
+
+			st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+				Instance:    data.Labels{"instance_label": "test"},
+				State:       tc.previous,
+				EvaluatedAt: evaluationTime,
+			}})
+			for i, r := range tc.results {
+				evaluatedAt := evaluationTime.Add(time.Duration(i+1) * 10 * time.Second)
+				states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+					Instance:    data.Labels{"instance_label": "test"},
+					State:       r,
+					EvaluatedAt: evaluatedAt,
+				}})
+				require.Len(t, states, 1)
+				assert.Equal(t, tc.expectedStates[i], states[0].State, "evaluation %d", i)
+				if states[0].State == eval.Alerting {
+					assert.True(t, states[0].EndsAt.After(evaluatedAt))
+				}
+			}
+		})
+	}
+}
+
+func TestProcessEvalResults_PreviousValuesInAnnotations(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_previous_values_in_annotations"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		Annotations: map[string]string{
+			"summary": "{{ with $previous.A }}changed from {{ . }} to {{ end }}{{ $values.A }}",
+		},
+	}
+	result := func(v float64, evaluatedAt time.Time) eval.Results {
+		return eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       eval.Normal,
+			EvaluatedAt: evaluatedAt,
+			Values:      map[string]eval.NumberValueCapture{"A": {Var: "A", Value: ptrFloat64(v)}},
+		}}
+	}
+
+	states := st.ProcessEvalResults(context.Background(), rule, result(1, evaluationTime))
+	require.Len(t, states, 1)
+	assert.Equal(t, "1", states[0].Annotations["summary"])
+
+	states = st.ProcessEvalResults(context.Background(), rule, result(2, evaluationTime.Add(10*time.Second)))
+	require.Len(t, states, 1)
+	assert.Equal(t, "changed from 1 to 2", states[0].Annotations["summary"])
+}
+
+func TestProcessEvalResults_RetainLastError(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		ExecErrState:    models.ErrorErrState,
+	}
+	results := func(s eval.State, err error, evaluatedAt time.Time) eval.Results {
+		return eval.Results{{Instance: data.Labels{"instance_label": "test"}, State: s, Error: err, EvaluatedAt: evaluatedAt}}
+	}
+
+	testCases := []struct {
+		desc            string
+		retainLastError bool
+		expected        []string
+	}{
+		{
+			desc:            "last error is retained after recovery",
+			retainLastError: true,
+			expected:        []string{"", "connection refused", "connection refused", ""},
+		},
+		{
+			desc:            "last error is cleared on recovery when disabled",
+			retainLastError: false,
+			expected:        []string{"", "", "", ""},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_retain_last_error"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.RetainLastError = tc.retainLastError
+
+			for i, r := range []eval.Results{
+				results(eval.Error, errors.New("connection refused"), evaluationTime),
+				results(eval.Normal, nil, evaluationTime.Add(10*time.Second)),
+				results(eval.Normal, nil, evaluationTime.Add(20*time.Second)),
+				results(eval.Error, errors.New("timeout"), evaluationTime.Add(30*time.Second)),
+			} {
+				states := st.ProcessEvalResults(context.Background(), rule, r)
+				require.Len(t, states, 1)
+				assert.Equal(t, tc.expected[i], states[0].Annotations[models.LastErrorAnnotation], "evaluation %d", i)
+				assert.Equal(t, tc.expected[i], states[0].LastError, "evaluation %d", i)
+			}
+		})
+	}
+}
+
+func TestProcessEvalResults_RetentionCoversFor(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_retention_covers_for"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	rule := &models.AlertRule{
+		OrgID:              1,
+		Title:              "test_title",
+		UID:                "test_alert_rule_uid",
+		NamespaceUID:       "test_namespace_uid",
+		IntervalSeconds:    10,
+		For:                15 * time.Second,
+		AnnotateWillFireAt: true,
+	}
+	require.GreaterOrEqual(t, state.RetentionWindow(rule), rule.For)
+
+	var states []*state.State
+	for i := 0; i < 10; i++ {
+		states = st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       eval.Alerting,
+			EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+		}})
+		require.Len(t, states, 1)
+		if i == 0 {
+			// For is not shortened to the retention window.
+			assert.Equal(t, eval.Pending, states[0].State)
+			assert.Equal(t, evaluationTime.Add(15*time.Second).Format(time.RFC3339), states[0].Annotations[models.WillFireAtAnnotation])
+		}
+	}
+
+	// The retained evaluations cover the whole pending period.
+	results := states[0].Results
+	require.Len(t, results, 4)
+	assert.GreaterOrEqual(t, results[len(results)-1].EvaluationTime.Sub(results[0].EvaluationTime), rule.For)
+}
+
+func TestProcessEvalResults_Backfill(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_backfill"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.Backfill = true
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		For:             10 * time.Second,
+	}
+	results := func(s eval.State, evaluatedAt time.Time) eval.Results {
+		return eval.Results{{Instance: data.Labels{"instance_label": "test"}, State: s, EvaluatedAt: evaluatedAt}}
+	}
+
+	var states []*state.State
+	for i, s := range []eval.State{eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting} {
+		states = st.ProcessEvalResults(context.Background(), rule, results(s, evaluationTime.Add(time.Duration(i)*10*time.Second)))
+		require.Len(t, states, 1)
+		assert.False(t, states[0].NeedsSending(st.SendPolicy()), "evaluation %d", i)
+	}
+	// The history and timers are built as if the results were live.
+	assert.Equal(t, eval.Alerting, states[0].State)
+	assert.Equal(t, evaluationTime.Add(70*time.Second), states[0].StartsAt)
+	assert.Equal(t, evaluationTime.Add(70*time.Second), states[0].LastEvaluationTime)
+	assert.NotEmpty(t, states[0].Results)
+	assert.True(t, states[0].Backfill)
+
+	st.Backfill = false
+	states = st.ProcessEvalResults(context.Background(), rule, results(eval.Alerting, evaluationTime.Add(80*time.Second)))
+	require.Len(t, states, 1)
+	assert.False(t, states[0].Backfill)
+	assert.True(t, states[0].NeedsSending(st.SendPolicy()))
+}
+
+func TestProcessEvalResults_TransitionBuffer(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_transition_buffer"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.TransitionBufferSize = 3
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		// Keeps the two latest evaluations in Results.
+		For:          10 * time.Second,
+		ExecErrState: models.ErrorErrState,
+	}
+
+	var states []*state.State
+	evaluations := []eval.State{eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal, eval.Normal, eval.Error, eval.Error, eval.Normal, eval.Normal}
+	for i, s := range evaluations {
+		states = st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       s,
+			EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+		}})
+	}
+	require.Len(t, states, 1)
+	assert.Len(t, states[0].Results, 2)
+	// The Pending and Alerting transitions are dropped from the buffer.
+	assert.Equal(t, []state.TransitionPoint{
+		{Time: evaluationTime.Add(30 * time.Second), State: eval.Normal},
+		{Time: evaluationTime.Add(50 * time.Second), State: eval.Error},
+		{Time: evaluationTime.Add(70 * time.Second), State: eval.Normal},
+	}, states[0].Transitions)
+}
+
+func TestProcessEvalResults_MergeSameTimeResults(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+	results := eval.Results{
+		{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       eval.Alerting,
+			EvaluatedAt: evaluationTime,
+			Values:      map[string]eval.NumberValueCapture{"A": {Var: "A", Value: ptrFloat64(1)}},
+		},
+		{
+			Instance:    data.Labels{"instance_label": "test"},
+			State:       eval.Normal,
+			EvaluatedAt: evaluationTime,
+			Values:      map[string]eval.NumberValueCapture{"B": {Var: "B", Value: ptrFloat64(2)}},
+		},
+	}
+
+	testCases := []struct {
+		desc                 string
+		mergeSameTimeResults bool
+		expectedResults      []state.Evaluation
+		expectedState        eval.State
+	}{
+		{
+			desc:                 "results at the same time are merged",
+			mergeSameTimeResults: true,
+			expectedResults: []state.Evaluation{
+				{
+					EvaluationTime:  evaluationTime,
+					EvaluationState: eval.Alerting,
+					Values:          map[string]*float64{"A": ptrFloat64(1), "B": ptrFloat64(2)},
+				},
+			},
+			expectedState: eval.Alerting,
+		},
+		{
+			desc:                 "results at the same time are separate evaluations when disabled",
+			mergeSameTimeResults: false,
+			expectedResults: []state.Evaluation{
+				{
+					EvaluationTime:  evaluationTime,
+					EvaluationState: eval.Alerting,
+					Values:          map[string]*float64{"A": ptrFloat64(1)},
+				},
+				{
+					EvaluationTime:  evaluationTime,
+					EvaluationState: eval.Normal,
+					Values:          map[string]*float64{"B": ptrFloat64(2)},
+				},
+			},
+			expectedState: eval.Normal,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_merge_same_time_results"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.MergeSameTimeResults = tc.mergeSameTimeResults
+
+			st.ProcessEvalResults(context.Background(), rule, results)
+			states := st.GetStatesForRuleUID(rule.OrgID, rule.UID)
+			require.Len(t, states, 1)
+			assert.Equal(t, tc.expectedResults, states[0].Results)
+			assert.Equal(t, tc.expectedState, states[0].State)
+		})
+	}
+}
+
+func TestProcessEvalResults_PreserveLabelOrder(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+	}
+	results := eval.Results{
+		{
+			Instance:      data.Labels{"instance": "a", "job": "node", "cluster": "eu"},
+			InstanceOrder: []string{"job", "instance", "cluster"},
+			State:         eval.Normal,
+			EvaluatedAt:   evaluationTime,
+		},
+	}
+
+	testCases := []struct {
+		desc                  string
+		preserveLabelOrder    bool
+		expectedOrderedLabels []state.KV
+	}{
+		{
+			desc:               "the labels are recorded in the order of the source",
+			preserveLabelOrder: true,
+			expectedOrderedLabels: []state.KV{
+				{Key: "job", Value: "node"},
+				{Key: "instance", Value: "a"},
+				{Key: "cluster", Value: "eu"},
+			},
+		},
+		{
+			desc:                  "the labels are not recorded when disabled",
+			preserveLabelOrder:    false,
+			expectedOrderedLabels: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_preserve_label_order"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.PreserveLabelOrder = tc.preserveLabelOrder
+
+			st.ProcessEvalResults(context.Background(), rule, results)
+			states := st.GetStatesForRuleUID(rule.OrgID, rule.UID)
+			require.Len(t, states, 1)
+			require.Len(t, states[0].Results, 1)
+			assert.Equal(t, tc.expectedOrderedLabels, states[0].Results[0].OrderedLabels)
+		})
+	}
+}
+
+func TestProcessEvalResults_ResolveOrphanedStates(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc                  string
+		resolveOrphanedStates bool
+		expectedResolved      []string
+	}{
+		{
+			desc:                  "the state orphaned by a label change is resolved",
+			resolveOrphanedStates: true,
+			expectedResolved:      []string{"1"},
+		},
+		{
+			desc:                  "the state orphaned by a label change is removed when disabled",
+			resolveOrphanedStates: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+			st := state.NewManager(log.New("test_resolve_orphaned_states"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+			st.ResolveOrphanedStates = tc.resolveOrphanedStates
+			rule := &models.AlertRule{
+				OrgID:           1,
+				Title:           "test_title",
+				UID:             "test_alert_rule_uid",
+				NamespaceUID:    "test_namespace_uid",
+				IntervalSeconds: 10,
+			}
+
+			st.ProcessEvalResults(context.Background(), rule, eval.Results{
+				{Instance: data.Labels{"instance": "a", "version": "1"}, State: eval.Alerting, EvaluatedAt: evaluationTime},
+			})
+			// The labels of the series change, so the state of the old labels is no longer evaluated.
+			states, orphaned := st.ProcessEvalResultsAndOrphans(context.Background(), rule, eval.Results{
+				{Instance: data.Labels{"instance": "a", "version": "2"}, State: eval.Alerting, EvaluatedAt: evaluationTime.Add(10 * time.Second)},
+			})
+			require.Len(t, states, 1)
+			assert.Equal(t, "2", states[0].Labels["version"])
+
+			var resolved []string
+			for _, s := range orphaned {
+				require.True(t, s.Resolved)
+				assert.Equal(t, eval.Normal, s.State)
+				resolved = append(resolved, s.Labels["version"])
+			}
+			assert.Equal(t, tc.expectedResolved, resolved)
+
+			remaining := st.GetStatesForRuleUID(rule.OrgID, rule.UID)
+			require.Len(t, remaining, 1)
+			assert.Equal(t, "2", remaining[0].Labels["version"])
+		})
+	}
+}
+
+func TestProcessEvalResults_ResolveOrphanedStatesIsSent(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_resolve_orphaned_states"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.ResolveOrphanedStates = true
+	mockClock := clock.NewMock()
+	mockClock.Set(evaluationTime)
+	st.Clock = mockClock
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		NoDataState:     models.NoData,
+	}
+
+	for _, s := range st.ProcessEvalResults(context.Background(), rule, eval.Results{
+		{Instance: data.Labels{"instance": "a", "version": "1"}, State: eval.Alerting, EvaluatedAt: evaluationTime},
+		{Instance: data.Labels{"instance": "b", "version": "1"}, State: eval.NoData, EvaluatedAt: evaluationTime},
+	}) {
+		s.MarkSent(evaluationTime)
+	}
+
+	// The labels of the series change, so the states of the old labels become stale.
+	next := evaluationTime.Add(state.ResendDelay + 10*time.Second)
+	mockClock.Set(next)
+	_, orphaned := st.ProcessEvalResultsAndOrphans(context.Background(), rule, eval.Results{
+		{Instance: data.Labels{"instance": "a", "version": "2"}, State: eval.Alerting, EvaluatedAt: next},
+		{Instance: data.Labels{"instance": "b", "version": "2"}, State: eval.NoData, EvaluatedAt: next},
+	})
+
+	var resolved []string
+	for _, s := range orphaned {
+		require.True(t, s.Resolved)
+		assert.Equal(t, next, s.LastEvaluationTime)
+		resolved = append(resolved, s.Labels["instance"])
+	}
+	assert.ElementsMatch(t, []string{"a", "b"}, resolved)
+
+	// The orphaned states are sent as resolved at the time they were removed.
+	alerts := schedule.FromOrphanedStatesToPostableAlerts(orphaned, nil)
+	require.Len(t, alerts.PostableAlerts, 2)
+	for _, a := range alerts.PostableAlerts {
+		assert.True(t, next.Equal(time.Time(a.EndsAt)))
+	}
+}
+
+func TestProcessEvalResults_ResendOnAnnotationChange(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_resend_on_annotation_change"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.ResendOnAnnotationChange = true
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		Annotations:     map[string]string{"summary": "{{ $values.A }} in use"},
+	}
+	result := func(at time.Time, value float64) eval.Results {
+		return eval.Results{{
+			Instance:    data.Labels{"instance": "a"},
+			State:       eval.Alerting,
+			EvaluatedAt: at,
+			Values:      map[string]eval.NumberValueCapture{"A": {Var: "A", Value: ptrFloat64(value)}},
+		}}
+	}
+
+	st.ProcessEvalResults(context.Background(), rule, result(evaluationTime, 1))
+	states := st.ProcessEvalResults(context.Background(), rule, result(evaluationTime.Add(10*time.Second), 1))
+	require.Len(t, states, 1)
+	assert.True(t, states[0].AnnotationsChangedAt.IsZero())
+
+	states = st.ProcessEvalResults(context.Background(), rule, result(evaluationTime.Add(20*time.Second), 2))
+	require.Len(t, states, 1)
+	assert.Equal(t, evaluationTime.Add(20*time.Second), states[0].AnnotationsChangedAt)
+	assert.Equal(t, "2 in use", states[0].Annotations["summary"])
+}
+
+func TestProcessEvalResults_ResendOnAnnotationChange_RepeatedError(t *testing.T) {
+	evaluationTime, err := time.Parse("2006-01-02", "2021-03-25")
+	require.NoError(t, err)
+
+	annotations.SetRepository(schedule.NewFakeAnnotationsRepo())
+	st := state.NewManager(log.New("test_resend_on_annotation_change"), testMetrics.GetStateMetrics(), nil, nil, &schedule.FakeInstanceStore{})
+	st.ResendOnAnnotationChange = true
+	rule := &models.AlertRule{
+		OrgID:           1,
+		Title:           "test_title",
+		UID:             "test_alert_rule_uid",
+		NamespaceUID:    "test_namespace_uid",
+		IntervalSeconds: 10,
+		ExecErrState:    models.ErrorErrState,
+		Annotations:     map[string]string{"summary": "instance is down"},
+	}
+
+	// The same error on each evaluation within the resend delay does not re-send the
+	// state, even though the Error annotation is added to it after the annotations of
+	// the rule are expanded.
+	for i := 0; i < 4; i++ {
+		at := evaluationTime.Add(time.Duration(i) * 5 * time.Second)
+		states := st.ProcessEvalResults(context.Background(), rule, eval.Results{{
+			Instance:    data.Labels{"instance": "a"},
+			State:       eval.Error,
+			Error:       errors.New("connection refused"),
+			EvaluatedAt: at,
+		}})
+		require.Len(t, states, 1)
+		s := states[0]
+		require.Equal(t, eval.Error, s.State)
+		require.Equal(t, "connection refused", s.Annotations["Error"])
+		assert.True(t, s.AnnotationsChangedAt.IsZero())
+		assert.Equal(t, i == 0, s.NeedsSending(st.SendPolicy()), "evaluation %d", i)
+		if i == 0 {
+			s.MarkSent(at)
+		}
+	}
+}
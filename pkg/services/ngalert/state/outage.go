@@ -0,0 +1,30 @@
+package state
+
+import (
+	"time"
+
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// DatasourceOutage is a known outage of a datasource. The states of rules that query
+// the datasource are frozen during the outage, so that the errors and missing data
+// caused by the outage do not change them.
+type DatasourceOutage struct {
+	// DatasourceUID is the UID of the datasource.
+	DatasourceUID string
+	// From and To are the start and end of the outage. The outage is ongoing if To is zero.
+	From, To time.Time
+}
+
+// Freezes returns true if the states of the rule are frozen by the outage at time t.
+func (o DatasourceOutage) Freezes(alertRule *ngModels.AlertRule, t time.Time) bool {
+	if t.Before(o.From) || (!o.To.IsZero() && !t.Before(o.To)) {
+		return false
+	}
+	for _, q := range alertRule.Data {
+		if q.DatasourceUID == o.DatasourceUID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package state
+
+import (
+	"github.com/prometheus/alertmanager/pkg/labels"
+)
+
+// Route is a notification route of the Alertmanager, reduced to what is needed to
+// estimate which receivers an alert is sent to.
+type Route struct {
+	// Receiver is the name of the receiver that alerts matching the route are sent to.
+	Receiver string
+	// Matchers select the alerts of the route. An alert must match all of them.
+	Matchers []*labels.Matcher
+}
+
+// matches returns true if the state matches all the matchers of the route.
+func (r Route) matches(s *State) bool {
+	for _, m := range r.Matchers {
+		if !m.Matches(s.Labels[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EstimateFanOut returns the number of distinct receivers of the routes that the state
+// matches, as an estimate of how many receivers are notified of it. Every matching
+// route is counted, as if all routes continue matching.
+func EstimateFanOut(s *State, routes []Route) int {
+	receivers := make(map[string]struct{})
+	for _, r := range routes {
+		if r.matches(s) {
+			receivers[r.Receiver] = struct{}{}
+		}
+	}
+	return len(receivers)
+}
+
+// groupByAll is the special group-by label of the Alertmanager that groups alerts by
+// all their labels.
+const groupByAll = "..."
+
+// SameGroup returns true if the Alertmanager would group the states together given the
+// group-by labels of their route, that is if they have the same value for each of the
+// labels. A missing label is the same as an empty one.
+func SameGroup(a, b *State, groupBy []string) bool {
+	for _, name := range groupBy {
+		if name == groupByAll {
+			return a.Labels.String() == b.Labels.String()
+		}
+	}
+	for _, name := range groupBy {
+		if a.Labels[name] != b.Labels[name] {
+			return false
+		}
+	}
+	return true
+}
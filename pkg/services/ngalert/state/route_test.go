@@ -0,0 +1,112 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/alertmanager/pkg/labels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateFanOut(t *testing.T) {
+	matcher := func(typ labels.MatchType, name, value string) *labels.Matcher {
+		m, err := labels.NewMatcher(typ, name, value)
+		require.NoError(t, err)
+		return m
+	}
+	routes := []Route{
+		{Receiver: "team-a", Matchers: []*labels.Matcher{matcher(labels.MatchEqual, "team", "a")}},
+		{Receiver: "pager", Matchers: []*labels.Matcher{matcher(labels.MatchEqual, "severity", "critical")}},
+		{Receiver: "team-a", Matchers: []*labels.Matcher{matcher(labels.MatchRegexp, "service", "api|web")}},
+		{Receiver: "team-b", Matchers: []*labels.Matcher{
+			matcher(labels.MatchEqual, "team", "b"),
+			matcher(labels.MatchEqual, "severity", "critical"),
+		}},
+		{Receiver: "everyone"},
+	}
+
+	testCases := []struct {
+		name     string
+		labels   data.Labels
+		expected int
+	}{
+		{
+			name:     "matches multiple routes",
+			labels:   data.Labels{"team": "a", "severity": "critical", "service": "api"},
+			expected: 3,
+		},
+		{
+			name:     "all matchers of a route must match",
+			labels:   data.Labels{"team": "b", "severity": "warning"},
+			expected: 1,
+		},
+		{
+			name:     "matches only the route without matchers",
+			labels:   data.Labels{"team": "c"},
+			expected: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, EstimateFanOut(&State{Labels: tc.labels}, routes))
+		})
+	}
+
+	assert.Equal(t, 0, EstimateFanOut(&State{Labels: data.Labels{"team": "a"}}, nil))
+}
+
+func TestSameGroup(t *testing.T) {
+	a := &State{Labels: data.Labels{"alertname": "HighCPU", "team": "a", "instance": "1"}}
+
+	testCases := []struct {
+		name     string
+		b        data.Labels
+		groupBy  []string
+		expected bool
+	}{
+		{
+			name:     "same group-by labels",
+			b:        data.Labels{"alertname": "HighCPU", "team": "a", "instance": "2"},
+			groupBy:  []string{"alertname", "team"},
+			expected: true,
+		},
+		{
+			name:     "different group-by label",
+			b:        data.Labels{"alertname": "HighCPU", "team": "b", "instance": "1"},
+			groupBy:  []string{"alertname", "team"},
+			expected: false,
+		},
+		{
+			name:     "missing group-by label",
+			b:        data.Labels{"alertname": "HighCPU", "instance": "1"},
+			groupBy:  []string{"alertname", "team"},
+			expected: false,
+		},
+		{
+			name:     "group-by label missing from both",
+			b:        data.Labels{"alertname": "HighCPU", "team": "a", "instance": "2"},
+			groupBy:  []string{"alertname", "cluster"},
+			expected: true,
+		},
+		{
+			name:     "no group-by labels",
+			b:        data.Labels{"alertname": "LowMemory"},
+			expected: true,
+		},
+		{
+			name:     "group by all labels",
+			b:        data.Labels{"alertname": "HighCPU", "team": "a", "instance": "2"},
+			groupBy:  []string{"..."},
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, SameGroup(a, &State{Labels: tc.b}, tc.groupBy))
+			assert.Equal(t, tc.expected, SameGroup(&State{Labels: tc.b}, a, tc.groupBy))
+		})
+	}
+}
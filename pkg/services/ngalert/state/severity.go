@@ -0,0 +1,201 @@
+package state
+
+import (
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// SeverityLabel is the label used to set the severity of an alert.
+const SeverityLabel = "severity"
+
+// Colors used to render states in the UI.
+const (
+	ColorRed    = "#E02F44"
+	ColorOrange = "#FF9830"
+	ColorYellow = "#FADE2A"
+	ColorGreen  = "#56A64B"
+	ColorBlue   = "#5794F2"
+	ColorGray   = "#8E8E8E"
+)
+
+var stateColors = map[eval.State]string{
+	eval.Normal:   ColorGreen,
+	eval.Alerting: ColorRed,
+	eval.Pending:  ColorYellow,
+	eval.NoData:   ColorGray,
+	eval.Error:    ColorOrange,
+}
+
+var severityColors = map[string]string{
+	"critical": ColorRed,
+	"warning":  ColorOrange,
+	"info":     ColorBlue,
+}
+
+// UIColor returns the color used to render the state in the UI. The color of a
+// firing alert can be overridden with a known value of the severity label.
+func (a *State) UIColor() string {
+	if a.State == eval.Alerting {
+		if c, ok := severityColors[strings.ToLower(a.Labels[SeverityLabel])]; ok {
+			return c
+		}
+	}
+	if c, ok := stateColors[a.State]; ok {
+		return c
+	}
+	return ColorGray
+}
+
+// Reasons returned by EffectiveSeverityReason.
+const (
+	SeverityReasonBreach = "breach"
+	SeverityReasonNoData = "no_data"
+	SeverityReasonError  = "error"
+)
+
+// EffectiveSeverityReason returns why an active state is active: the condition was
+// breached, or the rule returned no data or failed and NoDataState or ExecErrState
+// map it to the state, such as to Alerting. It is based on the latest evaluation
+// and returns an empty string if the state is not Alerting, NoData or Error.
+func (a *State) EffectiveSeverityReason() string {
+	if !a.IsActive() {
+		return ""
+	}
+	if len(a.Results) == 0 {
+		if a.State == eval.Alerting {
+			return SeverityReasonBreach
+		}
+		return ""
+	}
+	switch a.Results[len(a.Results)-1].EvaluationState {
+	case eval.NoData:
+		return SeverityReasonNoData
+	case eval.Error:
+		return SeverityReasonError
+	default:
+		return SeverityReasonBreach
+	}
+}
+
+// Severity is the severity of an alert, from SeverityNone to SeverityCritical.
+type Severity int
+
+const (
+	SeverityNone Severity = iota
+	SeverityInfo
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return "none"
+	}
+}
+
+// SeverityBand is the severity of an alert when the value of a RefID breaches a threshold.
+type SeverityBand struct {
+	Threshold ngModels.Threshold
+	Severity  Severity
+}
+
+// MultiBreachSeverity returns the severity of the state given the bands that the latest
+// evaluation breaches. It is the highest severity of the breached bands, raised by one
+// level for each other RefID that breaches at the same time, up to SeverityCritical.
+// It returns SeverityNone if no band is breached.
+func (a *State) MultiBreachSeverity(bands []SeverityBand) Severity {
+	if len(a.Results) == 0 {
+		return SeverityNone
+	}
+	values := a.Results[len(a.Results)-1].Values
+	severity := SeverityNone
+	breached := make(map[string]struct{})
+	for _, b := range bands {
+		v, ok := values[b.Threshold.RefID]
+		if !ok || v == nil || !b.Threshold.Breached(*v) {
+			continue
+		}
+		breached[b.Threshold.RefID] = struct{}{}
+		if b.Severity > severity {
+			severity = b.Severity
+		}
+	}
+	if len(breached) == 0 {
+		return SeverityNone
+	}
+	severity += Severity(len(breached) - 1)
+	if severity > SeverityCritical {
+		return SeverityCritical
+	}
+	return severity
+}
+
+// severityLabels maps the values of the severity label to severities.
+var severityLabels = map[string]Severity{
+	"critical": SeverityCritical,
+	"warning":  SeverityWarning,
+	"info":     SeverityInfo,
+}
+
+// stabilityWeightWindow is the window of the latest evaluations whose stability weighs
+// the severity in StabilityWeightedSeverity.
+const stabilityWeightWindow = time.Hour
+
+// StabilityWeightedSeverity returns the severity of a firing alert weighted by how stable
+// it has been in the hour before now, so a flapping alert scores lower than a sustained
+// one of the same severity. The severity is that of the severity label, or SeverityWarning
+// if the label is missing or unknown. It is weighted from half for a state that changed on
+// every evaluation to full for a state that did not change. It returns zero if the state
+// is not Alerting.
+func (a *State) StabilityWeightedSeverity(now time.Time) float64 {
+	if a.State != eval.Alerting {
+		return 0
+	}
+	stability := a.stability(now.Add(-stabilityWeightWindow), now)
+	return float64(a.labelSeverity()) * (1 + stability) / 2
+}
+
+// labelSeverity returns the severity of the severity label, or SeverityWarning if the
+// label is missing or unknown.
+func (a *State) labelSeverity() Severity {
+	if severity, ok := severityLabels[strings.ToLower(a.Labels[SeverityLabel])]; ok {
+		return severity
+	}
+	return SeverityWarning
+}
+
+// MajorIncidentOpts configures when a firing alert is a major incident. See IsMajorIncident.
+type MajorIncidentOpts struct {
+	// MinSeverity is the lowest severity of a major incident, as set by the severity
+	// label. Alerts without a known severity are SeverityWarning.
+	MinSeverity Severity
+	// MinFiringDuration is how long a major incident must have been firing.
+	MinFiringDuration time.Duration
+	// MinCoFiring is the number of other firing alerts that must share the values of
+	// LabelKeys with a major incident, as counted by BlastRadius. If LabelKeys is
+	// empty, all other firing alerts are counted.
+	MinCoFiring int
+	LabelKeys   []string
+}
+
+// IsMajorIncident returns true if the state is a major incident at now according to
+// the options: it is firing with at least the severity of the options, it has been
+// firing long enough, and enough other states in all are firing with it.
+func (a *State) IsMajorIncident(all []*State, opts MajorIncidentOpts, now time.Time) bool {
+	if a.State != eval.Alerting {
+		return false
+	}
+	return a.labelSeverity() >= opts.MinSeverity &&
+		now.Sub(a.StartsAt) >= opts.MinFiringDuration &&
+		BlastRadius(a, all, opts.LabelKeys) >= opts.MinCoFiring
+}
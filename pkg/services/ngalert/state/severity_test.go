@@ -0,0 +1,323 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngmodels "github.com/grafana/grafana/pkg/services/ngalert/models"
+	ptr "github.com/xorcare/pointer"
+)
+
+func TestUIColor(t *testing.T) {
+	testCases := []struct {
+		name     string
+		state    eval.State
+		labels   data.Labels
+		expected string
+	}{
+		{
+			name:     "normal",
+			state:    eval.Normal,
+			expected: ColorGreen,
+		},
+		{
+			name:     "alerting",
+			state:    eval.Alerting,
+			expected: ColorRed,
+		},
+		{
+			name:     "pending",
+			state:    eval.Pending,
+			expected: ColorYellow,
+		},
+		{
+			name:     "no data",
+			state:    eval.NoData,
+			expected: ColorGray,
+		},
+		{
+			name:     "error",
+			state:    eval.Error,
+			expected: ColorOrange,
+		},
+		{
+			name:     "alerting with severity warning",
+			state:    eval.Alerting,
+			labels:   data.Labels{SeverityLabel: "Warning"},
+			expected: ColorOrange,
+		},
+		{
+			name:     "alerting with severity info",
+			state:    eval.Alerting,
+			labels:   data.Labels{SeverityLabel: "info"},
+			expected: ColorBlue,
+		},
+		{
+			name:     "alerting with unknown severity",
+			state:    eval.Alerting,
+			labels:   data.Labels{SeverityLabel: "page"},
+			expected: ColorRed,
+		},
+		{
+			name:     "severity does not override other states",
+			state:    eval.Normal,
+			labels:   data.Labels{SeverityLabel: "info"},
+			expected: ColorGreen,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, Labels: tc.labels}
+			assert.Equal(t, tc.expected, s.UIColor())
+		})
+	}
+}
+
+func TestEffectiveSeverityReason(t *testing.T) {
+	testCases := []struct {
+		name       string
+		state      eval.State
+		evaluation eval.State
+		expected   string
+	}{
+		{
+			name:       "alerting from a breach",
+			state:      eval.Alerting,
+			evaluation: eval.Alerting,
+			expected:   SeverityReasonBreach,
+		},
+		{
+			name:       "alerting from no data",
+			state:      eval.Alerting,
+			evaluation: eval.NoData,
+			expected:   SeverityReasonNoData,
+		},
+		{
+			name:       "alerting from an error",
+			state:      eval.Alerting,
+			evaluation: eval.Error,
+			expected:   SeverityReasonError,
+		},
+		{
+			name:       "no data",
+			state:      eval.NoData,
+			evaluation: eval.NoData,
+			expected:   SeverityReasonNoData,
+		},
+		{
+			name:       "error",
+			state:      eval.Error,
+			evaluation: eval.Error,
+			expected:   SeverityReasonError,
+		},
+		{
+			name:       "normal",
+			state:      eval.Normal,
+			evaluation: eval.Normal,
+			expected:   "",
+		},
+		{
+			name:       "pending",
+			state:      eval.Pending,
+			evaluation: eval.Alerting,
+			expected:   "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{
+				State: tc.state,
+				Results: []Evaluation{
+					{EvaluationState: eval.Normal},
+					{EvaluationState: tc.evaluation},
+				},
+			}
+			assert.Equal(t, tc.expected, s.EffectiveSeverityReason())
+		})
+	}
+}
+
+func TestMultiBreachSeverity(t *testing.T) {
+	bands := []SeverityBand{
+		{Threshold: ngmodels.Threshold{RefID: "cpu", Value: 80}, Severity: SeverityWarning},
+		{Threshold: ngmodels.Threshold{RefID: "cpu", Value: 95}, Severity: SeverityCritical},
+		{Threshold: ngmodels.Threshold{RefID: "memory", Value: 90}, Severity: SeverityInfo},
+		{Threshold: ngmodels.Threshold{RefID: "disk", Value: 10, Below: true}, Severity: SeverityInfo},
+	}
+
+	testCases := []struct {
+		name     string
+		values   map[string]*float64
+		expected Severity
+	}{
+		{
+			name:     "no results",
+			expected: SeverityNone,
+		},
+		{
+			name:     "no breach",
+			values:   map[string]*float64{"cpu": ptr.Float64(50), "memory": ptr.Float64(50), "disk": ptr.Float64(50)},
+			expected: SeverityNone,
+		},
+		{
+			name:     "single breach",
+			values:   map[string]*float64{"cpu": ptr.Float64(85), "memory": ptr.Float64(50), "disk": ptr.Float64(50)},
+			expected: SeverityWarning,
+		},
+		{
+			name:     "single breach of several bands of the same RefID",
+			values:   map[string]*float64{"cpu": ptr.Float64(99), "memory": ptr.Float64(50)},
+			expected: SeverityCritical,
+		},
+		{
+			name:     "two simultaneous breaches",
+			values:   map[string]*float64{"cpu": ptr.Float64(50), "memory": ptr.Float64(95), "disk": ptr.Float64(5)},
+			expected: SeverityWarning,
+		},
+		{
+			name:     "three simultaneous breaches",
+			values:   map[string]*float64{"cpu": ptr.Float64(85), "memory": ptr.Float64(95), "disk": ptr.Float64(5)},
+			expected: SeverityCritical,
+		},
+		{
+			name:     "severity is capped at critical",
+			values:   map[string]*float64{"cpu": ptr.Float64(99), "memory": ptr.Float64(95), "disk": ptr.Float64(5)},
+			expected: SeverityCritical,
+		},
+		{
+			name:     "missing values do not breach",
+			values:   map[string]*float64{"cpu": nil, "memory": ptr.Float64(95)},
+			expected: SeverityInfo,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: eval.Alerting}
+			if tc.values != nil {
+				s.Results = []Evaluation{{EvaluationState: eval.Alerting, Values: tc.values}}
+			}
+			assert.Equal(t, tc.expected, s.MultiBreachSeverity(bands))
+		})
+	}
+}
+
+func TestStabilityWeightedSeverity(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	now := evaluationTime.Add(time.Minute)
+
+	testCases := []struct {
+		name     string
+		state    eval.State
+		labels   data.Labels
+		results  []Evaluation
+		expected float64
+	}{
+		{
+			name:     "sustained critical alert",
+			state:    eval.Alerting,
+			labels:   data.Labels{SeverityLabel: "critical"},
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting),
+			expected: 3,
+		},
+		{
+			name:     "flapping critical alert",
+			state:    eval.Alerting,
+			labels:   data.Labels{SeverityLabel: "critical"},
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Normal, eval.Alerting, eval.Normal, eval.Alerting),
+			expected: 1.5,
+		},
+		{
+			name:     "sustained alert without severity",
+			state:    eval.Alerting,
+			results:  makeResults(evaluationTime, eval.Alerting, eval.Alerting),
+			expected: 2,
+		},
+		{
+			name:     "normal state",
+			state:    eval.Normal,
+			labels:   data.Labels{SeverityLabel: "critical"},
+			results:  makeResults(evaluationTime, eval.Normal, eval.Normal),
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, Labels: tc.labels, Results: tc.results}
+			assert.InDelta(t, tc.expected, s.StabilityWeightedSeverity(now), 0.0001)
+		})
+	}
+}
+
+func TestIsMajorIncident(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	now := evaluationTime.Add(time.Hour)
+	opts := MajorIncidentOpts{
+		MinSeverity:       SeverityCritical,
+		MinFiringDuration: 30 * time.Minute,
+		MinCoFiring:       2,
+		LabelKeys:         []string{"cluster"},
+	}
+	firing := func(since time.Duration, labels data.Labels) *State {
+		return &State{State: eval.Alerting, StartsAt: now.Add(-since), Labels: labels}
+	}
+	critical := firing(time.Hour, data.Labels{SeverityLabel: "critical", "cluster": "prod"})
+	all := []*State{
+		critical,
+		firing(time.Minute, data.Labels{"cluster": "prod", "pod": "a"}),
+		firing(time.Minute, data.Labels{"cluster": "prod", "pod": "b"}),
+		firing(time.Minute, data.Labels{"cluster": "dev", "pod": "c"}),
+		{State: eval.Normal, Labels: data.Labels{"cluster": "prod", "pod": "d"}},
+	}
+
+	testCases := []struct {
+		name     string
+		state    *State
+		all      []*State
+		expected bool
+	}{
+		{
+			name:     "sustained critical alert with a broad blast radius",
+			state:    critical,
+			all:      all,
+			expected: true,
+		},
+		{
+			name:     "warning alert",
+			state:    firing(time.Hour, data.Labels{SeverityLabel: "warning", "cluster": "prod"}),
+			all:      all,
+			expected: false,
+		},
+		{
+			name:     "recently fired critical alert",
+			state:    firing(10*time.Minute, data.Labels{SeverityLabel: "critical", "cluster": "prod"}),
+			all:      all,
+			expected: false,
+		},
+		{
+			name:     "isolated critical alert",
+			state:    critical,
+			all:      all[:2],
+			expected: false,
+		},
+		{
+			name:     "resolved critical alert",
+			state:    &State{State: eval.Normal, StartsAt: evaluationTime, Labels: data.Labels{SeverityLabel: "critical", "cluster": "prod"}},
+			all:      all,
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.state.IsMajorIncident(tc.all, opts, now))
+		})
+	}
+}
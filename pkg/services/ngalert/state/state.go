@@ -1,10 +1,17 @@
 package state
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/common/model"
 
 	"github.com/grafana/grafana/pkg/expr"
 	"github.com/grafana/grafana/pkg/services/ngalert/eval"
@@ -26,6 +33,51 @@ type State struct {
 	Annotations        map[string]string
 	Labels             data.Labels
 	Error              error
+	// AcknowledgedAt is when a firing state was acknowledged, or zero if it is not
+	// acknowledged. Acknowledged states are not re-sent while they keep firing.
+	AcknowledgedAt time.Time
+	// PrePendingStartsAt is the StartsAt of the Normal state before the state became
+	// Pending, while it is Pending. It is only set when the PreservePrePendingStartsAt
+	// option of the Manager is enabled.
+	PrePendingStartsAt time.Time
+	// LastError is the message of the last error of a state that recovered from Error,
+	// until it is Error again. It is only set when the RetainLastError option of the
+	// Manager is enabled.
+	LastError string
+	// AnnotationsChangedAt is the time of the latest evaluation at which the annotations
+	// of the rule expanded differently for the state. It is only set when the ResendOnAnnotationChange option of the
+	// Manager is enabled.
+	AnnotationsChangedAt time.Time
+	// Backfill is true if the state was last processed from backfilled results. Such
+	// states build history but are not sent.
+	Backfill bool
+	// Paused is true if the rule of the state was paused since the state was last
+	// processed. See Pause.
+	Paused bool
+	// Transitions are the latest changes of the state, oldest first. They are kept
+	// regardless of how Results are trimmed, up to the TransitionBufferSize of the Manager.
+	Transitions []TransitionPoint
+	// SendCount is the number of times the state was sent to the Alertmanager.
+	SendCount int
+	// ClearSince is the time of the first of the latest consecutive Normal evaluations
+	// of the state, since when its condition has been clear. It is zero if the latest
+	// evaluation was not Normal. Unlike Results, it is not limited to the retained
+	// evaluations.
+	ClearSince time.Time
+	// Condition is the RefID of the condition of the rule of the state as of its latest
+	// evaluation.
+	Condition string
+	// For is the For of the rule of the state as of its latest evaluation.
+	For time.Duration
+
+	// fingerprint is the hash of fingerprintLabels, a copy of Labels as they were last
+	// changed with SetLabel or SetLabels. Both are only written by these methods, so
+	// Fingerprint can be called concurrently.
+	fingerprint       uint64
+	fingerprintLabels data.Labels
+	// restored is true if the state was restored from the database when the cache was
+	// warmed, rather than created from an evaluation.
+	restored bool
 }
 
 type Evaluation struct {
@@ -34,10 +86,216 @@ type Evaluation struct {
 	EvaluationString string
 	// Values contains the RefID and value of reduce and math expressions.
 	// It does not contain values for classic conditions as the values
-	// in classic conditions do not have a RefID.
+	// in classic conditions do not have a RefID. It is nil if none of the RefIDs has a
+	// value and CompactNilValues of the Manager is enabled, which reads as empty.
 	Values map[string]*float64
+	// QueriedFrom and QueriedTo are the absolute time range covered by the
+	// queries of the alert rule in this evaluation.
+	QueriedFrom time.Time
+	QueriedTo   time.Time
+	// Annotations are the annotations of the state after this evaluation. They are only
+	// recorded when the AnnotationHistory of the Manager is enabled, and must not be
+	// modified as they can be shared with other evaluations.
+	Annotations map[string]string
+	// OrderedLabels are the labels of the result in the order they were returned by the
+	// datasource. They are only recorded when PreserveLabelOrder of the Manager is enabled.
+	OrderedLabels []KV
+	// DroppedValues is the number of values that were not recorded in Values because the
+	// evaluation captured more RefIDs than MaxEvaluationValues of the Manager.
+	DroppedValues int
+	// ClampedRefIDs are the RefIDs whose values were clamped in the labels and annotations
+	// according to the ValueClamps of the alert rule. Values keeps the values unclamped.
+	ClampedRefIDs []string
+	// ErrorReason is why the evaluation failed. It is only set for evaluations with the
+	// Error state.
+	ErrorReason ErrorReason
+}
+
+// ErrorReason is the category of the error of a failed evaluation.
+type ErrorReason string
+
+const (
+	// ErrorReasonTimeout is the reason of evaluations whose queries timed out.
+	ErrorReasonTimeout ErrorReason = "timeout"
+	// ErrorReasonQuery is the reason of evaluations with queries that the datasource
+	// failed to run.
+	ErrorReasonQuery ErrorReason = "query"
+	// ErrorReasonOther is the reason of evaluations that failed for any other reason,
+	// such as invalid expressions.
+	ErrorReasonOther ErrorReason = "other"
+)
+
+// errorReason returns the reason of the error of a failed evaluation.
+func errorReason(err error) ErrorReason {
+	var queryErrors expr.QueryErrors
+	var queryError expr.QueryError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorReasonTimeout
+	case errors.As(err, &queryErrors), errors.As(err, &queryError):
+		return ErrorReasonQuery
+	default:
+		return ErrorReasonOther
+	}
+}
+
+// merge returns the evaluation combined with another evaluation at the same time, such
+// as of queries to different datasources. The values of both are kept, with those of
+// other taking precedence, and the state is the most severe of both.
+func (e Evaluation) merge(other Evaluation) Evaluation {
+	merged := e
+	merged.Values = make(map[string]*float64, len(e.Values)+len(other.Values))
+	for k, v := range e.Values {
+		merged.Values[k] = v
+	}
+	for k, v := range other.Values {
+		merged.Values[k] = v
+	}
+	if stateSeverity[other.EvaluationState] > stateSeverity[e.EvaluationState] {
+		merged.EvaluationState = other.EvaluationState
+	}
+	switch {
+	case merged.EvaluationString == "":
+		merged.EvaluationString = other.EvaluationString
+	case other.EvaluationString != "" && other.EvaluationString != merged.EvaluationString:
+		merged.EvaluationString += ", " + other.EvaluationString
+	}
+	merged.DroppedValues += other.DroppedValues
+	switch {
+	case merged.EvaluationState != eval.Error:
+		merged.ErrorReason = ""
+	case merged.ErrorReason == "":
+		merged.ErrorReason = other.ErrorReason
+	}
+	if len(other.ClampedRefIDs) > 0 {
+		merged.ClampedRefIDs = append(append([]string(nil), e.ClampedRefIDs...), other.ClampedRefIDs...)
+		sort.Strings(merged.ClampedRefIDs)
+	}
+	if other.QueriedFrom.Before(merged.QueriedFrom) {
+		merged.QueriedFrom = other.QueriedFrom
+	}
+	if other.QueriedTo.After(merged.QueriedTo) {
+		merged.QueriedTo = other.QueriedTo
+	}
+	return merged
+}
+
+// StateSummary is a compact summary of a state for API responses, without its Results.
+type StateSummary struct {
+	AlertRuleUID string            `json:"alertRuleUid"`
+	State        string            `json:"state"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	Labels       map[string]string `json:"labels"`
+	// Evaluations is the number of retained Results, and Alerting and Errors the number
+	// of them that are Alerting and Error.
+	Evaluations int `json:"evaluations"`
+	Alerting    int `json:"alerting"`
+	Errors      int `json:"errors"`
+}
+
+// Summary returns the summary of the state. The labels of the summary exclude internal
+// labels, such as the UID of the rule, whose names start and end with "__".
+func (a *State) Summary() StateSummary {
+	summary := StateSummary{
+		AlertRuleUID: a.AlertRuleUID,
+		State:        a.State.String(),
+		StartsAt:     a.StartsAt,
+		EndsAt:       a.EndsAt,
+		Labels:       make(map[string]string, len(a.Labels)),
+		Evaluations:  len(a.Results),
+	}
+	for k, v := range a.Labels {
+		if strings.HasPrefix(k, "__") && strings.HasSuffix(k, "__") {
+			continue
+		}
+		summary.Labels[k] = v
+	}
+	for _, r := range a.Results {
+		switch r.EvaluationState {
+		case eval.Alerting:
+			summary.Alerting++
+		case eval.Error:
+			summary.Errors++
+		}
+	}
+	return summary
+}
+
+// AnnotationHistory configures whether the annotations of a state are recorded with each
+// evaluation in its Results.
+type AnnotationHistory int
+
+const (
+	// AnnotationHistoryNone does not record annotations.
+	AnnotationHistoryNone AnnotationHistory = iota
+	// AnnotationHistoryFull records a copy of the annotations with each evaluation.
+	AnnotationHistoryFull
+	// AnnotationHistoryCompact records the annotations like AnnotationHistoryFull, but
+	// evaluations whose annotations are unchanged share those of the previous evaluation.
+	AnnotationHistoryCompact
+)
+
+// OutOfOrderResults configures how results evaluated before the last evaluation of
+// their state are processed, such as results of retries or backfills.
+type OutOfOrderResults int
+
+const (
+	// OutOfOrderProcess processes results as they arrive.
+	OutOfOrderProcess OutOfOrderResults = iota
+	// OutOfOrderReject discards results evaluated before the last evaluation.
+	OutOfOrderReject
+	// OutOfOrderReorder records results evaluated before the last evaluation in Results
+	// in order of evaluation, without changing the state.
+	OutOfOrderReorder
+)
+
+// PausePolicy configures what happens to the active alerts of a rule when it is paused.
+type PausePolicy int
+
+const (
+	// PauseKeep keeps the alerts as they are. Firing alerts resolve by themselves once
+	// their EndsAt passes.
+	PauseKeep PausePolicy = iota
+	// PauseResolve resolves the alerts, so they are cleared downstream right away.
+	PauseResolve
+)
+
+// Pause marks the state as paused at the given time, and resolves it if the policy is
+// PauseResolve.
+func (a *State) Pause(policy PausePolicy, at time.Time) {
+	a.Paused = true
+	if policy != PauseResolve || a.State == eval.Normal {
+		return
+	}
+	a.resolve(at)
+}
+
+// resolve resolves the state at the given time outside of an evaluation of its result,
+// such as when its rule is paused. LastEvaluationTime is set to the time, as the send
+// policy is measured from it, and active states are marked Resolved so they are sent.
+func (a *State) resolve(at time.Time) {
+	a.Resolved = a.IsActive()
+	a.State = eval.Normal
+	a.StartsAt = at
+	a.EndsAt = at
+	a.LastEvaluationTime = at
+	delete(a.Annotations, ngModels.WillFireAtAnnotation)
+}
+
+// insertResult inserts the evaluation in Results in order of evaluation time.
+func (a *State) insertResult(e Evaluation) {
+	i := sort.Search(len(a.Results), func(i int) bool {
+		return a.Results[i].EvaluationTime.After(e.EvaluationTime)
+	})
+	a.Results = append(a.Results, Evaluation{})
+	copy(a.Results[i+1:], a.Results[i:])
+	a.Results[i] = e
 }
 
+// ErrDuplicateRefID is the error for a result that captured more than one value for the same RefID.
+var ErrDuplicateRefID = errors.New("values captured more than once for the same RefID")
+
 // NewEvaluationValues returns the labels and values for each RefID in the capture.
 func NewEvaluationValues(m map[string]eval.NumberValueCapture) map[string]*float64 {
 	result := make(map[string]*float64, len(m))
@@ -47,14 +305,204 @@ func NewEvaluationValues(m map[string]eval.NumberValueCapture) map[string]*float
 	return result
 }
 
+// compactValues returns nil if none of the values is set, so that evaluations without
+// values do not keep a map. Otherwise, it returns the values.
+func compactValues(values map[string]*float64) map[string]*float64 {
+	for _, v := range values {
+		if v != nil {
+			return values
+		}
+	}
+	return nil
+}
+
+// clampedRefIDs returns the RefIDs, in sorted order, whose values are outside of their
+// range in clamps.
+func clampedRefIDs(clamps map[string]ngModels.ValueClamp, values map[string]*float64) []string {
+	var clamped []string
+	for refID, clamp := range clamps {
+		if v := values[refID]; v != nil {
+			if _, ok := clamp.Clamp(*v); ok {
+				clamped = append(clamped, refID)
+			}
+		}
+	}
+	sort.Strings(clamped)
+	return clamped
+}
+
+// capValues returns the values of the first max RefIDs in sorted order, so the same
+// RefIDs are kept on each evaluation, and the number of values that were dropped.
+func capValues(values map[string]*float64, max int) (map[string]*float64, int) {
+	if len(values) <= max {
+		return values, 0
+	}
+	refIDs := make([]string, 0, len(values))
+	for k := range values {
+		refIDs = append(refIDs, k)
+	}
+	sort.Strings(refIDs)
+	capped := make(map[string]*float64, max)
+	for _, k := range refIDs[:max] {
+		capped[k] = values[k]
+	}
+	return capped, len(values) - max
+}
+
+// duplicateRefIDs returns the sorted RefIDs that were captured more than once. The
+// duplicates are stored under disambiguated keys that are different from their RefID.
+func duplicateRefIDs(m map[string]eval.NumberValueCapture) []string {
+	seen := make(map[string]struct{})
+	var refIDs []string
+	for k, v := range m {
+		if k == v.Var {
+			continue
+		}
+		if _, ok := seen[v.Var]; !ok {
+			seen[v.Var] = struct{}{}
+			refIDs = append(refIDs, v.Var)
+		}
+	}
+	sort.Strings(refIDs)
+	return refIDs
+}
+
+// queryTimeRange returns the absolute time range covered by the queries of the alert
+// rule when evaluated at evaluatedAt. Expressions are ignored as they do not query
+// a time range. Both times are zero if the rule has no queries.
+func queryTimeRange(alertRule *ngModels.AlertRule, evaluatedAt time.Time) (from, to time.Time) {
+	for _, q := range alertRule.Data {
+		if expr.IsDataSource(q.DatasourceUID) {
+			continue
+		}
+		tr := q.RelativeTimeRange.ToTimeRange(evaluatedAt)
+		if from.IsZero() || tr.From.Before(from) {
+			from = tr.From
+		}
+		if to.IsZero() || tr.To.After(to) {
+			to = tr.To
+		}
+	}
+	return from, to
+}
+
+// FiringTimeRange returns the time range queried by the evaluation that caused the
+// state to fire, so the queries can be re-run as they were at fire time. Both times
+// are zero if the state is not Alerting or the evaluation is no longer retained.
+func (a *State) FiringTimeRange() (from, to time.Time) {
+	if a.State != eval.Alerting {
+		return time.Time{}, time.Time{}
+	}
+	for _, r := range a.Results {
+		if r.EvaluationTime.Equal(a.StartsAt) {
+			return r.QueriedFrom, r.QueriedTo
+		}
+	}
+	return time.Time{}, time.Time{}
+}
+
+// TransitioningEvaluation returns the evaluation that caused the state to enter its
+// current value, which is the evaluation at StartsAt. It returns nil if the evaluation
+// is no longer retained. See AlertRule.PinTransitioningEvaluation.
+func (a *State) TransitioningEvaluation() *Evaluation {
+	if i := a.transitioningIndex(a.Results); i >= 0 {
+		e := a.Results[i]
+		return &e
+	}
+	return nil
+}
+
+// transitioningIndex returns the index of the evaluation at StartsAt in results, or -1
+// if there is none.
+func (a *State) transitioningIndex(results []Evaluation) int {
+	for i, r := range results {
+		if r.EvaluationTime.Equal(a.StartsAt) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValueSummary returns the values of the latest evaluation as a summary such as
+// "A=87, B=12", sorted by RefID. Each value is formatted with format, or as the
+// shortest representation if format is empty. Missing values are shown as NaN.
+func (a *State) ValueSummary(format string) string {
+	if len(a.Results) == 0 {
+		return ""
+	}
+	values := a.Results[len(a.Results)-1].Values
+
+	refIDs := make([]string, 0, len(values))
+	for refID := range values {
+		refIDs = append(refIDs, refID)
+	}
+	sort.Strings(refIDs)
+
+	parts := make([]string, 0, len(refIDs))
+	for _, refID := range refIDs {
+		v := values[refID]
+		switch {
+		case v == nil:
+			parts = append(parts, refID+"=NaN")
+		case format == "":
+			parts = append(parts, refID+"="+strconv.FormatFloat(*v, 'f', -1, 64))
+		default:
+			parts = append(parts, refID+"="+fmt.Sprintf(format, *v))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
 func (a *State) resultNormal(alertRule *ngModels.AlertRule, result eval.Result) {
 	a.Error = result.Error // should be nil since state is not error
 
+	if a.State == eval.Alerting && result.EvaluatedAt.Sub(a.StartsAt) < alertRule.MinMaturityBeforeResolve {
+		// The alert has not been firing long enough to resolve, so it keeps firing.
+		a.setEndsAt(alertRule, result)
+		return
+	}
+
+	if a.State == eval.Alerting && result.EvaluatedAt.Sub(a.clearSinceOr(result.EvaluatedAt)) < alertRule.MinResolvedDwell {
+		// The condition has not been clear long enough to resolve, so the alert keeps firing.
+		a.setEndsAt(alertRule, result)
+		return
+	}
+
 	if a.State != eval.Normal {
 		a.EndsAt = result.EvaluatedAt
 		a.StartsAt = result.EvaluatedAt
 	}
 	a.State = eval.Normal
+	delete(a.Annotations, ngModels.WillFireAtAnnotation)
+}
+
+// recordTransition records the change of the state in Transitions, dropping the oldest
+// transitions beyond size.
+func (a *State) recordTransition(p TransitionPoint, size int) {
+	if len(a.Transitions) >= size {
+		// Shift in place rather than reslicing, so the buffer does not grow.
+		n := copy(a.Transitions, a.Transitions[len(a.Transitions)-size+1:])
+		a.Transitions = a.Transitions[:n]
+	}
+	a.Transitions = append(a.Transitions, p)
+}
+
+// recordClear updates ClearSince with the state of the evaluation at the given time.
+func (a *State) recordClear(state eval.State, at time.Time) {
+	switch {
+	case state != eval.Normal:
+		a.ClearSince = time.Time{}
+	case a.ClearSince.IsZero():
+		a.ClearSince = at
+	}
+}
+
+// clearSinceOr returns ClearSince, or at if the condition of the state is not clear.
+func (a *State) clearSinceOr(at time.Time) time.Time {
+	if a.ClearSince.IsZero() {
+		return at
+	}
+	return a.ClearSince
 }
 
 func (a *State) resultAlerting(alertRule *ngModels.AlertRule, result eval.Result) {
@@ -79,11 +527,29 @@ func (a *State) resultAlerting(alertRule *ngModels.AlertRule, result eval.Result
 			a.State = eval.Pending
 		}
 	}
+
+	if alertRule.AnnotateWillFireAt && a.State == eval.Pending {
+		if a.Annotations == nil {
+			a.Annotations = make(map[string]string)
+		}
+		a.Annotations[ngModels.WillFireAtAnnotation] = a.FiringETA(alertRule).Format(time.RFC3339)
+	} else {
+		delete(a.Annotations, ngModels.WillFireAtAnnotation)
+	}
 }
 
 func (a *State) resultError(alertRule *ngModels.AlertRule, result eval.Result) {
+	if alertRule.ExecErrState == ngModels.OkErrState {
+		// Errors are treated as OK, which also clears a state that entered
+		// Error before the rule was changed to this configuration.
+		a.resultNormal(alertRule, result)
+		return
+	}
+
 	a.Error = result.Error
 
+	// A state that goes from NoData to Error keeps StartsAt, the time data stopped,
+	// as it is not zero.
 	if a.StartsAt.IsZero() {
 		a.StartsAt = result.EvaluatedAt
 	}
@@ -98,18 +564,84 @@ func (a *State) resultError(alertRule *ngModels.AlertRule, result eval.Result) {
 		// update the state with the Datasource UID as a label and the error
 		// message as an annotation so other code can use this metadata to
 		// add context to alerts
+		var queryErrors expr.QueryErrors
 		var queryError expr.QueryError
-		if errors.As(a.Error, &queryError) {
+		if errors.As(a.Error, &queryErrors) {
+			a.setErrorAnnotation(queryErrorsMessage(queryErrors, alertRule.DeduplicateErrors))
+		} else if errors.As(a.Error, &queryError) {
 			for _, next := range alertRule.Data {
 				if next.RefID == queryError.RefID {
-					a.Labels["ref_id"] = next.RefID
-					a.Labels["datasource_uid"] = next.DatasourceUID
+					a.SetLabel("ref_id", next.RefID)
+					a.SetLabel("datasource_uid", next.DatasourceUID)
 					break
 				}
 			}
-			a.Annotations["Error"] = queryError.Error()
+			a.setErrorAnnotation(queryError.Error())
+		} else if a.Error != nil {
+			a.setErrorAnnotation(a.Error.Error())
+		}
+	}
+}
+
+// resultFrozen keeps the state as it is, such as during a datasource outage. A firing
+// alert keeps firing until the state is no longer frozen.
+func (a *State) resultFrozen(alertRule *ngModels.AlertRule, result eval.Result) {
+	if a.IsActive() {
+		a.setEndsAt(alertRule, result)
+	}
+}
+
+// retainLastError keeps the error of a state that recovered from Error in LastError and
+// in the LastErrorAnnotation, for post-mortems.
+func (a *State) retainLastError(oldState eval.State, oldErr error) {
+	switch {
+	case a.State == eval.Error:
+		a.LastError = ""
+	case oldState == eval.Error && oldErr != nil:
+		a.LastError = oldErr.Error()
+	}
+	if a.LastError == "" {
+		return
+	}
+	if a.Annotations == nil {
+		a.Annotations = make(map[string]string)
+	}
+	a.Annotations[ngModels.LastErrorAnnotation] = a.LastError
+}
+
+// queryErrorsMessage returns the message of the errors of several queries. If deduplicate
+// is true, errors with the same message are combined into one message with the RefIDs
+// of all of them, in the order the messages first appear.
+func queryErrorsMessage(queryErrors expr.QueryErrors, deduplicate bool) string {
+	if !deduplicate {
+		return queryErrors.Error()
+	}
+	var messages []string
+	refIDs := make(map[string][]string)
+	for _, e := range queryErrors {
+		message := e.Err.Error()
+		if _, ok := refIDs[message]; !ok {
+			messages = append(messages, message)
 		}
+		refIDs[message] = append(refIDs[message], e.RefID)
+	}
+	for i, message := range messages {
+		if ids := refIDs[message]; len(ids) > 1 {
+			messages[i] = fmt.Sprintf("failed to execute queries %s: %s", strings.Join(ids, ", "), message)
+		} else {
+			messages[i] = expr.QueryError{RefID: ids[0], Err: errors.New(message)}.Error()
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// setErrorAnnotation sets the Error annotation to the message of the latest error,
+// so it is up to date each time the state is re-sent.
+func (a *State) setErrorAnnotation(message string) {
+	if a.Annotations == nil {
+		a.Annotations = make(map[string]string)
 	}
+	a.Annotations["Error"] = message
 }
 
 func (a *State) resultNoData(alertRule *ngModels.AlertRule, result eval.Result) {
@@ -120,6 +652,10 @@ func (a *State) resultNoData(alertRule *ngModels.AlertRule, result eval.Result)
 	}
 	a.setEndsAt(alertRule, result)
 
+	if a.State == eval.Alerting && alertRule.KeepFiringOnNoData {
+		return
+	}
+
 	switch alertRule.NoDataState {
 	case ngModels.Alerting:
 		a.State = eval.Alerting
@@ -130,39 +666,782 @@ func (a *State) resultNoData(alertRule *ngModels.AlertRule, result eval.Result)
 	}
 }
 
-func (a *State) NeedsSending(resendDelay time.Duration) bool {
-	if a.State == eval.Pending || a.State == eval.Normal && !a.Resolved {
+// ResendDelayResolver returns the resend delay to use for a state with the given labels.
+// It allows noisy, low-priority alerts to be re-sent less often than critical ones.
+type ResendDelayResolver func(labels data.Labels) time.Duration
+
+// SendPolicy configures when states are sent to the Alertmanager.
+type SendPolicy struct {
+	// ResendDelay returns how long to wait before a state is sent again. The delays
+	// below take precedence over it, in the order they are listed.
+	ResendDelay ResendDelayResolver
+	// StateResendDelay, if set, returns the resend delay of a state, such as one set for
+	// its rule. It takes precedence over the other delays unless it returns zero.
+	StateResendDelay ResendDelayResolver
+	// OrgResendDelays are the default resend delays of organizations. They are used
+	// instead of NoDataResendDelay and ResendDelay for the states of the organizations
+	// they are set for.
+	OrgResendDelays map[int64]time.Duration
+	// NoDataResendDelay, if not zero, is used instead of ResendDelay for NoData states.
+	NoDataResendDelay time.Duration
+	// SuppressionWindows are the windows of time during which matching states are not sent.
+	SuppressionWindows []SuppressionWindow
+	// ResolveCoalesceWindow, if set, is how long a state must stay resolved before it is
+	// sent as resolved, so a flapping alert sends a single resolve when it stops flapping.
+	ResolveCoalesceWindow time.Duration
+	// AckTTL, if set, is how long an acknowledgement lasts. Acknowledged states are
+	// re-sent once it expires. Acknowledgements do not expire if it is zero.
+	AckTTL time.Duration
+	// MaxEvaluationLag, if set, is how long before Now the last evaluation of a state
+	// can be for it to be re-sent. Resends of states whose evaluation lags further
+	// behind are held until it catches up.
+	MaxEvaluationLag time.Duration
+	// Predicates, if set, decide whether the states of the rules they are set for need
+	// sending, instead of the policy.
+	Predicates map[ngModels.AlertRuleKey]SendPredicate
+	// LatestValues sends states with the values of their latest evaluation instead of
+	// their oldest retained evaluation.
+	LatestValues bool
+	// OnAnnotationChange re-sends active states on the evaluation at which their
+	// annotations changed, regardless of the resend delay.
+	OnAnnotationChange bool
+	// Now returns the current time. It is required if MaxEvaluationLag or Predicates
+	// are set.
+	Now func() time.Time
+}
+
+// SendPredicate returns true if the state should be sent to the Alertmanager, given the
+// resend delay of the state and the current time.
+type SendPredicate func(s *State, resendDelay time.Duration, now time.Time) bool
+
+// resendDelay returns the resend delay of the state according to the policy.
+func (policy SendPolicy) resendDelay(a *State) time.Duration {
+	if policy.StateResendDelay != nil {
+		if delay := policy.StateResendDelay(a.Labels); delay != 0 {
+			return delay
+		}
+	}
+	if delay, ok := policy.OrgResendDelays[a.OrgID]; ok {
+		return delay
+	}
+	if a.State == eval.NoData && policy.NoDataResendDelay != 0 {
+		return policy.NoDataResendDelay
+	}
+	return policy.ResendDelay(a.Labels)
+}
+
+// NeedsSending returns true if the state should be sent to the Alertmanager
+// according to the policy.
+func (a *State) NeedsSending(policy SendPolicy) bool {
+	return a.needsSendingAt(policy, a.LastEvaluationTime)
+}
+
+// needsSendingAt is NeedsSending at the time at rather than at the last evaluation of
+// the state, such as to know whether a state needs sending between evaluations.
+func (a *State) needsSendingAt(policy SendPolicy, at time.Time) bool {
+	if predicate := policy.Predicates[ngModels.AlertRuleKey{OrgID: a.OrgID, UID: a.AlertRuleUID}]; predicate != nil {
+		return predicate(a, policy.resendDelay(a), policy.Now())
+	}
+	if a.Backfill || a.State == eval.Pending || a.State == eval.Normal && !a.Resolved {
+		return false
+	}
+	for _, w := range policy.SuppressionWindows {
+		if w.Suppresses(a.Labels, at) {
+			return false
+		}
+	}
+	if a.State != eval.Normal && a.acknowledged(policy.AckTTL) {
+		return false
+	}
+	if a.State == eval.Normal && at.Sub(a.StartsAt) < policy.ResolveCoalesceWindow {
 		return false
 	}
+	if a.LastSentAt.IsZero() {
+		// The state has not been sent since it was created or restored, so it is sent
+		// regardless of the resend delay. This includes resolved states, so that alerts
+		// restored after a restart are resolved in the Alertmanager.
+		return true
+	}
+	if policy.OnAnnotationChange && a.IsActive() && a.AnnotationsChangedAt.Equal(a.LastEvaluationTime) && a.LastSentAt.Before(a.LastEvaluationTime) {
+		return true
+	}
+	if policy.MaxEvaluationLag > 0 && a.State != eval.Normal && policy.Now().Sub(a.LastEvaluationTime) > policy.MaxEvaluationLag {
+		return false
+	}
+	delay := policy.resendDelay(a)
 	// if LastSentAt is before or equal to LastEvaluationTime + resendDelay, send again
-	nextSent := a.LastSentAt.Add(resendDelay)
-	return nextSent.Before(a.LastEvaluationTime) || nextSent.Equal(a.LastEvaluationTime)
+	nextSent := a.LastSentAt.Add(delay)
+	return nextSent.Before(at) || nextSent.Equal(at)
+}
+
+// nextSendTime returns the earliest time from the time from at which the state needs
+// sending according to the policy, as in needsSendingAt, if it is not evaluated again.
+// The times checked are from and the times at which the resend delay of the state, the
+// ResolveCoalesceWindow and the SuppressionWindows of the policy end. It returns zero
+// if the state does not need sending at any of them.
+func (a *State) nextSendTime(policy SendPolicy, from time.Time) time.Time {
+	candidates := []time.Time{from, a.LastSentAt.Add(policy.resendDelay(a))}
+	if a.State == eval.Normal && policy.ResolveCoalesceWindow > 0 {
+		candidates = append(candidates, a.StartsAt.Add(policy.ResolveCoalesceWindow))
+	}
+	midnight := from.UTC().Truncate(24 * time.Hour)
+	for _, w := range policy.SuppressionWindows {
+		// The window ends today or tomorrow, if it spans midnight or already ended today.
+		candidates = append(candidates, midnight.Add(w.End), midnight.Add(24*time.Hour+w.End))
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Before(candidates[j])
+	})
+	for _, c := range candidates {
+		if !c.Before(from) && a.needsSendingAt(policy, c) {
+			return c
+		}
+	}
+	return time.Time{}
+}
+
+// MarkSent records that the state was sent to the Alertmanager at the given time.
+func (a *State) MarkSent(at time.Time) {
+	a.LastSentAt = at
+	a.SendCount++
+}
+
+// IsActive returns true if the state is sent to the Alertmanager as a firing alert, that
+// is if it is Alerting, NoData or Error.
+func (a *State) IsActive() bool {
+	return a.State == eval.Alerting || a.State == eval.NoData || a.State == eval.Error
+}
+
+// IsActiveIncludingPending returns true if the state is active or Pending, such as for
+// views of issues in progress that include alerts that are about to fire.
+func (a *State) IsActiveIncludingPending() bool {
+	return a.IsActive() || a.State == eval.Pending
+}
+
+// IsNewSeries returns true if the state has been evaluated once, such as for a series
+// that has not been seen before. Notifications of new series can be made quieter.
+func (a *State) IsNewSeries() bool {
+	return len(a.Results) == 1
+}
+
+// NotificationBudgetUsed returns the fraction of the notification budget, the number
+// of times the state can be sent, that the state has used. It is greater than 1 if
+// the budget is exceeded, and zero if there is no budget.
+func (a *State) NotificationBudgetUsed(budget int) float64 {
+	if budget <= 0 {
+		return 0
+	}
+	return float64(a.SendCount) / float64(budget)
+}
+
+// Acknowledge acknowledges the state at the given time, so it is not re-sent while it
+// keeps firing.
+func (a *State) Acknowledge(at time.Time) {
+	a.AcknowledgedAt = at
+}
+
+// acknowledged returns true if the state is acknowledged and the acknowledgement has
+// not expired at the time of the last evaluation.
+func (a *State) acknowledged(ttl time.Duration) bool {
+	if a.AcknowledgedAt.IsZero() {
+		return false
+	}
+	return ttl == 0 || a.LastEvaluationTime.Sub(a.AcknowledgedAt) < ttl
+}
+
+// SendAction is the action needed to bring the Alertmanager up to date with a state.
+type SendAction int
+
+const (
+	// SendNone means nothing needs to be sent.
+	SendNone SendAction = iota
+	// SendFiring means the state needs to be sent as a firing alert.
+	SendFiring
+	// SendResolve means the state needs to be sent as a resolved alert.
+	SendResolve
+)
+
+func (s SendAction) String() string {
+	switch s {
+	case SendFiring:
+		return "SendFiring"
+	case SendResolve:
+		return "SendResolve"
+	default:
+		return "SendNone"
+	}
+}
+
+// PendingSendAction returns the action needed at the time now for the state, so the
+// scheduler can drive sends declaratively. A state is sent if it needs sending at now
+// according to the policy, as in NeedsSending, so the resend delays of its rule and
+// organization apply.
+func (a *State) PendingSendAction(policy SendPolicy, now time.Time) SendAction {
+	if !a.needsSendingAt(policy, now) {
+		return SendNone
+	}
+	if a.State == eval.Normal {
+		return SendResolve
+	}
+	return SendFiring
+}
+
+// ReconcileAction is the action needed to reconcile a state with the alert of an
+// external Alertmanager.
+type ReconcileAction int
+
+const (
+	// ReconcileSkip means the Alertmanager is up to date with the state.
+	ReconcileSkip ReconcileAction = iota
+	// ReconcileResend means the state needs to be sent as a firing alert.
+	ReconcileResend
+	// ReconcileResolve means the alert needs to be resolved in the Alertmanager.
+	ReconcileResolve
+)
+
+func (r ReconcileAction) String() string {
+	switch r {
+	case ReconcileResend:
+		return "ReconcileResend"
+	case ReconcileResolve:
+		return "ReconcileResolve"
+	default:
+		return "ReconcileSkip"
+	}
+}
+
+// Reconcile returns the action needed to reconcile the local state with the alert of an
+// external Alertmanager, such as on startup to avoid sending alerts that are already
+// active in the Alertmanager again. remoteActive is true if the alert is active in the
+// Alertmanager, until remoteEndsAt. An active alert is resent only if it would resolve
+// in the Alertmanager before the state ends.
+func Reconcile(local *State, remoteEndsAt time.Time, remoteActive bool) ReconcileAction {
+	localActive := local.IsActive()
+	switch {
+	case localActive && (!remoteActive || remoteEndsAt.Before(local.EndsAt)):
+		return ReconcileResend
+	case !localActive && remoteActive:
+		return ReconcileResolve
+	default:
+		return ReconcileSkip
+	}
+}
+
+// ExpectedResolveSendTime returns when the resolve notification of a resolved state
+// is expected to be sent according to the policy, as in NeedsSending. This is the time
+// of the evaluation that resolved the state if it needs sending then, and otherwise
+// the time it does, such as once the resend delay of the state has passed since it was
+// last sent. It returns zero if the state is not resolved, or if it is not expected to
+// be sent before it is evaluated again.
+func (a *State) ExpectedResolveSendTime(policy SendPolicy) time.Time {
+	if a.State != eval.Normal || !a.Resolved {
+		return time.Time{}
+	}
+	return a.nextSendTime(policy, a.LastEvaluationTime)
+}
+
+// resendTime returns when the state is resent according to the policy, if it is not
+// evaluated again: when its resend delay has passed since it was last sent, or later
+// once it is no longer held back, such as by a suppression window.
+func (a *State) resendTime(policy SendPolicy) time.Time {
+	resendAt := a.LastSentAt.Add(policy.resendDelay(a))
+	if next := a.nextSendTime(policy, resendAt); !next.IsZero() {
+		return next
+	}
+	return resendAt
+}
+
+// TimeToResend returns how long after now the state is resent according to the
+// policy, after which NeedsSending returns true for states that are sent. It is zero
+// if the state is due and negative if it is overdue.
+func (a *State) TimeToResend(policy SendPolicy, now time.Time) time.Duration {
+	return a.resendTime(policy).Sub(now)
+}
+
+// NextDecisionTime returns the next time at which a decision about the state changes,
+// for event-driven scheduling: when a Pending state fires if its condition persists,
+// when a state that is sent is resent according to the policy, as in TimeToResend, or
+// when an active alert resolves by itself at EndsAt, whichever is soonest. It returns
+// now if a decision is due, and zero if no decision changes over time, such as for a
+// Normal state that is not resolved.
+func (a *State) NextDecisionTime(policy SendPolicy, alertRule *ngModels.AlertRule, now time.Time) time.Time {
+	var candidates []time.Time
+	switch a.State {
+	case eval.Pending:
+		candidates = append(candidates, a.FiringETA(alertRule))
+	case eval.Alerting, eval.NoData, eval.Error:
+		candidates = append(candidates, a.resendTime(policy), a.EndsAt)
+	case eval.Normal:
+		if a.Resolved {
+			candidates = append(candidates, a.resendTime(policy))
+		}
+	}
+	var next time.Time
+	for _, c := range candidates {
+		if next.IsZero() || c.Before(next) {
+			next = c
+		}
+	}
+	if !next.IsZero() && next.Before(now) {
+		return now
+	}
+	return next
+}
+
+// FiringETA returns the time at which a Pending state fires if its condition persists,
+// that is StartsAt plus the For of the rule. It returns zero if the state is not Pending.
+func (a *State) FiringETA(alertRule *ngModels.AlertRule) time.Time {
+	if a.State != eval.Pending {
+		return time.Time{}
+	}
+	return a.StartsAt.Add(alertRule.For)
+}
+
+// EscalationSchedule returns the time at which a firing state reaches each of the
+// thresholds, that is how long it must have been firing to escalate to each level.
+// It returns nil if the state is not Alerting.
+func (a *State) EscalationSchedule(thresholds []time.Duration) []time.Time {
+	if a.State != eval.Alerting {
+		return nil
+	}
+	schedule := make([]time.Time, 0, len(thresholds))
+	for _, t := range thresholds {
+		schedule = append(schedule, a.StartsAt.Add(t))
+	}
+	return schedule
+}
+
+// NotificationLatency returns the time from the evaluation at which the state started
+// firing until it was sent. LastSentAt is updated each time the state is re-sent, so it
+// is the latency of the first notification only until the state is re-sent. It returns
+// zero if the state is not Alerting or has not been sent since it started firing.
+func (a *State) NotificationLatency() time.Duration {
+	if a.State != eval.Alerting || a.LastSentAt.Before(a.StartsAt) {
+		return 0
+	}
+	return a.LastSentAt.Sub(a.StartsAt)
+}
+
+// TimeToAcknowledge returns how long a firing state was firing before it was
+// acknowledged, for on-call metrics. It returns zero if the state is not Alerting, is not
+// acknowledged, or was acknowledged before it started firing.
+func (a *State) TimeToAcknowledge() time.Duration {
+	if a.State != eval.Alerting || a.AcknowledgedAt.Before(a.StartsAt) {
+		return 0
+	}
+	return a.AcknowledgedAt.Sub(a.StartsAt)
+}
+
+// Fingerprint returns a hash of the labels of the state. The hash is computed when
+// the labels are changed with SetLabel or SetLabels. It is computed again, but not
+// stored, if the labels were not set with them or were changed directly since.
+func (a *State) Fingerprint() uint64 {
+	if a.fingerprintLabels != nil && labelsEqual(a.Labels, a.fingerprintLabels) {
+		return a.fingerprint
+	}
+	return labelsFingerprint(a.Labels)
+}
+
+// SetLabels replaces the labels of the state.
+func (a *State) SetLabels(labels data.Labels) {
+	a.Labels = labels
+	a.updateFingerprint()
+}
+
+// SetLabel sets the value of a label of the state.
+func (a *State) SetLabel(name, value string) {
+	if a.Labels == nil {
+		a.Labels = data.Labels{}
+	}
+	a.Labels[name] = value
+	a.updateFingerprint()
+}
+
+// deleteLabel deletes a label of the state.
+func (a *State) deleteLabel(name string) {
+	if _, ok := a.Labels[name]; ok {
+		delete(a.Labels, name)
+		a.updateFingerprint()
+	}
+}
+
+// updateFingerprint computes the Fingerprint of the current labels of the state.
+func (a *State) updateFingerprint() {
+	a.fingerprintLabels = a.Labels.Copy()
+	a.fingerprint = labelsFingerprint(a.Labels)
+}
+
+// escalate sets the EscalationLabel of a firing state to the severity of the last
+// escalation band of the rule that applies to it, and removes it otherwise.
+func (a *State) escalate(alertRule *ngModels.AlertRule) {
+	severity := ""
+	if a.State == eval.Alerting {
+		firing := a.LastEvaluationTime.Sub(a.StartsAt)
+		for _, band := range alertRule.EscalationBands {
+			if firing < band.After {
+				continue
+			}
+			if band.MinValue != nil {
+				if len(a.Results) == 0 {
+					continue
+				}
+				v := a.Results[len(a.Results)-1].Values[band.RefID]
+				if v == nil || *v < *band.MinValue {
+					continue
+				}
+			}
+			severity = band.Severity
+		}
+	}
+	if severity == "" {
+		a.deleteLabel(ngModels.EscalationLabel)
+		return
+	}
+	if a.Labels[ngModels.EscalationLabel] != severity {
+		a.SetLabel(ngModels.EscalationLabel, severity)
+	}
+}
+
+// PrometheusFingerprint returns the fingerprint of the labels of the state computed
+// like Prometheus and the Prometheus Alertmanager do, to identify the same alert in
+// them. It is different from Fingerprint.
+func (a *State) PrometheusFingerprint() uint64 {
+	ls := make(model.LabelSet, len(a.Labels))
+	for name, value := range a.Labels {
+		ls[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return uint64(ls.Fingerprint())
+}
+
+// labelsFingerprint returns the FNV-1a hash of the sorted names and values of the labels.
+func labelsFingerprint(labels data.Labels) uint64 {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	for _, name := range names {
+		_, _ = h.Write([]byte(name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(labels[name]))
+		_, _ = h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+// labelsEqual returns true if the labels have the same names and values.
+func labelsEqual(a, b data.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if v, ok := b[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
 }
 
 func (a *State) Equals(b *State) bool {
+	return a.EqualsRounded(b, 0)
+}
+
+// EqualsRounded is like Equals, but StartsAt and EndsAt are rounded to the nearest
+// multiple of granularity before they are compared, such as the interval of the rule.
+// This prevents sub-granularity differences from making otherwise equal states differ.
+// The timestamps are compared exactly if granularity is zero.
+func (a *State) EqualsRounded(b *State, granularity time.Duration) bool {
 	return a.AlertRuleUID == b.AlertRuleUID &&
 		a.OrgID == b.OrgID &&
 		a.CacheId == b.CacheId &&
-		a.Labels.String() == b.Labels.String() &&
+		a.Fingerprint() == b.Fingerprint() &&
 		a.State.String() == b.State.String() &&
-		a.StartsAt == b.StartsAt &&
-		a.EndsAt == b.EndsAt &&
+		roundTime(a.StartsAt, granularity) == roundTime(b.StartsAt, granularity) &&
+		roundTime(a.EndsAt, granularity) == roundTime(b.EndsAt, granularity) &&
 		a.LastEvaluationTime == b.LastEvaluationTime &&
 		data.Labels(a.Annotations).String() == data.Labels(b.Annotations).String()
 }
 
-func (a *State) TrimResults(alertRule *ngModels.AlertRule) {
-	numBuckets := 2 * (int64(alertRule.For.Seconds()) / alertRule.IntervalSeconds)
+// roundTime rounds t to the nearest multiple of granularity, or returns it unchanged
+// if granularity is zero.
+func roundTime(t time.Time, granularity time.Duration) time.Time {
+	if granularity <= 0 {
+		return t
+	}
+	return t.Round(granularity)
+}
+
+// setAnnotations replaces the annotations of the state if they differ from the
+// current annotations, so identical annotations are not rewritten on each evaluation.
+// A copy of the annotations is stored, as the annotations of the state are written in
+// place. It returns true if the annotations were changed.
+func (a *State) setAnnotations(annotations map[string]string) bool {
+	if equalAnnotations(a.Annotations, annotations) {
+		return false
+	}
+	a.Annotations = copyAnnotations(annotations)
+	return true
+}
+
+// copyAnnotations returns a copy of the annotations. It is never nil, so annotations
+// can be added to it.
+func copyAnnotations(annotations map[string]string) map[string]string {
+	c := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		c[k] = v
+	}
+	return c
+}
+
+// KV is a key and its value, such as of an annotation.
+type KV struct {
+	Key   string
+	Value string
+}
+
+// orderedLabels returns the labels in the order of their names in order. Labels whose
+// names are not in order follow sorted by name.
+func orderedLabels(labels data.Labels, order []string) []KV {
+	kvs := make([]KV, 0, len(labels))
+	seen := make(map[string]struct{}, len(order))
+	for _, k := range order {
+		v, ok := labels[k]
+		if _, dup := seen[k]; !ok || dup {
+			continue
+		}
+		seen[k] = struct{}{}
+		kvs = append(kvs, KV{Key: k, Value: v})
+	}
+	rest := make([]KV, 0, len(labels)-len(kvs))
+	for k, v := range labels {
+		if _, ok := seen[k]; !ok {
+			rest = append(rest, KV{Key: k, Value: v})
+		}
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		return rest[i].Key < rest[j].Key
+	})
+	return append(kvs, rest...)
+}
+
+// SortedAnnotations returns the annotations of the state sorted by key, so payloads
+// built from them are deterministic.
+func (a *State) SortedAnnotations() []KV {
+	kvs := make([]KV, 0, len(a.Annotations))
+	for k, v := range a.Annotations {
+		kvs = append(kvs, KV{Key: k, Value: v})
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs
+}
+
+// recordAnnotations records the annotations of the state with its latest evaluation.
+func (a *State) recordAnnotations(mode AnnotationHistory) {
+	if mode == AnnotationHistoryNone || len(a.Results) == 0 {
+		return
+	}
+	last := len(a.Results) - 1
+	if mode == AnnotationHistoryCompact && last > 0 {
+		if prev := a.Results[last-1].Annotations; prev != nil && equalAnnotations(prev, a.Annotations) {
+			a.Results[last].Annotations = prev
+			return
+		}
+	}
+	a.Results[last].Annotations = copyAnnotations(a.Annotations)
+}
+
+// equalAnnotations returns true if both maps have the same annotations.
+func equalAnnotations(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if other, ok := b[k]; !ok || other != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ResultArchiver is called with the evaluations that are dropped from the Results of
+// a state, so they can be kept elsewhere.
+type ResultArchiver func([]Evaluation)
+
+// retainedEvaluations returns the number of evaluations kept in Results for the rule.
+func retainedEvaluations(alertRule *ngModels.AlertRule) int64 {
+	if alertRule.IntervalSeconds <= 0 {
+		return 10
+	}
+	// The evaluations in For are rounded up, so that the retained evaluations cover For.
+	interval := time.Duration(alertRule.IntervalSeconds) * time.Second
+	numBuckets := 2 * int64((alertRule.For+interval-1)/interval)
 	if numBuckets == 0 {
 		numBuckets = 10 // keep at least 10 evaluations in the event For is set to 0
 	}
+	return numBuckets
+}
+
+// RetentionWindow returns the time covered by the evaluations kept in Results for the
+// rule, which is at least For if the rule has an interval.
+func RetentionWindow(alertRule *ngModels.AlertRule) time.Duration {
+	return time.Duration(retainedEvaluations(alertRule)-1) * time.Duration(alertRule.IntervalSeconds) * time.Second
+}
+
+// TrimResults drops the oldest evaluations from Results that are no longer needed for
+// the rule. The dropped evaluations are passed to archive, if it is not nil. If the rule
+// pins the transitioning evaluation, it is kept before the retained evaluations.
+func (a *State) TrimResults(alertRule *ngModels.AlertRule, archive ResultArchiver) {
+	numBuckets := retainedEvaluations(alertRule)
 
 	if len(a.Results) < int(numBuckets) {
 		return
 	}
-	newResults := make([]Evaluation, numBuckets)
-	copy(newResults, a.Results[len(a.Results)-int(numBuckets):])
-	a.Results = newResults
+	dropped := a.Results[:len(a.Results)-int(numBuckets)]
+	pinned := -1
+	if alertRule.PinTransitioningEvaluation {
+		pinned = a.transitioningIndex(dropped)
+	}
+	if archive != nil && len(dropped) > 0 {
+		if pinned >= 0 {
+			archive(append(append([]Evaluation(nil), dropped[:pinned]...), dropped[pinned+1:]...))
+		} else {
+			archive(dropped)
+		}
+	}
+	var newResults []Evaluation
+	if pinned >= 0 {
+		newResults = make([]Evaluation, 0, numBuckets+1)
+		newResults = append(newResults, dropped[pinned])
+	} else {
+		newResults = make([]Evaluation, 0, numBuckets)
+	}
+	a.Results = append(newResults, a.Results[len(a.Results)-int(numBuckets):]...)
+}
+
+// IncidentID returns an identifier of the current firing episode of the state, to
+// correlate its notifications. It is derived from the Fingerprint and the time the
+// state started firing, so it is the same for the duration of the episode and
+// different for the next one. It returns an empty string if the state is not Alerting.
+func (a *State) IncidentID() string {
+	if a.State != eval.Alerting {
+		return ""
+	}
+	return fmt.Sprintf("%016x-%d", a.Fingerprint(), a.StartsAt.Unix())
+}
+
+// FiringSincePhrase returns a phrase such as "firing for 2h15m" with how long the state
+// has been firing at now, for notification templates. The duration is rounded down to
+// the two largest units of days, hours, minutes and seconds. It returns an empty string
+// if the state is not Alerting.
+func (a *State) FiringSincePhrase(now time.Time) string {
+	if a.State != eval.Alerting {
+		return ""
+	}
+	d := now.Sub(a.StartsAt)
+	if d < 0 {
+		d = 0
+	}
+	units := []struct {
+		size   time.Duration
+		suffix string
+	}{
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+	}
+	var b strings.Builder
+	parts := 0
+	for _, u := range units {
+		if parts == 2 || (parts == 1 && d < u.size) {
+			break
+		}
+		if n := d / u.size; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.suffix)
+			d -= n * u.size
+			parts++
+		}
+	}
+	if parts == 0 {
+		b.WriteString("0s")
+	}
+	return "firing for " + b.String()
+}
+
+// Reparent moves the state to another organization when its rule is moved. The
+// Results and the other history of the state are kept. The CacheId is computed again
+// from the labels, so labels that depend on the organization, such as the namespace
+// of the rule, must be set with SetLabels first. Use Manager.Reparent to move the
+// states in the cache of the manager.
+func (a *State) Reparent(newOrgID int64) {
+	a.OrgID = newOrgID
+	il := ngModels.InstanceLabels(a.Labels)
+	// The labels are strings, so they can always be encoded into the key.
+	if id, err := il.StringKey(); err == nil {
+		a.CacheId = id
+	}
+}
+
+// AdoptHistory merges the history of old into the state when the state replaces it,
+// such as when a configuration reload creates a new state for the same alert. The
+// evaluations of old are added to Results in order of evaluation time, keeping those of
+// the state at the same times, and the StartsAt of old is kept if it is earlier and both
+// states have the same value. Nothing is adopted if the Fingerprints of the states
+// differ. Results are not trimmed, so the caller should trim them for the rule.
+func (a *State) AdoptHistory(old *State) {
+	if old == nil || old == a || old.Fingerprint() != a.Fingerprint() {
+		return
+	}
+	evaluated := make(map[int64]bool, len(a.Results))
+	for _, r := range a.Results {
+		evaluated[r.EvaluationTime.UnixNano()] = true
+	}
+	for _, r := range old.Results {
+		if !evaluated[r.EvaluationTime.UnixNano()] {
+			a.insertResult(r)
+		}
+	}
+	if old.State == a.State && !old.StartsAt.IsZero() && (a.StartsAt.IsZero() || old.StartsAt.Before(a.StartsAt)) {
+		a.StartsAt = old.StartsAt
+	}
+}
+
+// normalizeResults makes Results that were not produced by this state machine, such
+// as those of migrated rules, consistent with it. It drops evaluations without a time
+// or with the Pending state, which is never the state of an evaluation, sorts the
+// evaluations by time keeping only the last of each time, and trims them for the rule,
+// passing the trimmed evaluations to archive. It returns the number of evaluations
+// that were dropped.
+func (a *State) normalizeResults(alertRule *ngModels.AlertRule, archive ResultArchiver) int {
+	n := len(a.Results)
+	results := make([]Evaluation, 0, len(a.Results))
+	for _, r := range a.Results {
+		if r.EvaluationTime.IsZero() || r.EvaluationState == eval.Pending {
+			continue
+		}
+		results = append(results, r)
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].EvaluationTime.Before(results[j].EvaluationTime)
+	})
+	deduplicated := results[:0]
+	for _, r := range results {
+		if last := len(deduplicated) - 1; last >= 0 && deduplicated[last].EvaluationTime.Equal(r.EvaluationTime) {
+			deduplicated[last] = r
+			continue
+		}
+		deduplicated = append(deduplicated, r)
+	}
+	a.Results = deduplicated
+	a.TrimResults(alertRule, archive)
+	if len(a.Results) > 0 && a.LastEvaluationTime.IsZero() {
+		a.LastEvaluationTime = a.Results[len(a.Results)-1].EvaluationTime
+	}
+	return n - len(a.Results)
 }
 
 // setEndsAt sets the ending timestamp of the alert.
@@ -175,5 +1454,25 @@ func (a *State) setEndsAt(alertRule *ngModels.AlertRule, result eval.Result) {
 		ends = time.Second * time.Duration(alertRule.IntervalSeconds)
 	}
 
-	a.EndsAt = result.EvaluatedAt.Add(ends * 3)
+	multiplier := int64(3)
+	if result.State == eval.Error && alertRule.ExecErrState == ngModels.ErrorErrState && alertRule.ErrorEndsAtMultiplier > 0 {
+		multiplier = alertRule.ErrorEndsAtMultiplier
+	}
+
+	a.EndsAt = result.EvaluatedAt.Add(ends * time.Duration(multiplier))
+}
+
+// capEndsAt sets EndsAt to maxEndsAt if EndsAt is after maxEndsAt.
+func (a *State) capEndsAt(maxEndsAt time.Time) {
+	if a.EndsAt.After(maxEndsAt) {
+		a.EndsAt = maxEndsAt
+	}
+}
+
+// clampEndsAt sets EndsAt to minEndsAt if EndsAt is before minEndsAt, such as when the
+// result was evaluated long before it was processed.
+func (a *State) clampEndsAt(minEndsAt time.Time) {
+	if a.EndsAt.Before(minEndsAt) {
+		a.EndsAt = minEndsAt
+	}
 }
@@ -1,14 +1,25 @@
 package state
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/alertmanager/pkg/labels"
+
+	"github.com/grafana/grafana/pkg/expr"
 	"github.com/grafana/grafana/pkg/services/ngalert/eval"
 	ngmodels "github.com/grafana/grafana/pkg/services/ngalert/models"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	ptr "github.com/xorcare/pointer"
 )
 
 func TestNeedsSending(t *testing.T) {
@@ -144,11 +155,588 @@ func TestNeedsSending(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			assert.Equal(t, tc.expected, tc.testState.NeedsSending(tc.resendDelay))
+			resendDelay := func(data.Labels) time.Duration { return tc.resendDelay }
+			assert.Equal(t, tc.expected, tc.testState.NeedsSending(SendPolicy{ResendDelay: resendDelay}))
+		})
+	}
+}
+
+func TestNeedsSending_ResendDelayResolver(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	resendDelay := func(labels data.Labels) time.Duration {
+		if labels["severity"] == "low" {
+			return 10 * time.Minute
+		}
+		return 1 * time.Minute
+	}
+
+	testCases := []struct {
+		name     string
+		severity string
+		expected bool
+	}{
+		{
+			name:     "critical label value uses the short resend delay",
+			severity: "critical",
+			expected: true,
+		},
+		{
+			name:     "low label value uses the long resend delay",
+			severity: "low",
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{
+				State:              eval.Alerting,
+				Labels:             data.Labels{"severity": tc.severity},
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime.Add(-5 * time.Minute),
+			}
+			assert.Equal(t, tc.expected, s.NeedsSending(SendPolicy{ResendDelay: resendDelay}))
+		})
+	}
+}
+
+func TestNeedsSending_NoDataResendDelay(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	resendDelay := func(data.Labels) time.Duration { return time.Minute }
+
+	testCases := []struct {
+		name              string
+		state             eval.State
+		noDataResendDelay time.Duration
+		sinceLastSent     time.Duration
+		expected          bool
+	}{
+		{
+			name:              "NoData is not re-sent before its own resend delay",
+			state:             eval.NoData,
+			noDataResendDelay: 10 * time.Minute,
+			sinceLastSent:     5 * time.Minute,
+			expected:          false,
+		},
+		{
+			name:              "NoData is re-sent after its own resend delay",
+			state:             eval.NoData,
+			noDataResendDelay: 10 * time.Minute,
+			sinceLastSent:     10 * time.Minute,
+			expected:          true,
+		},
+		{
+			name:              "NoData uses the resend delay when its own resend delay is not set",
+			state:             eval.NoData,
+			noDataResendDelay: 0,
+			sinceLastSent:     5 * time.Minute,
+			expected:          true,
+		},
+		{
+			name:              "Alerting ignores the NoData resend delay",
+			state:             eval.Alerting,
+			noDataResendDelay: 10 * time.Minute,
+			sinceLastSent:     5 * time.Minute,
+			expected:          true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{
+				State:              tc.state,
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime.Add(-tc.sinceLastSent),
+			}
+			assert.Equal(t, tc.expected, s.NeedsSending(SendPolicy{ResendDelay: resendDelay, NoDataResendDelay: tc.noDataResendDelay}))
+		})
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	assert.Equal(t, ErrorReasonTimeout, errorReason(fmt.Errorf("failed to query: %w", context.DeadlineExceeded)))
+	assert.Equal(t, ErrorReasonTimeout, errorReason(expr.QueryError{RefID: "A", Err: context.DeadlineExceeded}))
+	assert.Equal(t, ErrorReasonQuery, errorReason(expr.QueryError{RefID: "A", Err: errors.New("bad gateway")}))
+	assert.Equal(t, ErrorReasonQuery, errorReason(expr.QueryErrors{{RefID: "A", Err: errors.New("bad gateway")}}))
+	assert.Equal(t, ErrorReasonOther, errorReason(errors.New("invalid expression")))
+	assert.Equal(t, ErrorReasonOther, errorReason(nil))
+}
+
+func TestCompactValues(t *testing.T) {
+	t.Run("values without any value are compacted", func(t *testing.T) {
+		assert.Nil(t, compactValues(map[string]*float64{"A": nil, "B": nil}))
+		assert.Nil(t, compactValues(map[string]*float64{}))
+	})
+
+	t.Run("values with a value are kept", func(t *testing.T) {
+		values := map[string]*float64{"A": nil, "B": ptr.Float64(1)}
+		assert.Equal(t, values, compactValues(values))
+	})
+
+	t.Run("compacted values read as empty", func(t *testing.T) {
+		evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+		results := makeResults(evaluationTime, eval.Alerting, eval.Alerting)
+		results[0].Values = compactValues(map[string]*float64{"A": nil})
+		results[1].Values = map[string]*float64{"A": ptr.Float64(2)}
+		s := &State{Results: results}
+
+		assert.Nil(t, s.Results[0].Values["A"])
+		assert.Equal(t, "", (&State{Results: results[:1]}).ValueSummary(""))
+		assert.Equal(t, "A=2", s.ValueSummary(""))
+		merged := results[0].merge(results[1])
+		assert.Equal(t, results[1].Values, merged.Values)
+	})
+}
+
+func TestClampedRefIDs(t *testing.T) {
+	clamps := map[string]ngmodels.ValueClamp{
+		"A": {Min: ptr.Float64(0)},
+		"B": {Max: ptr.Float64(100)},
+		"C": {Min: ptr.Float64(0), Max: ptr.Float64(100)},
+		"D": {Min: ptr.Float64(0)},
+	}
+	values := map[string]*float64{
+		"A": ptr.Float64(-5),
+		"B": ptr.Float64(150),
+		"C": ptr.Float64(50),
+		"D": nil,
+	}
+	assert.Equal(t, []string{"A", "B"}, clampedRefIDs(clamps, values))
+	assert.Nil(t, clampedRefIDs(clamps, map[string]*float64{"C": ptr.Float64(0)}))
+}
+
+func TestNeedsSending_OrgResendDelays(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	resendDelay := func(data.Labels) time.Duration { return time.Minute }
+	orgResendDelays := map[int64]time.Duration{1: 10 * time.Minute}
+
+	testCases := []struct {
+		name          string
+		orgID         int64
+		sinceLastSent time.Duration
+		expected      bool
+	}{
+		{
+			name:          "org default is not re-sent before its resend delay",
+			orgID:         1,
+			sinceLastSent: 5 * time.Minute,
+			expected:      false,
+		},
+		{
+			name:          "org default is re-sent after its resend delay",
+			orgID:         1,
+			sinceLastSent: 10 * time.Minute,
+			expected:      true,
+		},
+		{
+			name:          "org without a default uses the global resend delay",
+			orgID:         2,
+			sinceLastSent: 5 * time.Minute,
+			expected:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{
+				OrgID:              tc.orgID,
+				State:              eval.Alerting,
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime.Add(-tc.sinceLastSent),
+			}
+			assert.Equal(t, tc.expected, s.NeedsSending(SendPolicy{ResendDelay: resendDelay, OrgResendDelays: orgResendDelays}))
+		})
+	}
+
+	t.Run("the resend delay of the rule takes precedence over the org default", func(t *testing.T) {
+		st := &Manager{
+			ResendDelay: time.Minute,
+			// Only the states of the critical rule have their own resend delay.
+			ResendDelayResolver: func(labels data.Labels) time.Duration {
+				if labels[ngmodels.RuleUIDLabel] == "critical" {
+					return 2 * time.Minute
+				}
+				return 0
+			},
+			OrgResendDelays:   orgResendDelays,
+			NoDataResendDelay: 30 * time.Minute,
+			Clock:             clock.New(),
+		}
+
+		testCases := []struct {
+			name          string
+			ruleUID       string
+			orgID         int64
+			state         eval.State
+			sinceLastSent time.Duration
+			expected      bool
+		}{
+			{
+				name:          "rule delay over the org default",
+				ruleUID:       "critical",
+				orgID:         1,
+				state:         eval.Alerting,
+				sinceLastSent: 2 * time.Minute,
+				expected:      true,
+			},
+			{
+				name:          "rule delay over the NoData delay",
+				ruleUID:       "critical",
+				orgID:         2,
+				state:         eval.NoData,
+				sinceLastSent: 2 * time.Minute,
+				expected:      true,
+			},
+			{
+				name:          "org default without a rule delay",
+				ruleUID:       "other",
+				orgID:         1,
+				state:         eval.Alerting,
+				sinceLastSent: 5 * time.Minute,
+				expected:      false,
+			},
+			{
+				name:          "org default over the NoData delay",
+				ruleUID:       "other",
+				orgID:         1,
+				state:         eval.NoData,
+				sinceLastSent: 10 * time.Minute,
+				expected:      true,
+			},
+			{
+				name:          "NoData delay without a rule delay or an org default",
+				ruleUID:       "other",
+				orgID:         2,
+				state:         eval.NoData,
+				sinceLastSent: 10 * time.Minute,
+				expected:      false,
+			},
+			{
+				name:          "global delay without a rule delay or an org default",
+				ruleUID:       "other",
+				orgID:         2,
+				state:         eval.Alerting,
+				sinceLastSent: time.Minute,
+				expected:      true,
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				s := &State{
+					OrgID:              tc.orgID,
+					Labels:             data.Labels{ngmodels.RuleUIDLabel: tc.ruleUID},
+					State:              tc.state,
+					LastEvaluationTime: evaluationTime,
+					LastSentAt:         evaluationTime.Add(-tc.sinceLastSent),
+				}
+				assert.Equal(t, tc.expected, s.NeedsSending(st.SendPolicy()))
+			})
+		}
+	})
+}
+
+func TestNeedsSending_SuppressionWindows(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	matcher, err := labels.NewMatcher(labels.MatchEqual, "type", "batch")
+	require.NoError(t, err)
+	overnight := SuppressionWindow{
+		Matchers: []*labels.Matcher{matcher},
+		Start:    22 * time.Hour,
+		End:      6 * time.Hour,
+	}
+	policy := SendPolicy{
+		ResendDelay:        func(data.Labels) time.Duration { return time.Minute },
+		SuppressionWindows: []SuppressionWindow{overnight},
+	}
+
+	testCases := []struct {
+		name     string
+		labels   data.Labels
+		evalTime time.Time
+		expected bool
+	}{
+		{
+			name:     "matching state is suppressed in the window",
+			labels:   data.Labels{"type": "batch"},
+			evalTime: evaluationTime.Add(23 * time.Hour),
+			expected: false,
+		},
+		{
+			name:     "matching state is suppressed in the window after midnight",
+			labels:   data.Labels{"type": "batch"},
+			evalTime: evaluationTime.Add(2 * time.Hour),
+			expected: false,
+		},
+		{
+			name:     "matching state is sent out of the window",
+			labels:   data.Labels{"type": "batch"},
+			evalTime: evaluationTime.Add(12 * time.Hour),
+			expected: true,
+		},
+		{
+			name:     "state that does not match is sent in the window",
+			labels:   data.Labels{"type": "web"},
+			evalTime: evaluationTime.Add(23 * time.Hour),
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{
+				State:              eval.Alerting,
+				Labels:             tc.labels,
+				LastEvaluationTime: tc.evalTime,
+			}
+			assert.Equal(t, tc.expected, s.NeedsSending(policy))
+		})
+	}
+}
+
+func TestSuppressionCoverage(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	now := evaluationTime.Add(100 * time.Second)
+	matcher, err := labels.NewMatcher(labels.MatchEqual, "team", "a")
+	require.NoError(t, err)
+	otherMatcher, err := labels.NewMatcher(labels.MatchEqual, "team", "b")
+	require.NoError(t, err)
+	silence := func(m *labels.Matcher, from, to time.Duration) Silence {
+		return Silence{Matchers: []*labels.Matcher{m}, StartsAt: evaluationTime.Add(from), EndsAt: evaluationTime.Add(to)}
+	}
+	// Fires from 20s to 60s.
+	s := &State{
+		Labels:  data.Labels{"team": "a"},
+		Results: makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Normal, eval.Normal, eval.Normal, eval.Normal),
+	}
+
+	testCases := []struct {
+		name     string
+		silences []Silence
+		period   time.Duration
+		expected float64
+	}{
+		{
+			name:     "fully suppressed",
+			silences: []Silence{silence(matcher, 0, time.Hour)},
+			period:   100 * time.Second,
+			expected: 1,
+		},
+		{
+			name:     "partially suppressed",
+			silences: []Silence{silence(matcher, 30*time.Second, 50*time.Second)},
+			period:   100 * time.Second,
+			expected: 0.5,
+		},
+		{
+			name:     "overlapping silences are counted once",
+			silences: []Silence{silence(matcher, 10*time.Second, 40*time.Second), silence(matcher, 30*time.Second, 50*time.Second)},
+			period:   100 * time.Second,
+			expected: 0.75,
+		},
+		{
+			name:     "not suppressed",
+			silences: []Silence{silence(matcher, 70*time.Second, time.Hour)},
+			period:   100 * time.Second,
+			expected: 0,
+		},
+		{
+			name:     "silences that do not match are ignored",
+			silences: []Silence{silence(otherMatcher, 0, time.Hour)},
+			period:   100 * time.Second,
+			expected: 0,
+		},
+		{
+			name:     "only the period is considered",
+			silences: []Silence{silence(matcher, 0, 50*time.Second)},
+			period:   60 * time.Second,
+			expected: 0.5,
+		},
+		{
+			name:     "not firing within the period",
+			silences: []Silence{silence(matcher, 0, time.Hour)},
+			period:   30 * time.Second,
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.InDelta(t, tc.expected, s.SuppressionCoverage(tc.silences, tc.period, now), 0.0001)
+		})
+	}
+}
+
+func TestNeedsSending_NeverSent(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	policy := SendPolicy{ResendDelay: func(data.Labels) time.Duration { return time.Minute }}
+
+	testCases := []struct {
+		name     string
+		state    *State
+		expected bool
+	}{
+		{
+			name:     "new alerting state is sent",
+			state:    &State{State: eval.Alerting, LastEvaluationTime: evaluationTime},
+			expected: true,
+		},
+		{
+			name:     "new alerting state is sent even if it has not been evaluated",
+			state:    &State{State: eval.Alerting},
+			expected: true,
+		},
+		{
+			name:     "resolved state that was never sent is sent",
+			state:    &State{State: eval.Normal, Resolved: true},
+			expected: true,
+		},
+		{
+			name:     "new normal state is not sent",
+			state:    &State{State: eval.Normal, LastEvaluationTime: evaluationTime},
+			expected: false,
+		},
+		{
+			name:     "new pending state is not sent",
+			state:    &State{State: eval.Pending, LastEvaluationTime: evaluationTime},
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.state.NeedsSending(policy))
+		})
+	}
+}
+
+func TestNeedsSending_MaxEvaluationLag(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	policy := SendPolicy{
+		ResendDelay:      func(data.Labels) time.Duration { return time.Minute },
+		MaxEvaluationLag: 5 * time.Minute,
+	}
+
+	testCases := []struct {
+		name     string
+		state    *State
+		lag      time.Duration
+		expected bool
+	}{
+		{
+			name:     "resend of an up to date state is sent",
+			state:    &State{State: eval.Alerting, LastSentAt: evaluationTime.Add(-time.Minute)},
+			lag:      time.Minute,
+			expected: true,
+		},
+		{
+			name:     "resend of a lagging state is held",
+			state:    &State{State: eval.Alerting, LastSentAt: evaluationTime.Add(-time.Minute)},
+			lag:      10 * time.Minute,
+			expected: false,
+		},
+		{
+			name:     "lagging state that was never sent is sent",
+			state:    &State{State: eval.Alerting},
+			lag:      10 * time.Minute,
+			expected: true,
+		},
+		{
+			name:     "resolve of a lagging state is sent",
+			state:    &State{State: eval.Normal, Resolved: true, LastSentAt: evaluationTime.Add(-time.Minute)},
+			lag:      10 * time.Minute,
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.state.LastEvaluationTime = evaluationTime
+			policy.Now = func() time.Time { return evaluationTime.Add(tc.lag) }
+			assert.Equal(t, tc.expected, tc.state.NeedsSending(policy))
+		})
+	}
+}
+
+func TestNeedsSending_OnAnnotationChange(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	policy := SendPolicy{
+		ResendDelay:        func(data.Labels) time.Duration { return time.Minute },
+		OnAnnotationChange: true,
+	}
+
+	testCases := []struct {
+		name      string
+		changedAt time.Time
+		expected  bool
+	}{
+		{
+			name:      "annotation change forces a send",
+			changedAt: evaluationTime,
+			expected:  true,
+		},
+		{
+			name:      "no annotation change waits for the resend delay",
+			changedAt: evaluationTime.Add(-30 * time.Second),
+			expected:  false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{
+				State:                eval.Alerting,
+				LastEvaluationTime:   evaluationTime,
+				LastSentAt:           evaluationTime.Add(-30 * time.Second),
+				AnnotationsChangedAt: tc.changedAt,
+			}
+			assert.Equal(t, tc.expected, s.NeedsSending(policy))
+
+			// The change is sent once.
+			s.MarkSent(evaluationTime)
+			assert.False(t, s.NeedsSending(policy))
 		})
 	}
 }
 
+func TestNeedsSending_Predicates(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	now := evaluationTime.Add(time.Minute)
+	key := ngmodels.AlertRuleKey{OrgID: 1, UID: "rule"}
+
+	var gotDelay time.Duration
+	var gotNow time.Time
+	policy := SendPolicy{
+		ResendDelay: func(data.Labels) time.Duration { return time.Minute },
+		Predicates: map[ngmodels.AlertRuleKey]SendPredicate{
+			key: func(s *State, resendDelay time.Duration, now time.Time) bool {
+				gotDelay, gotNow = resendDelay, now
+				// Pending states are sent, which the default never does.
+				return s.State == eval.Pending
+			},
+		},
+		Now: func() time.Time { return now },
+	}
+
+	t.Run("custom predicate overrides the default", func(t *testing.T) {
+		pending := &State{OrgID: key.OrgID, AlertRuleUID: key.UID, State: eval.Pending, LastEvaluationTime: evaluationTime}
+		assert.True(t, pending.NeedsSending(policy))
+		assert.Equal(t, time.Minute, gotDelay)
+		assert.Equal(t, now, gotNow)
+
+		alerting := &State{OrgID: key.OrgID, AlertRuleUID: key.UID, State: eval.Alerting, LastEvaluationTime: evaluationTime}
+		assert.False(t, alerting.NeedsSending(policy))
+	})
+
+	t.Run("default applies when unset for the rule", func(t *testing.T) {
+		pending := &State{OrgID: key.OrgID, AlertRuleUID: "other", State: eval.Pending, LastEvaluationTime: evaluationTime}
+		assert.False(t, pending.NeedsSending(policy))
+
+		alerting := &State{OrgID: key.OrgID, AlertRuleUID: "other", State: eval.Alerting, LastEvaluationTime: evaluationTime}
+		assert.True(t, alerting.NeedsSending(policy))
+	})
+}
+
 func TestSetEndsAt(t *testing.T) {
 	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
 	testCases := []struct {
@@ -230,3 +818,1686 @@ func TestSetEndsAt(t *testing.T) {
 		})
 	}
 }
+
+func TestSetEndsAt_ErrorEndsAtMultiplier(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{IntervalSeconds: 60, ExecErrState: ngmodels.ErrorErrState, ErrorEndsAtMultiplier: 10}
+
+	testCases := []struct {
+		name         string
+		result       eval.State
+		execErrState ngmodels.ExecutionErrorState
+		expected     time.Time
+	}{
+		{
+			name:         "error",
+			result:       eval.Error,
+			execErrState: ngmodels.ErrorErrState,
+			expected:     evaluationTime.Add(10 * time.Minute),
+		},
+		{
+			name:         "breach",
+			result:       eval.Alerting,
+			execErrState: ngmodels.ErrorErrState,
+			expected:     evaluationTime.Add(3 * time.Minute),
+		},
+		{
+			name:         "error that is alerting",
+			result:       eval.Error,
+			execErrState: ngmodels.AlertingErrState,
+			expected:     evaluationTime.Add(3 * time.Minute),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := *rule
+			r.ExecErrState = tc.execErrState
+			s := &State{}
+			result := eval.Result{State: tc.result, EvaluatedAt: evaluationTime}
+			if tc.result == eval.Error {
+				s.resultError(&r, result)
+			} else {
+				s.resultAlerting(&r, result)
+			}
+			assert.Equal(t, tc.expected, s.EndsAt)
+		})
+	}
+}
+
+func TestValueSummary(t *testing.T) {
+	testCases := []struct {
+		name     string
+		format   string
+		results  []Evaluation
+		expected string
+	}{
+		{
+			name:     "no results",
+			expected: "",
+		},
+		{
+			name:     "empty values",
+			results:  []Evaluation{{Values: map[string]*float64{}}},
+			expected: "",
+		},
+		{
+			name: "values are sorted by RefID",
+			results: []Evaluation{{Values: map[string]*float64{
+				"C": ptr.Float64(3),
+				"A": ptr.Float64(87),
+				"B": ptr.Float64(12.5),
+			}}},
+			expected: "A=87, B=12.5, C=3",
+		},
+		{
+			name:   "values are formatted using the format",
+			format: "%.2f",
+			results: []Evaluation{{Values: map[string]*float64{
+				"A": ptr.Float64(87),
+				"B": ptr.Float64(12.345),
+			}}},
+			expected: "A=87.00, B=12.35",
+		},
+		{
+			name: "nil values are shown as NaN",
+			results: []Evaluation{{Values: map[string]*float64{
+				"A": nil,
+				"B": ptr.Float64(12),
+			}}},
+			expected: "A=NaN, B=12",
+		},
+		{
+			name: "only the latest evaluation is used",
+			results: []Evaluation{
+				{Values: map[string]*float64{"A": ptr.Float64(1)}},
+				{Values: map[string]*float64{"A": ptr.Float64(2)}},
+			},
+			expected: "A=2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Results: tc.results}
+			assert.Equal(t, tc.expected, s.ValueSummary(tc.format))
+		})
+	}
+}
+
+func TestSetAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		current     map[string]string
+		annotations map[string]string
+		expected    bool
+	}{
+		{
+			name:        "identical annotations are not rewritten",
+			current:     map[string]string{"summary": "foo is down", "severity": "critical"},
+			annotations: map[string]string{"summary": "foo is down", "severity": "critical"},
+			expected:    false,
+		},
+		{
+			name:        "empty annotations are not rewritten",
+			current:     nil,
+			annotations: map[string]string{},
+			expected:    false,
+		},
+		{
+			name:        "changed value is rewritten",
+			current:     map[string]string{"summary": "foo is down"},
+			annotations: map[string]string{"summary": "bar is down"},
+			expected:    true,
+		},
+		{
+			name:        "changed key is rewritten",
+			current:     map[string]string{"summary": "foo is down"},
+			annotations: map[string]string{"description": "foo is down"},
+			expected:    true,
+		},
+		{
+			name:        "added annotation is rewritten",
+			current:     map[string]string{"summary": "foo is down"},
+			annotations: map[string]string{"summary": "foo is down", "severity": "critical"},
+			expected:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{Annotations: tc.current}
+			before := *s
+			assert.Equal(t, tc.expected, s.setAnnotations(tc.annotations))
+			assert.Equal(t, !tc.expected, s.Equals(&before))
+			assert.Equal(t, len(tc.annotations), len(s.Annotations))
+		})
+	}
+}
+
+func TestFiringTimeRange(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{
+		For:             10 * time.Second,
+		IntervalSeconds: 10,
+		Data: []ngmodels.AlertQuery{
+			{
+				RefID:             "A",
+				DatasourceUID:     "datasource",
+				RelativeTimeRange: ngmodels.RelativeTimeRange{From: ngmodels.Duration(10 * time.Minute)},
+			},
+			{
+				RefID:             "B",
+				DatasourceUID:     "datasource",
+				RelativeTimeRange: ngmodels.RelativeTimeRange{From: ngmodels.Duration(5 * time.Minute), To: ngmodels.Duration(time.Minute)},
+			},
+			{
+				RefID:         "C",
+				DatasourceUID: "-100",
+			},
+		},
+	}
+
+	s := &State{}
+	for i, st := range []eval.State{eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting} {
+		r := eval.Result{State: st, EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second)}
+		from, to := queryTimeRange(rule, r.EvaluatedAt)
+		s.Results = append(s.Results, Evaluation{
+			EvaluationTime:  r.EvaluatedAt,
+			EvaluationState: r.State,
+			QueriedFrom:     from,
+			QueriedTo:       to,
+		})
+		s.resultAlerting(rule, r)
+	}
+	require.Equal(t, eval.Alerting, s.State)
+
+	// The state fired on the third evaluation, when For was exceeded.
+	from, to := s.FiringTimeRange()
+	firedAt := evaluationTime.Add(20 * time.Second)
+	assert.Equal(t, firedAt.Add(-10*time.Minute), from)
+	assert.Equal(t, firedAt, to)
+
+	// There is no time range when the state is not firing.
+	s.State = eval.Normal
+	from, to = s.FiringTimeRange()
+	assert.True(t, from.IsZero())
+	assert.True(t, to.IsZero())
+}
+
+func TestFingerprint(t *testing.T) {
+	s := &State{Labels: data.Labels{"a": "1", "b": "2"}}
+	fp := s.Fingerprint()
+
+	// The fingerprint does not depend on the order of labels
+	// and is the same for states with the same labels.
+	other := &State{Labels: data.Labels{"b": "2", "a": "1"}}
+	assert.Equal(t, fp, other.Fingerprint())
+	assert.True(t, s.Equals(other))
+
+	// Labels are not confused with their concatenation.
+	assert.NotEqual(t, fp, (&State{Labels: data.Labels{"a": "12"}}).Fingerprint())
+
+	t.Run("SetLabel invalidates the fingerprint", func(t *testing.T) {
+		s.SetLabel("a", "3")
+		assert.NotEqual(t, fp, s.Fingerprint())
+		assert.False(t, s.Equals(other))
+
+		s.SetLabel("a", "1")
+		assert.Equal(t, fp, s.Fingerprint())
+		assert.True(t, s.Equals(other))
+	})
+
+	t.Run("SetLabels invalidates the fingerprint", func(t *testing.T) {
+		s.SetLabels(data.Labels{"a": "1"})
+		assert.NotEqual(t, fp, s.Fingerprint())
+		assert.False(t, s.Equals(other))
+	})
+
+	t.Run("labels changed directly are not hidden by the stored fingerprint", func(t *testing.T) {
+		s := &State{}
+		s.SetLabels(data.Labels{"a": "1", "b": "2"})
+		assert.Equal(t, fp, s.Fingerprint())
+
+		s.Labels["a"] = "3"
+		assert.Equal(t, labelsFingerprint(data.Labels{"a": "3", "b": "2"}), s.Fingerprint())
+		delete(s.Labels, "a")
+		assert.Equal(t, labelsFingerprint(data.Labels{"b": "2"}), s.Fingerprint())
+		s.Labels = data.Labels{"a": "1", "b": "2"}
+		assert.Equal(t, fp, s.Fingerprint())
+	})
+
+	t.Run("reading the fingerprint does not write the state", func(t *testing.T) {
+		s := &State{}
+		s.SetLabels(data.Labels{"a": "1", "b": "2"})
+		other := &State{Labels: data.Labels{"b": "2", "a": "1"}}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.Equal(t, fp, s.Fingerprint())
+				assert.True(t, s.Equals(other))
+				assert.Equal(t, fp, other.Fingerprint())
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func TestPrometheusFingerprint(t *testing.T) {
+	// Vectors from the signature tests of github.com/prometheus/common/model.
+	testCases := []struct {
+		labels   data.Labels
+		expected uint64
+	}{
+		{
+			labels:   data.Labels{},
+			expected: 14695981039346656037,
+		},
+		{
+			labels:   data.Labels{"name": "garland, briggs", "fear": "love is not enough"},
+			expected: 5799056148416392346,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.labels.String(), func(t *testing.T) {
+			s := &State{Labels: tc.labels}
+			assert.Equal(t, tc.expected, s.PrometheusFingerprint())
+		})
+	}
+}
+
+func TestEqualsRounded(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	newState := func(startsAt, endsAt time.Time) *State {
+		return &State{
+			AlertRuleUID: "test_alert_rule_uid",
+			State:        eval.Alerting,
+			Labels:       data.Labels{"a": "1"},
+			StartsAt:     startsAt,
+			EndsAt:       endsAt,
+		}
+	}
+	s := newState(evaluationTime, evaluationTime.Add(90*time.Second))
+
+	testCases := []struct {
+		name        string
+		other       *State
+		granularity time.Duration
+		expected    bool
+	}{
+		{
+			name:        "sub-granularity differences are equal",
+			other:       newState(evaluationTime.Add(300*time.Millisecond), evaluationTime.Add(90*time.Second-200*time.Millisecond)),
+			granularity: 10 * time.Second,
+			expected:    true,
+		},
+		{
+			name:        "sub-second differences are not equal without rounding",
+			other:       newState(evaluationTime.Add(300*time.Millisecond), evaluationTime.Add(90*time.Second-200*time.Millisecond)),
+			granularity: 0,
+			expected:    false,
+		},
+		{
+			name:        "differences of the granularity are not equal",
+			other:       newState(evaluationTime.Add(10*time.Second), evaluationTime.Add(90*time.Second)),
+			granularity: 10 * time.Second,
+			expected:    false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, s.EqualsRounded(tc.other, tc.granularity))
+		})
+	}
+}
+
+func BenchmarkEquals(b *testing.B) {
+	labels := make(data.Labels, 500)
+	for i := 0; i < 500; i++ {
+		labels[fmt.Sprintf("label_%d", i)] = fmt.Sprintf("value_%d", i)
+	}
+	s1 := &State{Labels: labels}
+	s2 := &State{Labels: labels.Copy()}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s1.Equals(s2)
+	}
+}
+
+func TestPendingSendAction(t *testing.T) {
+	now, _ := time.Parse("2006-01-02", "2021-03-25")
+	resendDelay := time.Minute
+	policy := SendPolicy{
+		ResendDelay:     func(data.Labels) time.Duration { return resendDelay },
+		OrgResendDelays: map[int64]time.Duration{2: 10 * time.Second},
+	}
+
+	testCases := []struct {
+		name     string
+		state    *State
+		expected SendAction
+	}{
+		{
+			name:     "alerting and never sent",
+			state:    &State{State: eval.Alerting},
+			expected: SendFiring,
+		},
+		{
+			name:     "alerting and resend delay has passed",
+			state:    &State{State: eval.Alerting, LastSentAt: now.Add(-resendDelay)},
+			expected: SendFiring,
+		},
+		{
+			name:     "alerting and sent within the resend delay",
+			state:    &State{State: eval.Alerting, LastSentAt: now.Add(-30 * time.Second)},
+			expected: SendNone,
+		},
+		{
+			name:     "no data is sent as firing",
+			state:    &State{State: eval.NoData, LastSentAt: now.Add(-resendDelay)},
+			expected: SendFiring,
+		},
+		{
+			name:     "error is sent as firing",
+			state:    &State{State: eval.Error, LastSentAt: now.Add(-resendDelay)},
+			expected: SendFiring,
+		},
+		{
+			name:     "resolved",
+			state:    &State{State: eval.Normal, Resolved: true, LastSentAt: now.Add(-resendDelay)},
+			expected: SendResolve,
+		},
+		{
+			name:     "resolved and sent within the resend delay",
+			state:    &State{State: eval.Normal, Resolved: true, LastSentAt: now.Add(-30 * time.Second)},
+			expected: SendNone,
+		},
+		{
+			name:     "normal",
+			state:    &State{State: eval.Normal},
+			expected: SendNone,
+		},
+		{
+			name:     "pending",
+			state:    &State{State: eval.Pending},
+			expected: SendNone,
+		},
+		{
+			name:     "alerting and the resend delay of the organization has passed",
+			state:    &State{OrgID: 2, State: eval.Alerting, LastSentAt: now.Add(-30 * time.Second)},
+			expected: SendFiring,
+		},
+		{
+			name:     "backfilled",
+			state:    &State{State: eval.Alerting, Backfill: true},
+			expected: SendNone,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.state.PendingSendAction(policy, now))
+		})
+	}
+}
+
+func TestNextDecisionTime(t *testing.T) {
+	now, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{For: 5 * time.Minute}
+	policy := SendPolicy{
+		ResendDelay: func(data.Labels) time.Duration { return time.Minute },
+		StateResendDelay: func(l data.Labels) time.Duration {
+			if l["rule"] == "slow" {
+				return 5 * time.Minute
+			}
+			return 0
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		state    *State
+		expected time.Time
+	}{
+		{
+			name:     "pending fires after For",
+			state:    &State{State: eval.Pending, StartsAt: now.Add(-2 * time.Minute)},
+			expected: now.Add(3 * time.Minute),
+		},
+		{
+			name:     "alerting is resent after the resend delay",
+			state:    &State{State: eval.Alerting, LastSentAt: now.Add(-20 * time.Second), EndsAt: now.Add(90 * time.Second)},
+			expected: now.Add(40 * time.Second),
+		},
+		{
+			name:     "alerting resolves by itself before the resend delay",
+			state:    &State{State: eval.Alerting, LastSentAt: now.Add(-20 * time.Second), EndsAt: now.Add(30 * time.Second)},
+			expected: now.Add(30 * time.Second),
+		},
+		{
+			name:     "alerting that is due",
+			state:    &State{State: eval.Alerting, LastSentAt: now.Add(-2 * time.Minute), EndsAt: now.Add(90 * time.Second)},
+			expected: now,
+		},
+		{
+			name:     "resolved normal is sent after the resend delay",
+			state:    &State{State: eval.Normal, Resolved: true, LastSentAt: now.Add(-20 * time.Second)},
+			expected: now.Add(40 * time.Second),
+		},
+		{
+			name:     "alerting is resent after the resend delay of the rule",
+			state:    &State{State: eval.Alerting, Labels: data.Labels{"rule": "slow"}, LastSentAt: now.Add(-20 * time.Second), EndsAt: now.Add(10 * time.Minute)},
+			expected: now.Add(280 * time.Second),
+		},
+		{
+			name:     "normal",
+			state:    &State{State: eval.Normal, LastSentAt: now.Add(-20 * time.Second)},
+			expected: time.Time{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.state.NextDecisionTime(policy, rule, now))
+		})
+	}
+}
+
+func TestFiringETA(t *testing.T) {
+	startsAt, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{For: 5 * time.Minute}
+
+	testCases := []struct {
+		name     string
+		state    eval.State
+		expected time.Time
+	}{
+		{
+			name:     "pending",
+			state:    eval.Pending,
+			expected: startsAt.Add(5 * time.Minute),
+		},
+		{
+			name:  "alerting",
+			state: eval.Alerting,
+		},
+		{
+			name:  "normal",
+			state: eval.Normal,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, StartsAt: startsAt}
+			assert.Equal(t, tc.expected, s.FiringETA(rule))
+		})
+	}
+}
+
+func TestEscalationSchedule(t *testing.T) {
+	startsAt, _ := time.Parse("2006-01-02", "2021-03-25")
+	thresholds := []time.Duration{0, 15 * time.Minute, time.Hour}
+
+	testCases := []struct {
+		name     string
+		state    eval.State
+		expected []time.Time
+	}{
+		{
+			name:     "alerting",
+			state:    eval.Alerting,
+			expected: []time.Time{startsAt, startsAt.Add(15 * time.Minute), startsAt.Add(time.Hour)},
+		},
+		{
+			name:  "pending",
+			state: eval.Pending,
+		},
+		{
+			name:  "normal",
+			state: eval.Normal,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, StartsAt: startsAt}
+			assert.Equal(t, tc.expected, s.EscalationSchedule(thresholds))
+		})
+	}
+}
+
+func TestSummary(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	s := &State{
+		AlertRuleUID: "test_alert_rule_uid",
+		OrgID:        1,
+		CacheId:      `[["instance","a"]]`,
+		State:        eval.Alerting,
+		StartsAt:     evaluationTime,
+		EndsAt:       evaluationTime.Add(time.Minute),
+		Labels: data.Labels{
+			"alertname":                "test_title",
+			"instance":                 "a",
+			ngmodels.RuleUIDLabel:      "test_alert_rule_uid",
+			ngmodels.NamespaceUIDLabel: "test_namespace_uid",
+		},
+		Annotations: map[string]string{"summary": "instance a is down"},
+		Results: []Evaluation{
+			{EvaluationTime: evaluationTime.Add(-20 * time.Second), EvaluationState: eval.Error},
+			{EvaluationTime: evaluationTime.Add(-10 * time.Second), EvaluationState: eval.Normal},
+			{EvaluationTime: evaluationTime, EvaluationState: eval.Alerting, Values: map[string]*float64{"A": ptr.Float64(1)}},
+		},
+	}
+
+	assert.Equal(t, StateSummary{
+		AlertRuleUID: "test_alert_rule_uid",
+		State:        "Alerting",
+		StartsAt:     evaluationTime,
+		EndsAt:       evaluationTime.Add(time.Minute),
+		Labels:       map[string]string{"alertname": "test_title", "instance": "a"},
+		Evaluations:  3,
+		Alerting:     1,
+		Errors:       1,
+	}, s.Summary())
+}
+
+func TestReconcile(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	endsAt := evaluationTime.Add(90 * time.Second)
+
+	testCases := []struct {
+		name         string
+		state        eval.State
+		remoteActive bool
+		remoteEndsAt time.Time
+		expected     ReconcileAction
+	}{
+		{
+			name:         "local active, remote active",
+			state:        eval.Alerting,
+			remoteActive: true,
+			remoteEndsAt: endsAt,
+			expected:     ReconcileSkip,
+		},
+		{
+			name:         "local active, remote active but ends earlier",
+			state:        eval.Alerting,
+			remoteActive: true,
+			remoteEndsAt: endsAt.Add(-time.Minute),
+			expected:     ReconcileResend,
+		},
+		{
+			name:         "local active, remote missing",
+			state:        eval.Alerting,
+			remoteActive: false,
+			expected:     ReconcileResend,
+		},
+		{
+			name:         "local error, remote missing",
+			state:        eval.Error,
+			remoteActive: false,
+			expected:     ReconcileResend,
+		},
+		{
+			name:         "local normal, remote active",
+			state:        eval.Normal,
+			remoteActive: true,
+			remoteEndsAt: endsAt,
+			expected:     ReconcileResolve,
+		},
+		{
+			name:         "local pending, remote active",
+			state:        eval.Pending,
+			remoteActive: true,
+			remoteEndsAt: endsAt,
+			expected:     ReconcileResolve,
+		},
+		{
+			name:         "local normal, remote missing",
+			state:        eval.Normal,
+			remoteActive: false,
+			expected:     ReconcileSkip,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, StartsAt: evaluationTime, EndsAt: endsAt}
+			assert.Equal(t, tc.expected, Reconcile(s, tc.remoteEndsAt, tc.remoteActive))
+		})
+	}
+}
+
+func TestHoldStartupResolve(t *testing.T) {
+	warmedAt, _ := time.Parse("2006-01-02", "2021-03-25")
+	st := &Manager{StartupResolveGrace: time.Minute, warmedAt: warmedAt}
+
+	testCases := []struct {
+		name     string
+		state    *State
+		at       time.Duration
+		expected bool
+	}{
+		{
+			name:     "first resolve of a restored state is held",
+			state:    &State{State: eval.Alerting, restored: true, Results: makeResults(warmedAt.Add(10*time.Second), eval.Normal)},
+			at:       10 * time.Second,
+			expected: true,
+		},
+		{
+			name:     "resolve confirmed by the next evaluation is not held",
+			state:    &State{State: eval.Alerting, restored: true, Results: makeResults(warmedAt.Add(10*time.Second), eval.Normal, eval.Normal)},
+			at:       20 * time.Second,
+			expected: false,
+		},
+		{
+			name:     "resolve after the grace is not held",
+			state:    &State{State: eval.Alerting, restored: true, Results: makeResults(warmedAt.Add(2*time.Minute), eval.Normal)},
+			at:       2 * time.Minute,
+			expected: false,
+		},
+		{
+			name:     "resolve of a state created after startup is not held",
+			state:    &State{State: eval.Alerting, Results: makeResults(warmedAt.Add(10*time.Second), eval.Normal)},
+			at:       10 * time.Second,
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result := eval.Result{State: eval.Normal, EvaluatedAt: warmedAt.Add(tc.at)}
+			assert.Equal(t, tc.expected, st.holdStartupResolve(tc.state, result))
+		})
+	}
+
+	t.Run("held state keeps firing until the resolve is confirmed", func(t *testing.T) {
+		rule := &ngmodels.AlertRule{IntervalSeconds: 10}
+		s := &State{State: eval.Alerting, restored: true, StartsAt: warmedAt.Add(-time.Hour)}
+		for i, expected := range []eval.State{eval.Alerting, eval.Normal} {
+			result := eval.Result{State: eval.Normal, EvaluatedAt: warmedAt.Add(time.Duration(i+1) * 10 * time.Second)}
+			s.Results = append(s.Results, Evaluation{EvaluationTime: result.EvaluatedAt, EvaluationState: result.State})
+			if st.holdStartupResolve(s, result) {
+				s.resultFrozen(rule, result)
+			} else {
+				s.resultNormal(rule, result)
+			}
+			assert.Equal(t, expected, s.State)
+		}
+	})
+}
+
+func TestPause(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	pausedAt := evaluationTime.Add(time.Minute)
+
+	testCases := []struct {
+		name     string
+		policy   PausePolicy
+		expected *State
+	}{
+		{
+			name:   "keep leaves the alert firing",
+			policy: PauseKeep,
+			expected: &State{
+				State:              eval.Alerting,
+				StartsAt:           evaluationTime,
+				EndsAt:             evaluationTime.Add(3 * time.Minute),
+				LastEvaluationTime: evaluationTime,
+				Paused:             true,
+			},
+		},
+		{
+			name:   "resolve resolves the alert",
+			policy: PauseResolve,
+			expected: &State{
+				State:              eval.Normal,
+				Resolved:           true,
+				StartsAt:           pausedAt,
+				EndsAt:             pausedAt,
+				LastEvaluationTime: pausedAt,
+				Paused:             true,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{
+				State:              eval.Alerting,
+				StartsAt:           evaluationTime,
+				EndsAt:             evaluationTime.Add(3 * time.Minute),
+				LastEvaluationTime: evaluationTime,
+			}
+			s.Pause(tc.policy, pausedAt)
+			assert.Equal(t, tc.expected, s)
+		})
+	}
+
+	t.Run("resolve does not resolve a normal state", func(t *testing.T) {
+		s := &State{State: eval.Normal, StartsAt: evaluationTime}
+		s.Pause(PauseResolve, pausedAt)
+		assert.Equal(t, &State{State: eval.Normal, StartsAt: evaluationTime, Paused: true}, s)
+	})
+
+	t.Run("resolve sends the resolve of every active state", func(t *testing.T) {
+		policy := SendPolicy{ResendDelay: func(data.Labels) time.Duration { return 30 * time.Second }}
+		for _, state := range []eval.State{eval.Alerting, eval.NoData, eval.Error} {
+			s := &State{
+				State:              state,
+				StartsAt:           evaluationTime,
+				EndsAt:             evaluationTime.Add(3 * time.Minute),
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime,
+			}
+			require.False(t, s.NeedsSending(policy), state.String())
+			s.Pause(PauseResolve, pausedAt)
+			assert.True(t, s.Resolved, state.String())
+			assert.True(t, s.NeedsSending(policy), state.String())
+		}
+	})
+
+	t.Run("resolve does not send a pending state", func(t *testing.T) {
+		s := &State{State: eval.Pending, StartsAt: evaluationTime, LastEvaluationTime: evaluationTime}
+		s.Pause(PauseResolve, pausedAt)
+		assert.Equal(t, eval.Normal, s.State)
+		assert.False(t, s.Resolved)
+		assert.False(t, s.NeedsSending(SendPolicy{ResendDelay: func(data.Labels) time.Duration { return 0 }}))
+	})
+}
+
+func TestIsActive(t *testing.T) {
+	testCases := []struct {
+		state                  eval.State
+		active                 bool
+		activeIncludingPending bool
+	}{
+		{state: eval.Normal, active: false, activeIncludingPending: false},
+		{state: eval.Pending, active: false, activeIncludingPending: true},
+		{state: eval.Alerting, active: true, activeIncludingPending: true},
+		{state: eval.NoData, active: true, activeIncludingPending: true},
+		{state: eval.Error, active: true, activeIncludingPending: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.state.String(), func(t *testing.T) {
+			s := &State{State: tc.state}
+			assert.Equal(t, tc.active, s.IsActive())
+			assert.Equal(t, tc.activeIncludingPending, s.IsActiveIncludingPending())
+		})
+	}
+}
+
+func TestIsNewSeries(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	t.Run("first evaluation", func(t *testing.T) {
+		s := &State{Results: makeResults(evaluationTime, eval.Alerting)}
+		assert.True(t, s.IsNewSeries())
+	})
+
+	t.Run("established series", func(t *testing.T) {
+		s := &State{Results: makeResults(evaluationTime, eval.Normal, eval.Normal, eval.Alerting)}
+		assert.False(t, s.IsNewSeries())
+	})
+
+	t.Run("not evaluated", func(t *testing.T) {
+		s := &State{}
+		assert.False(t, s.IsNewSeries())
+	})
+}
+
+func TestNotificationBudgetUsed(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		sends    int
+		budget   int
+		expected float64
+	}{
+		{
+			name:     "unused",
+			sends:    0,
+			budget:   10,
+			expected: 0,
+		},
+		{
+			name:     "partially used",
+			sends:    4,
+			budget:   10,
+			expected: 0.4,
+		},
+		{
+			name:     "used up",
+			sends:    10,
+			budget:   10,
+			expected: 1,
+		},
+		{
+			name:     "exceeded",
+			sends:    15,
+			budget:   10,
+			expected: 1.5,
+		},
+		{
+			name:     "no budget",
+			sends:    15,
+			budget:   0,
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{}
+			for i := 0; i < tc.sends; i++ {
+				s.MarkSent(evaluationTime.Add(time.Duration(i) * time.Minute))
+			}
+			assert.Equal(t, tc.sends, s.SendCount)
+			assert.InDelta(t, tc.expected, s.NotificationBudgetUsed(tc.budget), 0.0001)
+		})
+	}
+}
+
+func TestTimeToResend(t *testing.T) {
+	now, _ := time.Parse("2006-01-02", "2021-03-25")
+	resendDelay := time.Minute
+	policy := SendPolicy{
+		ResendDelay: func(data.Labels) time.Duration { return resendDelay },
+	}
+
+	testCases := []struct {
+		name       string
+		policy     SendPolicy
+		orgID      int64
+		lastSentAt time.Time
+		expected   time.Duration
+	}{
+		{
+			name:       "not yet due",
+			policy:     policy,
+			lastSentAt: now.Add(-20 * time.Second),
+			expected:   40 * time.Second,
+		},
+		{
+			name:       "due",
+			policy:     policy,
+			lastSentAt: now.Add(-resendDelay),
+			expected:   0,
+		},
+		{
+			name:       "overdue",
+			policy:     policy,
+			lastSentAt: now.Add(-90 * time.Second),
+			expected:   -30 * time.Second,
+		},
+		{
+			name: "resend delay of the org",
+			policy: SendPolicy{
+				ResendDelay:     policy.ResendDelay,
+				OrgResendDelays: map[int64]time.Duration{2: 5 * time.Minute},
+			},
+			orgID:      2,
+			lastSentAt: now.Add(-20 * time.Second),
+			expected:   280 * time.Second,
+		},
+		{
+			name: "due within a suppression window",
+			policy: SendPolicy{
+				ResendDelay:        policy.ResendDelay,
+				SuppressionWindows: []SuppressionWindow{{Start: 0, End: time.Hour}},
+			},
+			lastSentAt: now.Add(-20 * time.Second),
+			expected:   time.Hour,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: eval.Alerting, OrgID: tc.orgID, LastSentAt: tc.lastSentAt}
+			assert.Equal(t, tc.expected, s.TimeToResend(tc.policy, now))
+		})
+	}
+}
+
+func TestNotificationLatency(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{IntervalSeconds: 10}
+
+	s := &State{}
+	s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime})
+	require.Equal(t, eval.Alerting, s.State)
+	assert.Equal(t, time.Duration(0), s.NotificationLatency(), "not sent yet")
+
+	s.LastSentAt = evaluationTime.Add(1500 * time.Millisecond)
+	assert.Equal(t, 1500*time.Millisecond, s.NotificationLatency())
+
+	s.resultNormal(rule, eval.Result{State: eval.Normal, EvaluatedAt: evaluationTime.Add(10 * time.Second)})
+	assert.Equal(t, time.Duration(0), s.NotificationLatency(), "not firing")
+
+	// The next episode has not been sent yet.
+	s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime.Add(20 * time.Second)})
+	assert.Equal(t, time.Duration(0), s.NotificationLatency(), "sent before the next episode")
+}
+
+func TestTimeToAcknowledge(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{IntervalSeconds: 10}
+
+	s := &State{}
+	s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime})
+	require.Equal(t, eval.Alerting, s.State)
+	assert.Equal(t, time.Duration(0), s.TimeToAcknowledge(), "not acknowledged")
+
+	s.Acknowledge(evaluationTime.Add(7 * time.Minute))
+	assert.Equal(t, 7*time.Minute, s.TimeToAcknowledge())
+
+	pending := &State{State: eval.Pending, StartsAt: evaluationTime}
+	pending.Acknowledge(evaluationTime.Add(time.Minute))
+	assert.Equal(t, time.Duration(0), pending.TimeToAcknowledge(), "not firing")
+}
+
+func TestResultNoData_KeepFiringOnNoData(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	testCases := []struct {
+		name               string
+		keepFiringOnNoData bool
+		noDataState        ngmodels.NoDataState
+		expected           eval.State
+	}{
+		{
+			name:        "alerting follows NoDataState NoData",
+			noDataState: ngmodels.NoData,
+			expected:    eval.NoData,
+		},
+		{
+			name:        "alerting follows NoDataState OK",
+			noDataState: ngmodels.OK,
+			expected:    eval.Normal,
+		},
+		{
+			name:               "alerting keeps firing with NoDataState NoData",
+			keepFiringOnNoData: true,
+			noDataState:        ngmodels.NoData,
+			expected:           eval.Alerting,
+		},
+		{
+			name:               "alerting keeps firing with NoDataState OK",
+			keepFiringOnNoData: true,
+			noDataState:        ngmodels.OK,
+			expected:           eval.Alerting,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &ngmodels.AlertRule{
+				IntervalSeconds:    10,
+				NoDataState:        tc.noDataState,
+				KeepFiringOnNoData: tc.keepFiringOnNoData,
+			}
+			s := &State{}
+			s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime})
+			require.Equal(t, eval.Alerting, s.State)
+
+			noDataAt := evaluationTime.Add(10 * time.Second)
+			s.resultNoData(rule, eval.Result{State: eval.NoData, EvaluatedAt: noDataAt})
+			assert.Equal(t, tc.expected, s.State)
+			assert.Equal(t, evaluationTime, s.StartsAt)
+			assert.Equal(t, noDataAt.Add(ResendDelay*3), s.EndsAt)
+		})
+	}
+}
+
+func TestExpectedResolveSendTime(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	policy := SendPolicy{
+		ResendDelay: func(data.Labels) time.Duration { return time.Minute },
+		StateResendDelay: func(l data.Labels) time.Duration {
+			if l["rule"] == "slow" {
+				return 5 * time.Minute
+			}
+			return 0
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		policy   SendPolicy
+		state    *State
+		expected time.Time
+	}{
+		{
+			name: "just cleared and last sent before the resend delay",
+			state: &State{
+				State:              eval.Normal,
+				Resolved:           true,
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime.Add(-2 * time.Minute),
+			},
+			expected: evaluationTime,
+		},
+		{
+			name: "just cleared and last sent within the resend delay",
+			state: &State{
+				State:              eval.Normal,
+				Resolved:           true,
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime.Add(-20 * time.Second),
+			},
+			expected: evaluationTime.Add(40 * time.Second),
+		},
+		{
+			name: "just cleared and last sent within the resend delay of the rule",
+			state: &State{
+				State:              eval.Normal,
+				Resolved:           true,
+				Labels:             data.Labels{"rule": "slow"},
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime.Add(-2 * time.Minute),
+			},
+			expected: evaluationTime.Add(3 * time.Minute),
+		},
+		{
+			name: "just cleared within the resolve coalesce window",
+			policy: SendPolicy{
+				ResendDelay:           func(data.Labels) time.Duration { return time.Minute },
+				ResolveCoalesceWindow: 2 * time.Minute,
+			},
+			state: &State{
+				State:              eval.Normal,
+				Resolved:           true,
+				StartsAt:           evaluationTime,
+				LastEvaluationTime: evaluationTime,
+				LastSentAt:         evaluationTime.Add(-time.Hour),
+			},
+			expected: evaluationTime.Add(2 * time.Minute),
+		},
+		{
+			name: "alerting",
+			state: &State{
+				State:              eval.Alerting,
+				LastEvaluationTime: evaluationTime,
+			},
+			expected: time.Time{},
+		},
+		{
+			name: "normal and not resolved",
+			state: &State{
+				State:              eval.Normal,
+				LastEvaluationTime: evaluationTime,
+			},
+			expected: time.Time{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := policy
+			if tc.policy.ResendDelay != nil {
+				p = tc.policy
+			}
+			assert.Equal(t, tc.expected, tc.state.ExpectedResolveSendTime(p))
+		})
+	}
+}
+
+func TestNewEvaluationValues_DuplicateRefIDs(t *testing.T) {
+	captures := map[string]eval.NumberValueCapture{
+		"A":   {Var: "A", Value: ptr.Float64(1)},
+		"A_1": {Var: "A", Value: ptr.Float64(2)},
+		"B":   {Var: "B", Value: ptr.Float64(3)},
+	}
+
+	// Both values of A are recorded under disambiguated keys.
+	assert.Equal(t, map[string]*float64{
+		"A":   ptr.Float64(1),
+		"A_1": ptr.Float64(2),
+		"B":   ptr.Float64(3),
+	}, NewEvaluationValues(captures))
+	assert.Equal(t, []string{"A"}, duplicateRefIDs(captures))
+
+	delete(captures, "A_1")
+	assert.Empty(t, duplicateRefIDs(captures))
+}
+
+func TestCapValues(t *testing.T) {
+	values := map[string]*float64{
+		"D": ptr.Float64(4),
+		"B": ptr.Float64(2),
+		"A": ptr.Float64(1),
+		"C": ptr.Float64(3),
+	}
+
+	t.Run("values over the cap are dropped", func(t *testing.T) {
+		capped, dropped := capValues(values, 2)
+		assert.Equal(t, map[string]*float64{"A": ptr.Float64(1), "B": ptr.Float64(2)}, capped)
+		assert.Equal(t, 2, dropped)
+	})
+
+	t.Run("values within the cap are kept", func(t *testing.T) {
+		capped, dropped := capValues(values, 4)
+		assert.Equal(t, values, capped)
+		assert.Equal(t, 0, dropped)
+	})
+}
+
+func TestOrderedLabels(t *testing.T) {
+	labels := data.Labels{"instance": "a", "job": "node", "cluster": "eu"}
+
+	// Labels missing from the order follow sorted, and unknown or repeated names are ignored.
+	assert.Equal(t, []KV{
+		{Key: "job", Value: "node"},
+		{Key: "cluster", Value: "eu"},
+		{Key: "instance", Value: "a"},
+	}, orderedLabels(labels, []string{"job", "unknown", "job"}))
+	assert.Equal(t, []KV{}, orderedLabels(data.Labels{}, nil))
+}
+
+func TestResultAlerting_AnnotateWillFireAt(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{
+		IntervalSeconds:    10,
+		For:                30 * time.Second,
+		AnnotateWillFireAt: true,
+	}
+
+	t.Run("annotation is added when Pending and removed when firing", func(t *testing.T) {
+		s := &State{Annotations: map[string]string{"summary": "test"}}
+		s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime})
+		require.Equal(t, eval.Pending, s.State)
+		assert.Equal(t, map[string]string{
+			"summary":                     "test",
+			ngmodels.WillFireAtAnnotation: "2021-03-25T00:00:30Z",
+		}, s.Annotations)
+
+		s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime.Add(40 * time.Second)})
+		require.Equal(t, eval.Alerting, s.State)
+		assert.Equal(t, map[string]string{"summary": "test"}, s.Annotations)
+	})
+
+	t.Run("annotation is removed when resolved", func(t *testing.T) {
+		s := &State{}
+		s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime})
+		require.Equal(t, eval.Pending, s.State)
+		assert.Contains(t, s.Annotations, ngmodels.WillFireAtAnnotation)
+
+		s.resultNormal(rule, eval.Result{State: eval.Normal, EvaluatedAt: evaluationTime.Add(10 * time.Second)})
+		assert.NotContains(t, s.Annotations, ngmodels.WillFireAtAnnotation)
+	})
+
+	t.Run("annotation is not added when disabled", func(t *testing.T) {
+		s := &State{}
+		s.resultAlerting(&ngmodels.AlertRule{IntervalSeconds: 10, For: 30 * time.Second}, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime})
+		require.Equal(t, eval.Pending, s.State)
+		assert.NotContains(t, s.Annotations, ngmodels.WillFireAtAnnotation)
+	})
+}
+
+func TestResultError_ErrorAnnotation(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{
+		IntervalSeconds: 10,
+		ExecErrState:    ngmodels.ErrorErrState,
+		Data:            []ngmodels.AlertQuery{{RefID: "A", DatasourceUID: "datasource_uid_1"}},
+	}
+
+	testCases := []struct {
+		name     string
+		err      error
+		expected string
+	}{
+		{
+			name:     "first error",
+			err:      errors.New("connection refused"),
+			expected: "connection refused",
+		},
+		{
+			name:     "the error changes on resend",
+			err:      expr.QueryError{RefID: "A", Err: errors.New("timeout")},
+			expected: "failed to execute query A: timeout",
+		},
+		{
+			name:     "the error changes again on resend",
+			err:      errors.New("bad gateway"),
+			expected: "bad gateway",
+		},
+	}
+
+	s := &State{}
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s.resultError(rule, eval.Result{
+				State:       eval.Error,
+				Error:       tc.err,
+				EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second),
+			})
+			require.Equal(t, eval.Error, s.State)
+			assert.Equal(t, tc.expected, s.Annotations["Error"])
+			assert.Equal(t, evaluationTime, s.StartsAt)
+		})
+	}
+}
+
+func TestResultError_DeduplicateErrors(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	err := expr.QueryErrors{
+		{RefID: "A", Err: errors.New("timeout")},
+		{RefID: "B", Err: errors.New("bad gateway")},
+		{RefID: "C", Err: errors.New("timeout")},
+	}
+
+	testCases := []struct {
+		name        string
+		deduplicate bool
+		expected    string
+	}{
+		{
+			name:        "duplicate messages are combined",
+			deduplicate: true,
+			expected:    "failed to execute queries A, C: timeout; failed to execute query B: bad gateway",
+		},
+		{
+			name:        "each message is kept when disabled",
+			deduplicate: false,
+			expected:    "failed to execute query A: timeout; failed to execute query B: bad gateway; failed to execute query C: timeout",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule := &ngmodels.AlertRule{
+				IntervalSeconds:   10,
+				ExecErrState:      ngmodels.ErrorErrState,
+				DeduplicateErrors: tc.deduplicate,
+			}
+			s := &State{}
+			s.resultError(rule, eval.Result{State: eval.Error, Error: err, EvaluatedAt: evaluationTime})
+			assert.Equal(t, tc.expected, s.Annotations["Error"])
+		})
+	}
+
+	t.Run("distinct messages are kept", func(t *testing.T) {
+		distinct := expr.QueryErrors{
+			{RefID: "A", Err: errors.New("timeout")},
+			{RefID: "B", Err: errors.New("bad gateway")},
+		}
+		assert.Equal(t, distinct.Error(), queryErrorsMessage(distinct, true))
+	})
+}
+
+func TestReparent(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	s := &State{
+		AlertRuleUID: "test_alert_rule_uid",
+		OrgID:        1,
+		CacheId:      `[["instance_label","test"]]`,
+		Labels:       data.Labels{"instance_label": "test"},
+		State:        eval.Alerting,
+		StartsAt:     evaluationTime,
+		Results: []Evaluation{
+			{EvaluationTime: evaluationTime, EvaluationState: eval.Alerting},
+		},
+	}
+	fingerprint := s.Fingerprint()
+
+	s.Reparent(2)
+
+	assert.Equal(t, int64(2), s.OrgID)
+	assert.Equal(t, "test_alert_rule_uid", s.AlertRuleUID)
+	assert.Equal(t, `[["instance_label","test"]]`, s.CacheId)
+	assert.Equal(t, fingerprint, s.Fingerprint())
+	assert.Equal(t, eval.Alerting, s.State)
+	assert.Equal(t, evaluationTime, s.StartsAt)
+	assert.Equal(t, []Evaluation{{EvaluationTime: evaluationTime, EvaluationState: eval.Alerting}}, s.Results)
+
+	t.Run("the CacheId is computed from the labels set before", func(t *testing.T) {
+		s.SetLabels(data.Labels{"instance_label": "test", ngmodels.NamespaceUIDLabel: "new_namespace_uid"})
+
+		s.Reparent(3)
+
+		assert.Equal(t, int64(3), s.OrgID)
+		assert.Equal(t, `[["__alert_rule_namespace_uid__","new_namespace_uid"],["instance_label","test"]]`, s.CacheId)
+		assert.Equal(t, []Evaluation{{EvaluationTime: evaluationTime, EvaluationState: eval.Alerting}}, s.Results)
+	})
+}
+
+func TestTrimResults_ResultArchiver(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{IntervalSeconds: 10, For: 20 * time.Second}
+	results := make([]Evaluation, 0, 6)
+	for i := 0; i < 6; i++ {
+		results = append(results, Evaluation{EvaluationTime: evaluationTime.Add(time.Duration(i) * 10 * time.Second)})
+	}
+
+	t.Run("dropped evaluations are handed to the archiver", func(t *testing.T) {
+		var archived []Evaluation
+		s := &State{Results: append([]Evaluation{}, results...)}
+		s.TrimResults(rule, func(dropped []Evaluation) {
+			archived = append(archived, dropped...)
+		})
+		assert.Equal(t, results[2:], s.Results)
+		assert.Equal(t, results[:2], archived)
+	})
+
+	t.Run("archiver is not called when nothing is dropped", func(t *testing.T) {
+		called := false
+		s := &State{Results: append([]Evaluation{}, results[:3]...)}
+		s.TrimResults(rule, func([]Evaluation) { called = true })
+		assert.Equal(t, results[:3], s.Results)
+		assert.False(t, called)
+	})
+
+	t.Run("evaluations are dropped without an archiver", func(t *testing.T) {
+		s := &State{Results: append([]Evaluation{}, results...)}
+		s.TrimResults(rule, nil)
+		assert.Equal(t, results[2:], s.Results)
+	})
+}
+
+func TestTrimResults_PinTransitioningEvaluation(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	// Retains 4 evaluations.
+	rule := &ngmodels.AlertRule{IntervalSeconds: 10, For: 20 * time.Second, PinTransitioningEvaluation: true}
+	results := makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting, eval.Alerting)
+	transitioning := results[1]
+
+	t.Run("the transitioning evaluation survives repeated trimming", func(t *testing.T) {
+		var archived []Evaluation
+		s := &State{State: eval.Alerting, StartsAt: transitioning.EvaluationTime}
+		for _, r := range results {
+			s.Results = append(s.Results, r)
+			s.TrimResults(rule, func(dropped []Evaluation) {
+				archived = append(archived, dropped...)
+			})
+		}
+		assert.Equal(t, append([]Evaluation{transitioning}, results[4:]...), s.Results)
+		assert.Equal(t, []Evaluation{results[0], results[2], results[3]}, archived)
+		require.NotNil(t, s.TransitioningEvaluation())
+		assert.Equal(t, transitioning, *s.TransitioningEvaluation())
+	})
+
+	t.Run("the transitioning evaluation is dropped once the state changes", func(t *testing.T) {
+		s := &State{State: eval.Alerting, StartsAt: transitioning.EvaluationTime}
+		s.Results = append([]Evaluation{transitioning}, results[4:]...)
+		s.StartsAt = results[7].EvaluationTime
+		s.TrimResults(rule, nil)
+		assert.Equal(t, results[4:], s.Results)
+	})
+
+	t.Run("the transitioning evaluation is not pinned by default", func(t *testing.T) {
+		s := &State{State: eval.Alerting, StartsAt: transitioning.EvaluationTime, Results: append([]Evaluation{}, results...)}
+		s.TrimResults(&ngmodels.AlertRule{IntervalSeconds: 10, For: 20 * time.Second}, nil)
+		assert.Equal(t, results[4:], s.Results)
+		assert.Nil(t, s.TransitioningEvaluation())
+	})
+}
+
+func TestSortedAnnotations(t *testing.T) {
+	s := &State{Annotations: map[string]string{
+		"summary":     "instance is down",
+		"runbook_url": "https://example.com/runbook",
+		"description": "instance has been down for 5m",
+		"Error":       "timeout",
+	}}
+	expected := []KV{
+		{Key: "Error", Value: "timeout"},
+		{Key: "description", Value: "instance has been down for 5m"},
+		{Key: "runbook_url", Value: "https://example.com/runbook"},
+		{Key: "summary", Value: "instance is down"},
+	}
+
+	// The order is the same regardless of the iteration order of the map.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, expected, s.SortedAnnotations())
+	}
+	assert.Empty(t, (&State{}).SortedAnnotations())
+}
+
+func TestRetentionWindow(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rule     *ngmodels.AlertRule
+		expected time.Duration
+	}{
+		{
+			name:     "without For",
+			rule:     &ngmodels.AlertRule{IntervalSeconds: 10},
+			expected: 90 * time.Second,
+		},
+		{
+			name:     "For is a multiple of the interval",
+			rule:     &ngmodels.AlertRule{IntervalSeconds: 10, For: time.Minute},
+			expected: 110 * time.Second,
+		},
+		{
+			name:     "For is not a multiple of the interval",
+			rule:     &ngmodels.AlertRule{IntervalSeconds: 10, For: 15 * time.Second},
+			expected: 30 * time.Second,
+		},
+		{
+			name:     "For is shorter than the interval",
+			rule:     &ngmodels.AlertRule{IntervalSeconds: 60, For: 30 * time.Second},
+			expected: 60 * time.Second,
+		},
+		{
+			name:     "without interval",
+			rule:     &ngmodels.AlertRule{For: time.Minute},
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, RetentionWindow(tc.rule))
+		})
+	}
+}
+
+func TestIncidentID(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{IntervalSeconds: 10}
+	s := &State{Labels: data.Labels{"instance_label": "test"}}
+	evaluate := func(i int, state eval.State) {
+		result := eval.Result{State: state, EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second)}
+		if state == eval.Alerting {
+			s.resultAlerting(rule, result)
+		} else {
+			s.resultNormal(rule, result)
+		}
+	}
+
+	evaluate(0, eval.Normal)
+	assert.Empty(t, s.IncidentID())
+
+	evaluate(1, eval.Alerting)
+	first := s.IncidentID()
+	assert.Equal(t, fmt.Sprintf("%016x-%d", s.Fingerprint(), evaluationTime.Add(10*time.Second).Unix()), first)
+
+	// The ID is stable for the duration of the episode.
+	evaluate(2, eval.Alerting)
+	evaluate(3, eval.Alerting)
+	assert.Equal(t, first, s.IncidentID())
+
+	evaluate(4, eval.Normal)
+	assert.Empty(t, s.IncidentID())
+
+	// The next episode has a different ID.
+	evaluate(5, eval.Alerting)
+	assert.NotEmpty(t, s.IncidentID())
+	assert.NotEqual(t, first, s.IncidentID())
+
+	// Alerts with different labels have different IDs.
+	other := &State{Labels: data.Labels{"instance_label": "other"}, State: eval.Alerting, StartsAt: s.StartsAt}
+	assert.NotEqual(t, s.IncidentID(), other.IncidentID())
+}
+
+func TestFiringSincePhrase(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+
+	testCases := []struct {
+		name     string
+		state    eval.State
+		since    time.Duration
+		expected string
+	}{
+		{
+			name:     "just fired",
+			state:    eval.Alerting,
+			since:    0,
+			expected: "firing for 0s",
+		},
+		{
+			name:     "seconds",
+			state:    eval.Alerting,
+			since:    45 * time.Second,
+			expected: "firing for 45s",
+		},
+		{
+			name:     "minutes and seconds",
+			state:    eval.Alerting,
+			since:    5*time.Minute + 30*time.Second,
+			expected: "firing for 5m30s",
+		},
+		{
+			name:     "hours and minutes",
+			state:    eval.Alerting,
+			since:    2*time.Hour + 15*time.Minute + 59*time.Second,
+			expected: "firing for 2h15m",
+		},
+		{
+			name:     "whole hours",
+			state:    eval.Alerting,
+			since:    3*time.Hour + 20*time.Second,
+			expected: "firing for 3h",
+		},
+		{
+			name:     "days and hours",
+			state:    eval.Alerting,
+			since:    50*time.Hour + 10*time.Minute,
+			expected: "firing for 2d2h",
+		},
+		{
+			name:     "not firing",
+			state:    eval.Pending,
+			since:    time.Hour,
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &State{State: tc.state, StartsAt: evaluationTime}
+			assert.Equal(t, tc.expected, s.FiringSincePhrase(evaluationTime.Add(tc.since)))
+		})
+	}
+}
+
+func TestAdoptHistory(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	results := makeResults(evaluationTime, eval.Normal, eval.Alerting, eval.Alerting, eval.Alerting)
+	labels := data.Labels{"instance_label": "test"}
+
+	t.Run("history is adopted on replacement", func(t *testing.T) {
+		old := &State{Labels: labels.Copy(), State: eval.Alerting, StartsAt: results[1].EvaluationTime, Results: results[:3]}
+		replacement := results[3]
+		replacement.EvaluationString = "replacement"
+		s := &State{Labels: labels.Copy(), State: eval.Alerting, StartsAt: results[3].EvaluationTime, Results: []Evaluation{results[2], replacement}}
+		s.Results[0].EvaluationString = "replacement"
+
+		s.AdoptHistory(old)
+		require.Len(t, s.Results, 4)
+		assert.Equal(t, results[:2], s.Results[:2])
+		assert.Equal(t, "replacement", s.Results[2].EvaluationString)
+		assert.Equal(t, replacement, s.Results[3])
+		assert.Equal(t, results[1].EvaluationTime, s.StartsAt)
+	})
+
+	t.Run("StartsAt is not adopted from a different state", func(t *testing.T) {
+		old := &State{Labels: labels.Copy(), State: eval.Pending, StartsAt: results[1].EvaluationTime, Results: results[:3]}
+		s := &State{Labels: labels.Copy(), State: eval.Alerting, StartsAt: results[3].EvaluationTime, Results: results[3:]}
+		s.AdoptHistory(old)
+		assert.Equal(t, results, s.Results)
+		assert.Equal(t, results[3].EvaluationTime, s.StartsAt)
+	})
+
+	t.Run("history of a different alert is not adopted", func(t *testing.T) {
+		old := &State{Labels: data.Labels{"instance_label": "other"}, State: eval.Alerting, StartsAt: results[1].EvaluationTime, Results: results[:3]}
+		s := &State{Labels: labels.Copy(), State: eval.Alerting, StartsAt: results[3].EvaluationTime, Results: results[3:]}
+		s.AdoptHistory(old)
+		assert.Equal(t, results[3:], s.Results)
+		assert.Equal(t, results[3].EvaluationTime, s.StartsAt)
+	})
+}
+
+func TestResultNormal_MinResolvedDwell(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{IntervalSeconds: 10, MinResolvedDwell: 20 * time.Second}
+	s := &State{}
+	evaluate := func(i int, state eval.State) time.Time {
+		result := eval.Result{State: state, EvaluatedAt: evaluationTime.Add(time.Duration(i) * 10 * time.Second)}
+		s.Results = append(s.Results, Evaluation{EvaluationTime: result.EvaluatedAt, EvaluationState: state})
+		s.recordClear(state, result.EvaluatedAt)
+		if state == eval.Alerting {
+			s.resultAlerting(rule, result)
+		} else {
+			s.resultNormal(rule, result)
+		}
+		return result.EvaluatedAt
+	}
+
+	evaluate(0, eval.Alerting)
+	require.Equal(t, eval.Alerting, s.State)
+
+	// The resolve is deferred until the condition has been clear for the dwell.
+	evaluate(1, eval.Normal)
+	assert.Equal(t, eval.Alerting, s.State)
+	evaluate(2, eval.Normal)
+	assert.Equal(t, eval.Alerting, s.State)
+
+	// Firing again restarts the dwell.
+	evaluate(3, eval.Alerting)
+	assert.Equal(t, eval.Alerting, s.State)
+	assert.Equal(t, evaluationTime, s.StartsAt)
+	evaluate(4, eval.Normal)
+	evaluate(5, eval.Normal)
+	assert.Equal(t, eval.Alerting, s.State)
+
+	resolvedAt := evaluate(6, eval.Normal)
+	assert.Equal(t, eval.Normal, s.State)
+	assert.Equal(t, resolvedAt, s.StartsAt)
+	assert.Equal(t, resolvedAt, s.EndsAt)
+}
+
+func TestResultNormal_MinMaturityBeforeResolve(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngmodels.AlertRule{IntervalSeconds: 10, MinMaturityBeforeResolve: 30 * time.Second}
+
+	s := &State{}
+	s.resultAlerting(rule, eval.Result{State: eval.Alerting, EvaluatedAt: evaluationTime})
+	require.Equal(t, eval.Alerting, s.State)
+
+	// The resolve of a young alert is deferred.
+	for _, after := range []time.Duration{10 * time.Second, 20 * time.Second} {
+		evaluatedAt := evaluationTime.Add(after)
+		s.resultNormal(rule, eval.Result{State: eval.Normal, EvaluatedAt: evaluatedAt})
+		assert.Equal(t, eval.Alerting, s.State, "after %s", after)
+		assert.Equal(t, evaluationTime, s.StartsAt)
+		assert.Equal(t, evaluatedAt.Add(ResendDelay*3), s.EndsAt)
+	}
+
+	// A mature alert resolves.
+	resolvedAt := evaluationTime.Add(30 * time.Second)
+	s.resultNormal(rule, eval.Result{State: eval.Normal, EvaluatedAt: resolvedAt})
+	assert.Equal(t, eval.Normal, s.State)
+	assert.Equal(t, resolvedAt, s.StartsAt)
+	assert.Equal(t, resolvedAt, s.EndsAt)
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"sort"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/prometheus/alertmanager/pkg/labels"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+)
+
+// SuppressionWindow is a daily recurring window of time during which states with
+// matching labels are not sent, such as batch job alerts overnight.
+type SuppressionWindow struct {
+	// Matchers select the states to suppress. A state must match all of them.
+	Matchers []*labels.Matcher
+	// Start and End are the offsets since midnight UTC at which the window starts
+	// and ends. The window spans midnight if End is before Start.
+	Start, End time.Duration
+}
+
+// Suppresses returns true if a state with the given labels is suppressed at time t.
+func (w SuppressionWindow) Suppresses(l data.Labels, t time.Time) bool {
+	for _, m := range w.Matchers {
+		if !m.Matches(l[m.Name]) {
+			return false
+		}
+	}
+	t = t.UTC()
+	offset := t.Sub(time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC))
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// Silence is a silence or inhibition of the Alertmanager, reduced to what is needed to
+// know when it suppressed a state.
+type Silence struct {
+	// Matchers select the states to suppress. A state must match all of them.
+	Matchers []*labels.Matcher
+	// StartsAt and EndsAt are when the silence is active.
+	StartsAt, EndsAt time.Time
+}
+
+// matches returns true if a state with the given labels matches the silence.
+func (s Silence) matches(l data.Labels) bool {
+	for _, m := range s.Matchers {
+		if !m.Matches(l[m.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SuppressionCoverage returns the fraction of the time the state was firing within the
+// period before now that it was suppressed by the silences. Each Alerting evaluation in
+// Results counts as firing until the next evaluation, or until now for the latest one.
+// It returns zero if the state was not firing within the period.
+func (a *State) SuppressionCoverage(silences []Silence, period time.Duration, now time.Time) float64 {
+	from := now.Add(-period)
+	clip := func(start, end time.Time) (time.Time, time.Time) {
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(now) {
+			end = now
+		}
+		return start, end
+	}
+
+	type interval struct{ start, end time.Time }
+	var suppressed []interval
+	for _, s := range silences {
+		if !s.matches(a.Labels) {
+			continue
+		}
+		if start, end := clip(s.StartsAt, s.EndsAt); start.Before(end) {
+			suppressed = append(suppressed, interval{start, end})
+		}
+	}
+	// Merge overlapping silences so overlaps are not counted twice.
+	sort.Slice(suppressed, func(i, j int) bool {
+		return suppressed[i].start.Before(suppressed[j].start)
+	})
+	var merged []interval
+	for _, s := range suppressed {
+		if n := len(merged); n > 0 && !s.start.After(merged[n-1].end) {
+			if s.end.After(merged[n-1].end) {
+				merged[n-1].end = s.end
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+
+	var firing, covered time.Duration
+	for i, r := range a.Results {
+		if r.EvaluationState != eval.Alerting {
+			continue
+		}
+		end := now
+		if i < len(a.Results)-1 {
+			end = a.Results[i+1].EvaluationTime
+		}
+		start, end := clip(r.EvaluationTime, end)
+		if !start.Before(end) {
+			continue
+		}
+		firing += end.Sub(start)
+		for _, s := range merged {
+			overlapStart, overlapEnd := start, end
+			if s.start.After(overlapStart) {
+				overlapStart = s.start
+			}
+			if s.end.Before(overlapEnd) {
+				overlapEnd = s.end
+			}
+			if overlapStart.Before(overlapEnd) {
+				covered += overlapEnd.Sub(overlapStart)
+			}
+		}
+	}
+	if firing == 0 {
+		return 0
+	}
+	return float64(covered) / float64(firing)
+}
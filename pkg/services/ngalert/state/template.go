@@ -11,7 +11,10 @@ import (
 
 	text_template "text/template"
 
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
 	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/promql"
@@ -23,25 +26,43 @@ import (
 type templateCaptureValue struct {
 	Labels map[string]string
 	Value  float64
+
+	// evaluationString is printed instead of the value for classic conditions,
+	// which do not have a value per RefID.
+	evaluationString string
+	// format is an optional fmt format used to print the value.
+	format string
 }
 
 // String implements the Stringer interface to print the value of each RefID
 // in the template via {{ $values.A }} rather than {{ $values.A.Value }}.
 func (v templateCaptureValue) String() string {
+	if v.evaluationString != "" {
+		return v.evaluationString
+	}
+	if v.format != "" {
+		return fmt.Sprintf(v.format, v.Value)
+	}
 	return strconv.FormatFloat(v.Value, 'f', -1, 64)
 }
 
-func expandTemplate(ctx context.Context, name, text string, labels map[string]string, alertInstance eval.Result, externalURL *url.URL) (result string, resultErr error) {
-	name = "__alert_" + name
-	text = "{{- $labels := .Labels -}}{{- $values := .Values -}}{{- $value := .Value -}}" + text
+// expandTemplate expands the text of a label or annotation template. previous are the
+// values of the previous evaluation, available as $previous in the template. It is
+// empty on the first evaluation. siblings are the labels of related states by name,
+// available with the sibling function.
+func expandTemplate(ctx context.Context, alertRule *ngModels.AlertRule, text string, labels map[string]string, alertInstance eval.Result, previous map[string]*float64, siblings map[string]data.Labels, externalURL *url.URL, loc *time.Location) (result string, resultErr error) {
+	name := "__alert_" + alertRule.Title
+	text = "{{- $labels := .Labels -}}{{- $values := .Values -}}{{- $value := .Value -}}{{- $previous := .Previous -}}" + text
 	data := struct {
-		Labels map[string]string
-		Values map[string]templateCaptureValue
-		Value  string
+		Labels   map[string]string
+		Values   map[string]templateCaptureValue
+		Value    string
+		Previous map[string]templateCaptureValue
 	}{
-		Labels: labels,
-		Values: newTemplateCaptureValues(alertInstance.Values),
-		Value:  alertInstance.EvaluationString,
+		Labels:   labels,
+		Values:   newTemplateCaptureValues(alertRule, alertInstance),
+		Value:    alertInstance.EvaluationString,
+		Previous: newPreviousCaptureValues(alertRule, previous),
 	}
 
 	expander := template.NewTemplateExpander(
@@ -58,8 +79,10 @@ func expandTemplate(ctx context.Context, name, text string, labels map[string]st
 	)
 
 	expander.Funcs(text_template.FuncMap{
-		"graphLink": graphLink,
-		"tableLink": tableLink,
+		"graphLink":         graphLink,
+		"tableLink":         tableLink,
+		"humanizeTimestamp": humanizeTimestamp(loc),
+		"sibling":           sibling(siblings),
 
 		// This function is a no-op for now.
 		"strvalue": func(value templateCaptureValue) string {
@@ -70,23 +93,91 @@ func expandTemplate(ctx context.Context, name, text string, labels map[string]st
 	return expander.Expand()
 }
 
-func newTemplateCaptureValues(values map[string]eval.NumberValueCapture) map[string]templateCaptureValue {
+func newTemplateCaptureValues(alertRule *ngModels.AlertRule, alertInstance eval.Result) map[string]templateCaptureValue {
 	m := make(map[string]templateCaptureValue)
-	for k, v := range values {
+	if len(alertInstance.Values) == 0 && alertInstance.EvaluationString != "" && alertRule.Condition != "" {
+		// Classic conditions do not have values per RefID, so the evaluation string
+		// is used as the value of the condition to avoid blank annotations.
+		m[alertRule.Condition] = templateCaptureValue{
+			Value:            math.NaN(),
+			evaluationString: alertInstance.EvaluationString,
+		}
+		return m
+	}
+	for k, v := range alertInstance.Values {
 		var f float64
 		if v.Value != nil {
-			f = *v.Value
+			f, _ = alertRule.ValueClamps[k].Clamp(*v.Value)
 		} else {
 			f = math.NaN()
 		}
 		m[k] = templateCaptureValue{
 			Labels: v.Labels,
 			Value:  f,
+			format: alertRule.ValueFormats[k],
+		}
+	}
+	return m
+}
+
+// newPreviousCaptureValues returns the values of the previous evaluation for the
+// template. The labels of the values are not kept in the evaluations.
+func newPreviousCaptureValues(alertRule *ngModels.AlertRule, previous map[string]*float64) map[string]templateCaptureValue {
+	m := make(map[string]templateCaptureValue, len(previous))
+	for k, v := range previous {
+		f := math.NaN()
+		if v != nil {
+			f, _ = alertRule.ValueClamps[k].Clamp(*v)
+		}
+		m[k] = templateCaptureValue{
+			Value:  f,
+			format: alertRule.ValueFormats[k],
 		}
 	}
 	return m
 }
 
+// SiblingLabels returns the labels of the states related to the state with the given
+// labels, by name, such as of the primary of a replica. Only the returned labels can be
+// referenced in the annotation templates of the rule.
+type SiblingLabels func(alertRule *ngModels.AlertRule, labels data.Labels) map[string]data.Labels
+
+// sibling returns a function that returns the value of a label of a sibling by name,
+// as in {{ sibling "primary" "instance" }}. It returns an empty string if the sibling
+// or the label does not exist, so templates do not fail when a sibling is missing.
+func sibling(siblings map[string]data.Labels) func(name, label string) string {
+	return func(name, label string) string {
+		return siblings[name][label]
+	}
+}
+
+// humanizeTimestamp returns a function that formats a Unix timestamp in seconds
+// in the given location. It replaces the Prometheus function of the same name
+// which always uses UTC.
+func humanizeTimestamp(loc *time.Location) func(interface{}) (string, error) {
+	return func(i interface{}) (string, error) {
+		var v float64
+		switch t := i.(type) {
+		case templateCaptureValue:
+			v = t.Value
+		case float64:
+			v = t
+		case string:
+			f, err := strconv.ParseFloat(t, 64)
+			if err != nil {
+				return "", err
+			}
+			v = f
+		default:
+			return "", fmt.Errorf("can't convert %T to float", i)
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprintf("%.4g", v), nil
+		}
+		return fmt.Sprint(model.TimeFromUnixNano(int64(v * 1e9)).Time().In(loc)), nil
+	}
+}
+
 type query struct {
 	Datasource string `json:"datasource"`
 	Expr       string `json:"expr"`
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	ptr "github.com/xorcare/pointer"
@@ -140,7 +142,7 @@ func TestExpandTemplate(t *testing.T) {
 		alertInstance: eval.Result{
 			EvaluationString: "invalid",
 		},
-		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:79: executing "__alert_test" at <humanize $value>: error calling humanize: strconv.ParseFloat: parsing "invalid": invalid syntax`),
+		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:109: executing "__alert_test" at <humanize $value>: error calling humanize: strconv.ParseFloat: parsing "invalid": invalid syntax`),
 	}, {
 		name: "humanize1024 float64",
 		text: "{{ range $key, $val := $values }}{{ humanize1024 .Value }}:{{ end }}",
@@ -175,7 +177,7 @@ func TestExpandTemplate(t *testing.T) {
 		alertInstance: eval.Result{
 			EvaluationString: "invalid",
 		},
-		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:79: executing "__alert_test" at <humanize1024 $value>: error calling humanize1024: strconv.ParseFloat: parsing "invalid": invalid syntax`),
+		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:109: executing "__alert_test" at <humanize1024 $value>: error calling humanize1024: strconv.ParseFloat: parsing "invalid": invalid syntax`),
 	}, {
 		name: "humanizeDuration - seconds - float64",
 		text: "{{ range $key, $val := $values }}{{ humanizeDuration .Value }}:{{ end }}",
@@ -294,7 +296,7 @@ func TestExpandTemplate(t *testing.T) {
 		alertInstance: eval.Result{
 			EvaluationString: "invalid",
 		},
-		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:79: executing "__alert_test" at <humanizeDuration $value>: error calling humanizeDuration: strconv.ParseFloat: parsing "invalid": invalid syntax`),
+		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:109: executing "__alert_test" at <humanizeDuration $value>: error calling humanizeDuration: strconv.ParseFloat: parsing "invalid": invalid syntax`),
 	}, {
 		name:     "humanizePercentage - float64",
 		text:     "{{ -0.22222 | humanizePercentage }}:{{ 0.0 | humanizePercentage }}:{{ 0.1234567 | humanizePercentage }}:{{ 1.23456 | humanizePercentage }}",
@@ -306,7 +308,7 @@ func TestExpandTemplate(t *testing.T) {
 	}, {
 		name:          "humanizePercentage - string with error",
 		text:          `{{ "invalid" | humanizePercentage }}`,
-		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:91: executing "__alert_test" at <humanizePercentage>: error calling humanizePercentage: strconv.ParseFloat: parsing "invalid": invalid syntax`),
+		expectedError: errors.New(`error executing template __alert_test: template: __alert_test:1:121: executing "__alert_test" at <humanizePercentage>: error calling humanizePercentage: strconv.ParseFloat: parsing "invalid": invalid syntax`),
 	}, {
 		name:     "humanizeTimestamp - float64",
 		text:     "{{ 1435065584.128 | humanizeTimestamp }}",
@@ -404,7 +406,7 @@ func TestExpandTemplate(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-			v, err := expandTemplate(context.Background(), "test", c.text, c.labels, c.alertInstance, externalURL)
+			v, err := expandTemplate(context.Background(), &ngModels.AlertRule{Title: "test"}, c.text, c.labels, c.alertInstance, nil, nil, externalURL, time.UTC)
 			if c.expectedError != nil {
 				require.NotNil(t, err)
 				require.EqualError(t, c.expectedError, err.Error())
@@ -415,3 +417,230 @@ func TestExpandTemplate(t *testing.T) {
 		})
 	}
 }
+
+func TestExpandTemplate_Timezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	alertInstance := eval.Result{
+		Values: map[string]eval.NumberValueCapture{
+			"A": {
+				Var:   "A",
+				Value: ptr.Float64(1616630400),
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		text     string
+		loc      *time.Location
+		expected string
+	}{{
+		name:     "timestamp is rendered in UTC",
+		text:     `{{ "1616630400" | humanizeTimestamp }}`,
+		loc:      time.UTC,
+		expected: "2021-03-25 00:00:00 +0000 UTC",
+	}, {
+		name:     "timestamp is rendered in the location",
+		text:     `{{ "1616630400" | humanizeTimestamp }}`,
+		loc:      loc,
+		expected: "2021-03-24 20:00:00 -0400 EDT",
+	}, {
+		name:     "timestamp from $values is rendered in the location",
+		text:     "{{ $values.A | humanizeTimestamp }}",
+		loc:      loc,
+		expected: "2021-03-24 20:00:00 -0400 EDT",
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := expandTemplate(context.Background(), &ngModels.AlertRule{Title: "test"}, c.text, data.Labels{}, alertInstance, nil, nil, nil, c.loc)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, v)
+		})
+	}
+}
+
+func TestExpandTemplate_ClassicCondition(t *testing.T) {
+	alertRule := &ngModels.AlertRule{Title: "test", Condition: "B"}
+	evaluationString := "[ metric='cpu' labels={instance=foo} value=95 ]"
+
+	cases := []struct {
+		name          string
+		text          string
+		alertInstance eval.Result
+		expected      string
+	}{{
+		name: "evaluation string is used as the value of the condition",
+		text: "{{ $values.B }}",
+		alertInstance: eval.Result{
+			EvaluationString: evaluationString,
+		},
+		expected: evaluationString,
+	}, {
+		name: "evaluation string is used as $value",
+		text: "{{ $value }}",
+		alertInstance: eval.Result{
+			EvaluationString: evaluationString,
+		},
+		expected: evaluationString,
+	}, {
+		name: "values take precedence over the evaluation string",
+		text: "{{ $values.B }}",
+		alertInstance: eval.Result{
+			EvaluationString: "[ var='B' labels={} value=1 ]",
+			Values: map[string]eval.NumberValueCapture{
+				"B": {
+					Var:   "B",
+					Value: ptr.Float64(1),
+				},
+			},
+		},
+		expected: "1",
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := expandTemplate(context.Background(), alertRule, c.text, data.Labels{}, c.alertInstance, nil, nil, nil, time.UTC)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, v)
+		})
+	}
+}
+
+func TestExpandTemplate_ValueFormats(t *testing.T) {
+	alertRule := &ngModels.AlertRule{
+		Title: "test",
+		ValueFormats: map[string]string{
+			"A": "%.0f",
+			"B": "%.2f%%",
+		},
+	}
+	alertInstance := eval.Result{
+		Values: map[string]eval.NumberValueCapture{
+			"A": {
+				Var:   "A",
+				Value: ptr.Float64(1073741824.4),
+			},
+			"B": {
+				Var:   "B",
+				Value: ptr.Float64(93.456),
+			},
+			"C": {
+				Var:   "C",
+				Value: ptr.Float64(0.5),
+			},
+		},
+	}
+
+	v, err := expandTemplate(context.Background(), alertRule, "{{ $values.A }} bytes used, {{ $values.B }} full, {{ $values.C }} ratio", data.Labels{}, alertInstance, nil, nil, nil, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, "1073741824 bytes used, 93.46% full, 0.5 ratio", v)
+}
+
+func TestExpandTemplate_ValueClamps(t *testing.T) {
+	alertRule := &ngModels.AlertRule{
+		Title: "test",
+		ValueClamps: map[string]ngModels.ValueClamp{
+			"A": {Min: ptr.Float64(-40), Max: ptr.Float64(120)},
+			"B": {Min: ptr.Float64(-40), Max: ptr.Float64(120)},
+			"C": {Min: ptr.Float64(-40), Max: ptr.Float64(120)},
+		},
+	}
+	alertInstance := eval.Result{
+		Values: map[string]eval.NumberValueCapture{
+			"A": {Var: "A", Value: ptr.Float64(-273)},
+			"B": {Var: "B", Value: ptr.Float64(65535)},
+			"C": {Var: "C", Value: ptr.Float64(21.5)},
+			"D": {Var: "D", Value: ptr.Float64(65535)},
+		},
+	}
+	previous := map[string]*float64{"A": ptr.Float64(-1000)}
+
+	v, err := expandTemplate(context.Background(), alertRule, "{{ $values.A }} {{ $values.B }} {{ $values.C }} {{ $values.D }} {{ $previous.A }}", data.Labels{}, alertInstance, previous, nil, nil, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, "-40 120 21.5 65535 -40", v)
+}
+
+func TestExpandTemplate_Previous(t *testing.T) {
+	alertRule := &ngModels.AlertRule{Title: "test"}
+	alertInstance := eval.Result{
+		Values: map[string]eval.NumberValueCapture{
+			"A": {
+				Var:   "A",
+				Value: ptr.Float64(2),
+			},
+		},
+	}
+	text := "changed from {{ $previous.A }} to {{ $values.A }}"
+
+	cases := []struct {
+		name     string
+		text     string
+		previous map[string]*float64
+		expected string
+	}{{
+		name:     "previous value is substituted",
+		text:     text,
+		previous: map[string]*float64{"A": ptr.Float64(1)},
+		expected: "changed from 1 to 2",
+	}, {
+		name:     "first evaluation has no previous value",
+		text:     text,
+		expected: "changed from <no value> to 2",
+	}, {
+		name:     "first evaluation can be handled in the template",
+		text:     "{{ with $previous.A }}changed from {{ . }} to {{ end }}{{ $values.A }}",
+		expected: "2",
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := expandTemplate(context.Background(), alertRule, c.text, data.Labels{}, alertInstance, c.previous, nil, nil, time.UTC)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, v)
+		})
+	}
+}
+
+func TestExpandTemplate_Sibling(t *testing.T) {
+	alertRule := &ngModels.AlertRule{Title: "test"}
+	siblings := map[string]data.Labels{
+		"primary": {"instance": "db-1"},
+	}
+
+	cases := []struct {
+		name     string
+		text     string
+		siblings map[string]data.Labels
+		expected string
+	}{{
+		name:     "sibling label is substituted",
+		text:     `replica of {{ sibling "primary" "instance" }}`,
+		siblings: siblings,
+		expected: "replica of db-1",
+	}, {
+		name:     "missing sibling is empty",
+		text:     `replica of {{ sibling "standby" "instance" }}`,
+		siblings: siblings,
+		expected: "replica of ",
+	}, {
+		name:     "missing label of sibling is empty",
+		text:     `replica of {{ sibling "primary" "zone" }}`,
+		siblings: siblings,
+		expected: "replica of ",
+	}, {
+		name:     "no siblings",
+		text:     `{{ with sibling "primary" "instance" }}replica of {{ . }}{{ else }}no primary{{ end }}`,
+		expected: "no primary",
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			v, err := expandTemplate(context.Background(), alertRule, c.text, data.Labels{}, eval.Result{}, nil, c.siblings, nil, time.UTC)
+			require.NoError(t, err)
+			require.Equal(t, c.expected, v)
+		})
+	}
+}
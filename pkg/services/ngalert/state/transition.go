@@ -0,0 +1,110 @@
+package state
+
+import (
+	"math"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+// TransitionObserver is called with a state after it is processed, and the state
+// it had before. The state must not be modified.
+type TransitionObserver func(alertRule *ngModels.AlertRule, oldState eval.State, s *State)
+
+// Event is an event of a state that is more specific than the change of its value,
+// passed to the EventObserver of the Manager.
+type Event int
+
+const (
+	// EventNoLongerNoData is emitted when a NoData state returns to Normal because its
+	// queries returned data again, to tell a data recovery from a condition recovery.
+	EventNoLongerNoData Event = iota
+	// EventThresholdProximity is a low-priority warning emitted when the value of a Normal
+	// state comes within the ProximityMargin of the Threshold of its rule, before it
+	// breaches. It is emitted once each time the value enters the margin.
+	EventThresholdProximity
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventNoLongerNoData:
+		return "NoLongerNoData"
+	case EventThresholdProximity:
+		return "ThresholdProximity"
+	default:
+		return "Unknown"
+	}
+}
+
+// EventObserver is called with the events of a state after it is processed, and the
+// state it had before. The state must not be modified.
+type EventObserver func(event Event, alertRule *ngModels.AlertRule, oldState eval.State, s *State)
+
+// stateEvents returns the events of the state of the rule, which changed from oldState.
+func stateEvents(alertRule *ngModels.AlertRule, oldState eval.State, s *State) []Event {
+	n := len(s.Results)
+	if s.State != eval.Normal || n == 0 || s.Results[n-1].EvaluationState != eval.Normal {
+		return nil
+	}
+	var events []Event
+	if oldState == eval.NoData {
+		events = append(events, EventNoLongerNoData)
+	}
+	if nearThreshold(alertRule, s.Results[n-1]) && (n == 1 || !nearThreshold(alertRule, s.Results[n-2])) {
+		events = append(events, EventThresholdProximity)
+	}
+	return events
+}
+
+// nearThreshold returns true if the value of the threshold's RefID in the evaluation is
+// within the ProximityMargin of the rule's threshold without breaching it.
+func nearThreshold(alertRule *ngModels.AlertRule, e Evaluation) bool {
+	if alertRule.Threshold == nil || alertRule.ProximityMargin <= 0 {
+		return false
+	}
+	threshold := *alertRule.Threshold
+	v := e.Values[threshold.RefID]
+	if v == nil || math.IsNaN(*v) || threshold.Breached(*v) {
+		return false
+	}
+	return math.Abs(threshold.Value-*v) <= alertRule.ProximityMargin*math.Abs(threshold.Value)
+}
+
+// EmissionMode configures when the TransitionObserver of the Manager is called.
+type EmissionMode int
+
+const (
+	// EmitOnChange calls the observer only when a state changes.
+	EmitOnChange EmissionMode = iota
+	// EmitOnEvaluation calls the observer on every evaluation of a state, such as
+	// for streaming integrations.
+	EmitOnEvaluation
+	// EmitHeartbeat calls the observer when a state changes, and as a heartbeat on
+	// every successful evaluation of a Normal state, such as for dead man's switches
+	// that detect when the heartbeats stop.
+	EmitHeartbeat
+)
+
+func (m EmissionMode) String() string {
+	switch m {
+	case EmitOnEvaluation:
+		return "EmitOnEvaluation"
+	case EmitHeartbeat:
+		return "EmitHeartbeat"
+	default:
+		return "EmitOnChange"
+	}
+}
+
+// shouldEmit returns true if the state, which changed from oldState, is emitted in
+// this mode.
+func (m EmissionMode) shouldEmit(oldState eval.State, s *State) bool {
+	switch {
+	case m == EmitOnEvaluation || oldState != s.State:
+		return true
+	case m == EmitHeartbeat && s.State == eval.Normal:
+		return len(s.Results) > 0 && s.Results[len(s.Results)-1].EvaluationState == eval.Normal
+	default:
+		return false
+	}
+}
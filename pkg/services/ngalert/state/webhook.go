@@ -0,0 +1,196 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+const (
+	defaultWebhookTimeout   = 10 * time.Second
+	defaultWebhookBackoff   = time.Second
+	defaultWebhookQueueSize = 1000
+)
+
+// WebhookOpts configures the webhook observer returned by NewWebhookObserver.
+type WebhookOpts struct {
+	// Client is the HTTP client used to post the payloads. If nil, a client with a
+	// timeout of 10 seconds is used.
+	Client *http.Client
+	// MaxRetries is the number of times a payload that could not be posted is retried
+	// before it is dropped.
+	MaxRetries int
+	// Backoff is how long to wait before the first retry, which doubles on each of the
+	// next retries. If zero, it is 1 second.
+	Backoff time.Duration
+	// QueueSize is the number of payloads that can wait to be posted. Payloads observed
+	// while the queue is full are dropped. If zero, it is 1000.
+	QueueSize int
+	// Logger logs the payloads that are dropped. If nil, the logger of the package is used.
+	Logger log.Logger
+}
+
+// WebhookPayload is the payload posted by the webhook observer for each transition.
+type WebhookPayload struct {
+	OrgID          int64       `json:"orgId"`
+	RuleUID        string      `json:"ruleUid"`
+	RuleTitle      string      `json:"ruleTitle"`
+	Labels         data.Labels `json:"labels"`
+	OldState       string      `json:"oldState"`
+	State          string      `json:"state"`
+	StartsAt       time.Time   `json:"startsAt"`
+	LastEvaluation time.Time   `json:"lastEvaluation"`
+}
+
+// WebhookObserver posts a WebhookPayload as JSON to a URL for each transition it
+// observes. Its Observe method is a TransitionObserver.
+type WebhookObserver struct {
+	url    string
+	opts   WebhookOpts
+	queue  chan []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewWebhookObserver returns a WebhookObserver that posts to the URL until ctx is done
+// or it is stopped. Payloads are queued and posted one at a time in the order they are
+// observed by a single worker, so a slow webhook does not delay the evaluation of rules
+// and the transitions of a state are posted in order. A payload is retried with backoff
+// when the request fails or the response is 429 Too Many Requests or a 5xx status,
+// and dropped once the retries are exhausted or on any other non-2xx status.
+func NewWebhookObserver(ctx context.Context, url string, opts WebhookOpts) *WebhookObserver {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultWebhookBackoff
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultWebhookQueueSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New("ngalert.state.webhook")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	w := &WebhookObserver{
+		url:    url,
+		opts:   opts,
+		queue:  make(chan []byte, opts.QueueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Observe queues the payload of the transition of the state to be posted. It does not
+// block: the payload is dropped if the queue is full or the observer is stopped.
+func (w *WebhookObserver) Observe(alertRule *ngModels.AlertRule, oldState eval.State, s *State) {
+	if w.ctx.Err() != nil {
+		return
+	}
+	// The payload is built before returning, as the state changes after the observer.
+	body, err := json.Marshal(WebhookPayload{
+		OrgID:          s.OrgID,
+		RuleUID:        alertRule.UID,
+		RuleTitle:      alertRule.Title,
+		Labels:         s.Labels.Copy(),
+		OldState:       oldState.String(),
+		State:          s.State.String(),
+		StartsAt:       s.StartsAt,
+		LastEvaluation: s.LastEvaluationTime,
+	})
+	if err != nil {
+		w.opts.Logger.Error("failed to marshal state transition", "uid", alertRule.UID, "err", err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		w.opts.Logger.Warn("dropping state transition as the queue is full", "uid", alertRule.UID, "size", w.opts.QueueSize)
+	}
+}
+
+// Stop stops the observer and waits for the worker to return. The payload being posted
+// is not retried, and the payloads still in the queue are dropped.
+func (w *WebhookObserver) Stop() {
+	w.cancel()
+	<-w.done
+}
+
+// run posts the queued payloads until the observer is stopped.
+func (w *WebhookObserver) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.ctx.Done():
+			if n := len(w.queue); n > 0 {
+				w.opts.Logger.Warn("dropping state transitions as the observer is stopped", "count", n)
+			}
+			return
+		case body := <-w.queue:
+			w.post(body)
+		}
+	}
+}
+
+// post posts the body to the URL, retrying according to the options until the
+// observer is stopped.
+func (w *WebhookObserver) post(body []byte) {
+	backoff := w.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := postWebhookOnce(w.ctx, w.url, body, w.opts.Client)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.opts.MaxRetries || w.ctx.Err() != nil {
+			w.opts.Logger.Error("dropping state transition that could not be posted", "url", w.url, "attempts", attempt+1, "err", err)
+			return
+		}
+		w.opts.Logger.Debug("retrying state transition that could not be posted", "url", w.url, "backoff", backoff, "err", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-w.ctx.Done():
+			timer.Stop()
+			w.opts.Logger.Error("dropping state transition that could not be posted as the observer is stopped", "url", w.url, "attempts", attempt+1, "err", err)
+			return
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// postWebhookOnce posts the body to the URL. It returns whether the request can be
+// retried if it failed.
+func postWebhookOnce(ctx context.Context, url string, body []byte, client *http.Client) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
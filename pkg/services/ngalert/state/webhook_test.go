@@ -0,0 +1,169 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/services/ngalert/eval"
+	ngModels "github.com/grafana/grafana/pkg/services/ngalert/models"
+)
+
+func TestNewWebhookObserver(t *testing.T) {
+	evaluationTime, _ := time.Parse("2006-01-02", "2021-03-25")
+	rule := &ngModels.AlertRule{UID: "test_alert_rule_uid", Title: "test_title"}
+	s := &State{
+		OrgID:              1,
+		Labels:             data.Labels{"instance_label": "test"},
+		State:              eval.Alerting,
+		StartsAt:           evaluationTime,
+		LastEvaluationTime: evaluationTime,
+	}
+
+	// serve returns a test server that fails the first failures requests with status
+	// and then succeeds, and the channel of the payloads it accepted.
+	serve := func(t *testing.T, failures int32, status int) (*httptest.Server, *int32, chan WebhookPayload) {
+		var attempts int32
+		received := make(chan WebhookPayload, 1)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&attempts, 1) <= failures {
+				w.WriteHeader(status)
+				return
+			}
+			var payload WebhookPayload
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+			received <- payload
+		}))
+		t.Cleanup(srv.Close)
+		return srv, &attempts, received
+	}
+
+	t.Run("the transition is retried until it succeeds", func(t *testing.T) {
+		srv, attempts, received := serve(t, 2, http.StatusServiceUnavailable)
+		observer := NewWebhookObserver(context.Background(), srv.URL, WebhookOpts{MaxRetries: 3, Backoff: time.Millisecond})
+		t.Cleanup(observer.Stop)
+		observer.Observe(rule, eval.Pending, s)
+
+		select {
+		case payload := <-received:
+			assert.Equal(t, WebhookPayload{
+				OrgID:          1,
+				RuleUID:        "test_alert_rule_uid",
+				RuleTitle:      "test_title",
+				Labels:         data.Labels{"instance_label": "test"},
+				OldState:       "Pending",
+				State:          "Alerting",
+				StartsAt:       evaluationTime,
+				LastEvaluation: evaluationTime,
+			}, payload)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the transition was not posted")
+		}
+		assert.Equal(t, int32(3), atomic.LoadInt32(attempts))
+	})
+
+	t.Run("the transition is dropped once the retries are exhausted", func(t *testing.T) {
+		srv, attempts, received := serve(t, 3, http.StatusServiceUnavailable)
+		observer := NewWebhookObserver(context.Background(), srv.URL, WebhookOpts{MaxRetries: 2, Backoff: time.Millisecond})
+		t.Cleanup(observer.Stop)
+		observer.Observe(rule, eval.Pending, s)
+
+		require.Eventually(t, func() bool { return atomic.LoadInt32(attempts) == 3 }, 5*time.Second, time.Millisecond)
+		// Wait longer than the backoff to check there is no further attempt.
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int32(3), atomic.LoadInt32(attempts))
+		assert.Empty(t, received)
+	})
+
+	t.Run("the transition is not retried on a client error", func(t *testing.T) {
+		srv, attempts, received := serve(t, 1, http.StatusBadRequest)
+		observer := NewWebhookObserver(context.Background(), srv.URL, WebhookOpts{MaxRetries: 3, Backoff: time.Millisecond})
+		t.Cleanup(observer.Stop)
+		observer.Observe(rule, eval.Pending, s)
+
+		require.Eventually(t, func() bool { return atomic.LoadInt32(attempts) == 1 }, 5*time.Second, time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(attempts))
+		assert.Empty(t, received)
+	})
+
+	t.Run("the transitions are posted in the order they are observed", func(t *testing.T) {
+		srv, _, received := serve(t, 0, http.StatusOK)
+		observer := NewWebhookObserver(context.Background(), srv.URL, WebhookOpts{Backoff: time.Millisecond})
+		t.Cleanup(observer.Stop)
+		transitions := []eval.State{eval.Normal, eval.Pending, eval.Alerting, eval.Normal}
+		for i := 1; i < len(transitions); i++ {
+			next := *s
+			next.State = transitions[i]
+			next.LastEvaluationTime = evaluationTime.Add(time.Duration(i) * time.Minute)
+			observer.Observe(rule, transitions[i-1], &next)
+		}
+
+		for i := 1; i < len(transitions); i++ {
+			select {
+			case payload := <-received:
+				assert.Equal(t, transitions[i-1].String(), payload.OldState)
+				assert.Equal(t, transitions[i].String(), payload.State)
+				assert.Equal(t, evaluationTime.Add(time.Duration(i)*time.Minute), payload.LastEvaluation)
+			case <-time.After(5 * time.Second):
+				t.Fatal("the transition was not posted")
+			}
+		}
+	})
+
+	t.Run("the transition is not retried once the observer is stopped", func(t *testing.T) {
+		srv, attempts, received := serve(t, 100, http.StatusServiceUnavailable)
+		observer := NewWebhookObserver(context.Background(), srv.URL, WebhookOpts{MaxRetries: 3, Backoff: time.Hour})
+		observer.Observe(rule, eval.Pending, s)
+		require.Eventually(t, func() bool { return atomic.LoadInt32(attempts) == 1 }, 5*time.Second, time.Millisecond)
+
+		stopped := make(chan struct{})
+		go func() {
+			observer.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the observer did not stop")
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(attempts))
+		assert.Empty(t, received)
+
+		// Transitions observed after the observer is stopped are dropped.
+		observer.Observe(rule, eval.Pending, s)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int32(1), atomic.LoadInt32(attempts))
+	})
+
+	t.Run("the transition is dropped when the queue is full", func(t *testing.T) {
+		var requests int32
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			<-release
+		}))
+		t.Cleanup(srv.Close)
+		observer := NewWebhookObserver(context.Background(), srv.URL, WebhookOpts{QueueSize: 1, Backoff: time.Millisecond})
+		t.Cleanup(observer.Stop)
+
+		observer.Observe(rule, eval.Pending, s)
+		// The first transition is being posted, so the second fills the queue.
+		require.Eventually(t, func() bool { return atomic.LoadInt32(&requests) == 1 }, 5*time.Second, time.Millisecond)
+		observer.Observe(rule, eval.Pending, s)
+		observer.Observe(rule, eval.Pending, s)
+		close(release)
+
+		require.Eventually(t, func() bool { return atomic.LoadInt32(&requests) == 2 }, 5*time.Second, time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	})
+}